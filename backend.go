@@ -2,11 +2,20 @@ package circleci
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	circleci "github.com/bobthebuilderberlin/go-circleci"
 )
@@ -14,9 +23,31 @@ import (
 type backend struct {
 	*framework.Backend
 
-	// circleciClient is the actual client for connecting to CircleCI. It is cached on
-	// the backend for efficiency.
-	circleciClient *circleci.Client
+	// circleciClients holds the actual clients for connecting to CircleCI as a
+	// map[string]*apiClient keyed by organization name. They are cached
+	// on the backend for efficiency. The map is never modified in place but
+	// swapped atomically, so that requests can share the clients without
+	// locking. clientsLock serializes the creation and reset of clients.
+	circleciClients atomic.Value
+	clientsLock     sync.Mutex
+
+	// vaultClient is the client for minting tokens through the Vault API,
+	// created from config/vault on first use.
+	vaultClient     *api.Client
+	vaultClientLock sync.Mutex
+
+	// contextCache caches the contexts of each organization for resolving
+	// context names to IDs.
+	contextCache *contextCache
+
+	// rotationLocks serialize the rotations of each variable, so that
+	// scheduled and manual rotations of a variable never overlap. The lock of
+	// a variable is picked by its rotation key.
+	rotationLocks []*locksutil.LockEntry
+
+	// variableLocks serialize the updates of the record of each variable, so
+	// that concurrent writes do not drop each other's versions.
+	variableLocks []*locksutil.LockEntry
 
 	// ctx and ctxCancel are used to control overall plugin shutdown. These
 	// contexts are given to any client libraries or requests that should be
@@ -40,20 +71,69 @@ func Backend() *backend {
 	var b backend
 
 	b.ctx, b.ctxCancel = context.WithCancel(context.Background())
+	b.circleciClients.Store(map[string]*apiClient{})
+	b.contextCache = newContextCache()
+	b.rotationLocks = locksutil.CreateLocks()
+	b.variableLocks = locksutil.CreateLocks()
 
 	b.Backend = &framework.Backend{
 		BackendType: logical.TypeLogical,
 		Help:        "CircleCI secrets engine.",
 
+		PathsSpecial: &logical.Paths{
+			SealWrapStorage: []string{
+				"config",
+				vaultConfigKey,
+				"orgs/",
+				variablesPrefix,
+			},
+			LocalStorage: []string{
+				contextCachePrefix,
+			},
+		},
+
 		Paths: []*framework.Path{
 			b.pathConfig(),
+			b.pathConfigAccess(),
+			b.pathConfigVault(),
+			b.pathOrgsList(),
+			b.pathOrgs(),
 			b.pathContext(),
 			b.pathContextEnvList(),
+			b.pathContextDrift(),
 			b.pathContextKey(),
+			b.pathContextKeyValue(),
+			b.pathContextKeyVersions(),
+			b.pathContextKeyRollback(),
+			b.pathSSHKeypair(),
+			b.pathProjectEnvList(),
+			b.pathProjectKey(),
+			b.pathDrift(),
+			b.pathEnforceList(),
+			b.pathEnforce(),
+			b.pathRotateList(),
+			b.pathRotate(),
+			b.pathRotateNow(),
+			b.pathRolesList(),
+			b.pathRoles(),
+			b.pathRoleContext(),
+			b.pathRoleContextKey(),
+			b.pathVaultTokenRolesList(),
+			b.pathVaultTokenRoles(),
+			b.pathVaultToken(),
+		},
+
+		Secrets: []*framework.Secret{
+			b.secretContext(),
+			b.secretVariable(),
+			b.secretVaultToken(),
 		},
 
-		Invalidate: b.invalidate,
-		Clean:      b.clean,
+		Invalidate:        b.invalidate,
+		Clean:             b.clean,
+		PeriodicFunc:      b.periodicFunc,
+		WALRollback:       b.walRollback,
+		WALRollbackMinAge: walRollbackMinAge,
 	}
 
 	return &b
@@ -70,75 +150,211 @@ func (b *backend) clean(_ context.Context) {
 // invalidate resets the plugin. This is called when a key is updated via
 // replication.
 func (b *backend) invalidate(ctx context.Context, key string) {
-	switch key {
-	case "config":
-		b.ResetClient()
+	switch {
+	case key == vaultConfigKey:
+		b.ResetVaultClient()
+	case key == "config":
+		b.ResetClient(defaultOrg)
+		b.contextCache.Invalidate(defaultOrg)
+	case strings.HasPrefix(key, "orgs/"):
+		org := strings.TrimPrefix(key, "orgs/")
+		b.ResetClient(org)
+		b.contextCache.Invalidate(org)
+	case strings.HasPrefix(key, contextCachePrefix):
+		b.contextCache.Invalidate(strings.TrimPrefix(key, contextCachePrefix))
 	}
 }
 
-// ResetClient closes any connected clients.
-func (b *backend) ResetClient() {
-	b.circleciClient = nil
+// ResetClient closes the connected client of the given organization, if any.
+// Requests that already hold the client finish using it, subsequent requests
+// get a new client.
+func (b *backend) ResetClient(org string) {
+	b.clientsLock.Lock()
+	defer b.clientsLock.Unlock()
+
+	clients := b.clients()
+	if _, ok := clients[org]; !ok {
+		return
+	}
+
+	newClients := make(map[string]*apiClient, len(clients))
+	for k, v := range clients {
+		if k != org {
+			newClients[k] = v
+		}
+	}
+	b.circleciClients.Store(newClients)
 }
 
-// CircleCIClient creates a new client for talking to the GCP KMS service.
-func (b *backend) CircleCIClient(s logical.Storage) (*circleci.Client, func(), error) {
+// CircleCIClient returns the client for talking to CircleCI on behalf of the
+// given organization, creating it if needed. The client is safe for
+// concurrent use.
+func (b *backend) CircleCIClient(s logical.Storage, org string) (*apiClient, error) {
 	// If the client already exists and is valid, return it
-	b.ctxLock.Lock()
-	if b.circleciClient != nil {
-		closer := func() { b.ctxLock.Unlock() }
-		return b.circleciClient, closer, nil
+	if client, ok := b.clients()[org]; ok {
+		return client, nil
 	}
 
-	b.Logger().Debug("Creating new CircleCI Client...")
+	b.clientsLock.Lock()
+	defer b.clientsLock.Unlock()
+
+	// Another request may have created the client while waiting for the lock
+	clients := b.clients()
+	if client, ok := clients[org]; ok {
+		return client, nil
+	}
 
-	// Attempt to close an existing client if we have one.
-	b.ResetClient()
+	b.Logger().Debug("Creating new CircleCI Client...", "org", org)
 
 	// Get the config
-	config, err := b.Config(b.ctx, s)
-	b.Logger().Debug("CircleCI configuration:", "config", config)
+	config, err := b.OrgConfig(b.ctx, s, org)
+	if err != nil {
+		return nil, err
+	}
+	b.Logger().Debug("CircleCI configuration:", "org", org, "config", config.Redacted())
 
+	if org != defaultOrg && config.APIToken == "" {
+		return nil, logical.CodedError(404, fmt.Sprintf("organization '%v' is not configured", org))
+	}
+
+	// Create and return the CircleCI client
+	client, err := newCircleCIClient(config)
 	if err != nil {
-		b.ctxLock.Unlock()
-		return nil, nil, err
+		return nil, err
+	}
+
+	b.Logger().Debug("CircleCI client created successfully.")
+
+	// Cache the client
+	newClients := make(map[string]*apiClient, len(clients)+1)
+	for k, v := range clients {
+		newClients[k] = v
+	}
+	newClients[org] = client
+	b.circleciClients.Store(newClients)
+
+	return client, nil
+}
+
+// rateLimitStatus returns the state of the rate limiter of the given
+// organization. Until a client is created, the bucket is full.
+func (b *backend) rateLimitStatus(org string, config *Config) map[string]interface{} {
+	if client, ok := b.clients()[org]; ok {
+		return client.limiter.Status()
 	}
+	return newRateLimiter(config).Status()
+}
+
+// clients returns the currently cached clients. The returned map must not be
+// modified.
+func (b *backend) clients() map[string]*apiClient {
+	return b.circleciClients.Load().(map[string]*apiClient)
+}
 
-	// If credentials were provided, use those. Otherwise fall back to the
-	// default application credentials.
+// newCircleCIClient creates a new CircleCI client from the given configuration.
+func newCircleCIClient(config *Config) (*apiClient, error) {
 	if len(config.APIToken) == 0 {
-		b.ctxLock.Unlock()
-		return nil, nil, errors.New("APIToken must not be empty or nil")
+		return nil, errors.New("APIToken must not be empty or nil")
 	}
 
+	limiter := newRateLimiter(config)
+	clientConfig, err := circleCIConfig(config, limiter)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := circleci.NewClient(clientConfig)
+	if err != nil {
+		return nil, errwrap.Wrapf("Failed to create CircleCI client: {{err}}", err)
+	}
+	return &apiClient{Client: client, config: clientConfig, limiter: limiter}, nil
+}
+
+// circleCIConfig translates the stored configuration into the configuration
+// of the go-circleci client, including the HTTP client used to connect to
+// CircleCI.
+func circleCIConfig(config *Config, limiter *rateLimiter) (*circleci.Config, error) {
 	circleCIConfig := circleci.DefaultConfig()
 	circleCIConfig.Token = config.APIToken
 
-	// Create and return the CircleCI client
-	client, err := circleci.NewClient(circleCIConfig)
+	if config.BaseURL != "" {
+		baseURL, err := url.Parse(config.BaseURL)
+		if err != nil {
+			return nil, errwrap.Wrapf("invalid base-url: {{err}}", err)
+		}
+		if strings.Trim(baseURL.Path, "/") != "" {
+			circleCIConfig.BasePath = baseURL.Path
+		}
+		baseURL.Path = ""
+		circleCIConfig.Address = baseURL.String()
+	}
 
+	httpClient, err := httpClient(config, limiter)
 	if err != nil {
-		b.ctxLock.Unlock()
-		return nil, nil, errwrap.Wrapf("Failed to create CircleCI client: {{err}}", err)
+		return nil, err
 	}
+	circleCIConfig.HTTPClient = httpClient
 
-	b.Logger().Debug("CircleCI client created successfully.")
+	return circleCIConfig, nil
+}
 
-	// Cache the client
-	b.circleciClient = client
-	closer := func() {
-		b.ctxLock.Unlock()
+// httpClient creates the HTTP client for connecting to CircleCI, honoring the
+// configured CA bundle, TLS verification, proxy, timeout and retry policy.
+// Every attempt of a request takes a token from the given rate limiter.
+// Non-2xx responses are returned as *apiError.
+func httpClient(config *Config, limiter *rateLimiter) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.CACert != "" || config.TLSSkipVerify {
+		tlsConfig := &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: config.TLSSkipVerify,
+		}
+		if config.CACert != "" {
+			rootCAs, err := x509.SystemCertPool()
+			if err != nil || rootCAs == nil {
+				rootCAs = x509.NewCertPool()
+			}
+			if ok := rootCAs.AppendCertsFromPEM([]byte(config.CACert)); !ok {
+				return nil, errors.New("invalid ca-cert: no PEM encoded certificates found")
+			}
+			tlsConfig.RootCAs = rootCAs
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, errwrap.Wrapf("invalid proxy-url: {{err}}", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
 	}
-	return client, closer, nil
+
+	return &http.Client{
+		Transport: &apiTransport{
+			next:    transport,
+			retry:   newRetryPolicy(config),
+			limiter: limiter,
+		},
+		Timeout: config.Timeout,
+	}, nil
 }
 
-// Config parses and returns the configuration data from the storage backend.
-// Even when no user-defined data exists in storage, a Config is returned with
-// the default values.
+// Config parses and returns the configuration data of the default organization
+// from the storage backend. Even when no user-defined data exists in storage,
+// a Config is returned with the default values.
 func (b *backend) Config(ctx context.Context, s logical.Storage) (*Config, error) {
+	return b.OrgConfig(ctx, s, defaultOrg)
+}
+
+// OrgConfig parses and returns the configuration data of the given
+// organization from the storage backend. Even when no user-defined data exists
+// in storage, a Config is returned with the default values.
+func (b *backend) OrgConfig(ctx context.Context, s logical.Storage, org string) (*Config, error) {
 	c := DefaultConfig()
 
-	entry, err := s.Get(ctx, "config")
+	entry, err := s.Get(ctx, orgConfigKey(org))
 	if err != nil {
 		return nil, errwrap.Wrapf("failed to get configuration from storage: {{err}}", err)
 	}
@@ -151,3 +367,13 @@ func (b *backend) Config(ctx context.Context, s logical.Storage) (*Config, error
 	}
 	return c, nil
 }
+
+// orgConfigKey returns the storage key of the configuration of the given
+// organization. The default organization is stored at "config" for backwards
+// compatibility.
+func orgConfigKey(org string) string {
+	if org == defaultOrg {
+		return "config"
+	}
+	return "orgs/" + org
+}
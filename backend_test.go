@@ -2,10 +2,18 @@ package circleci
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	circleci "github.com/bobthebuilderberlin/go-circleci"
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // testBackend creates a new isolated instance of the backend for testing.
@@ -43,6 +51,594 @@ func testFieldValidation(tb testing.TB, op logical.Operation, pth string) {
 		tb.Error(err)
 	}
 }
+
+// testAPIToken and testOrgID are the credentials accepted by fakeCircleCI.
+const (
+	testAPIToken = "my-test-token-0123456789"
+	testOrgID    = "my-org-id"
+)
+
+// testBackendWithCircleCI creates a new isolated instance of the backend that
+// is configured to talk to a fake CircleCI server.
+func testBackendWithCircleCI(tb testing.TB) (*backend, logical.Storage, *fakeCircleCI) {
+	tb.Helper()
+
+	b, storage := testBackend(tb)
+	server := newFakeCircleCI(tb)
+
+	config := DefaultConfig()
+	config.APIToken = testAPIToken
+	config.OrgId = testOrgID
+	config.BaseURL = server.URL
+	config.RetryBackoffBase = time.Millisecond
+	config.RetryBackoffCap = 100 * time.Millisecond
+
+	entry, err := logical.StorageEntryJSON("config", config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := storage.Put(context.Background(), entry); err != nil {
+		tb.Fatal(err)
+	}
+	return b, storage, server
+}
+
+// fakeCircleCI is an in-memory implementation of the parts of the CircleCI
+// API used by the plugin.
+type fakeCircleCI struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	contexts []*fakeContext
+	projects map[string][]*fakeProjectVariable
+	nextID   int
+	requests map[string]int
+
+	// pageSize is the number of items returned per page by list endpoints.
+	pageSize int
+
+	// intercept, if set, is called for every request before it is handled.
+	// Returning true marks the request as handled.
+	intercept func(w http.ResponseWriter, r *http.Request) bool
+}
+
+type fakeContext struct {
+	circleci.Context
+	variables []*fakeVariable
+}
+
+type fakeProjectVariable struct {
+	Name      string    `json:"name"`
+	Value     string    `json:"value"`
+	CreatedAt time.Time `json:"created_at"`
+	value     string
+}
+
+type fakeVariable struct {
+	Variable  string    `json:"variable"`
+	ContextID string    `json:"context_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	value     string
+}
+
+// newFakeCircleCI starts a new fake CircleCI server that is shut down when
+// the test finishes.
+func newFakeCircleCI(tb testing.TB) *fakeCircleCI {
+	tb.Helper()
+
+	f := &fakeCircleCI{
+		requests: make(map[string]int),
+		projects: make(map[string][]*fakeProjectVariable),
+		pageSize: 20,
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	tb.Cleanup(f.Close)
+	return f
+}
+
+// newFakeCircleCITLS is like newFakeCircleCI, but the server uses TLS with a
+// self-signed certificate.
+func newFakeCircleCITLS(tb testing.TB) *fakeCircleCI {
+	tb.Helper()
+
+	f := &fakeCircleCI{
+		requests: make(map[string]int),
+		projects: make(map[string][]*fakeProjectVariable),
+		pageSize: 20,
+	}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(f.serveHTTP))
+	tb.Cleanup(f.Close)
+	return f
+}
+
+// Requests returns the number of requests received for the given method and
+// API path, e.g. "GET context".
+func (f *fakeCircleCI) Requests(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[key]
+}
+
+// SetIntercept replaces the request interceptor.
+func (f *fakeCircleCI) SetIntercept(intercept func(w http.ResponseWriter, r *http.Request) bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.intercept = intercept
+}
+
+// AddContext creates a context with the given variables and returns its ID.
+func (f *fakeCircleCI) AddContext(name string, variables ...string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := f.addContext(name)
+	for _, v := range variables {
+		f.setVariable(c, v, "")
+	}
+	return c.ID
+}
+
+// Context returns the context with the given name, or nil.
+func (f *fakeCircleCI) Context(name string) *fakeContext {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.contextByName(name)
+}
+
+// Variable returns a copy of the named variable in the named context, or nil.
+func (f *fakeCircleCI) Variable(contextName, name string) *fakeVariable {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := f.contextByName(contextName)
+	if c == nil {
+		return nil
+	}
+	for _, v := range c.variables {
+		if v.Variable == name {
+			cp := *v
+			return &cp
+		}
+	}
+	return nil
+}
+
+// SetVariable creates or updates the named variable in the named context, as
+// if it was changed outside of Vault.
+func (f *fakeCircleCI) SetVariable(contextName, name, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.setVariable(f.contextByName(contextName), name, value)
+}
+
+// RemoveVariable removes the named variable from the named context.
+func (f *fakeCircleCI) RemoveVariable(contextName, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := f.contextByName(contextName)
+	for i, v := range c.variables {
+		if v.Variable == name {
+			c.variables = append(c.variables[:i], c.variables[i+1:]...)
+			return
+		}
+	}
+}
+
+// RemoveContext removes the named context, as if it was deleted outside of
+// Vault.
+func (f *fakeCircleCI) RemoveContext(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, c := range f.contexts {
+		if c.Name == name {
+			f.contexts = append(f.contexts[:i], f.contexts[i+1:]...)
+			return
+		}
+	}
+}
+
+// Value returns the value of the named variable in the named context.
+func (f *fakeCircleCI) Value(contextName, name string) string {
+	if v := f.Variable(contextName, name); v != nil {
+		return v.value
+	}
+	return ""
+}
+
+// AddProject creates a project with the given slug, e.g. gh/my-org/my-repo.
+func (f *fakeCircleCI) AddProject(slug string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.projects[slug] = nil
+}
+
+// ProjectValue returns the value of the named variable in the given project.
+func (f *fakeCircleCI) ProjectValue(slug, name string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, v := range f.projects[slug] {
+		if v.Name == name {
+			return v.value, true
+		}
+	}
+	return "", false
+}
+
+func (f *fakeCircleCI) setProjectVariable(slug, name, value string) *fakeProjectVariable {
+	masked := value
+	if len(masked) > 4 {
+		masked = masked[len(masked)-4:]
+	}
+	v := &fakeProjectVariable{
+		Name:      name,
+		Value:     "xxxx" + masked,
+		CreatedAt: time.Now().UTC(),
+		value:     value,
+	}
+	for i, existing := range f.projects[slug] {
+		if existing.Name == name {
+			f.projects[slug][i] = v
+			return v
+		}
+	}
+	f.projects[slug] = append(f.projects[slug], v)
+	return v
+}
+
+func (f *fakeCircleCI) addContext(name string) *fakeContext {
+	f.nextID++
+	c := &fakeContext{Context: circleci.Context{
+		ID:        fmt.Sprintf("context-id-%d", f.nextID),
+		Name:      name,
+		CreatedAt: time.Now().UTC(),
+	}}
+	f.contexts = append(f.contexts, c)
+	return c
+}
+
+func (f *fakeCircleCI) contextByName(name string) *fakeContext {
+	for _, c := range f.contexts {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (f *fakeCircleCI) contextByID(id string) *fakeContext {
+	for _, c := range f.contexts {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+func (f *fakeCircleCI) setVariable(c *fakeContext, name, value string) *fakeVariable {
+	now := time.Now().UTC()
+	for _, v := range c.variables {
+		if v.Variable == name {
+			v.value = value
+			v.UpdatedAt = now
+			return v
+		}
+	}
+	v := &fakeVariable{
+		Variable:  name,
+		ContextID: c.ID,
+		CreatedAt: now,
+		UpdatedAt: now,
+		value:     value,
+	}
+	c.variables = append(c.variables, v)
+	return v
+}
+
+func (f *fakeCircleCI) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v2/")
+	parts := strings.Split(path, "/")
+
+	f.mu.Lock()
+	f.requests[r.Method+" "+path]++
+	intercept := f.intercept
+	f.mu.Unlock()
+
+	if intercept != nil && intercept(w, r) {
+		return
+	}
+
+	if r.Header.Get("Circle-Token") != testAPIToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"message": "Invalid token provided."}`)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == "GET" && path == "me":
+		fmt.Fprint(w, `{"id": "my-user-id", "login": "my-user", "name": "My User"}`)
+	case r.Method == "GET" && path == "me/collaborations":
+		fmt.Fprintf(w, `[{"id": %q, "vcs-type": "github", "name": "my-org", "slug": "gh/my-org"}]`, testOrgID)
+	case r.Method == "GET" && path == "context":
+		if r.URL.Query().Get("owner-id") != testOrgID {
+			f.writeJSON(w, http.StatusNotFound, map[string]string{"message": "Owner not found."})
+			return
+		}
+		items := make([]interface{}, len(f.contexts))
+		for i, c := range f.contexts {
+			items[i] = c.Context
+		}
+		f.writePage(w, r, items)
+	case r.Method == "POST" && path == "context":
+		var body circleci.ContextCreateOptions
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Name == nil {
+			f.writeJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid request body."})
+			return
+		}
+		if f.contextByName(*body.Name) != nil {
+			f.writeJSON(w, http.StatusConflict, map[string]string{"message": "A context with this name already exists."})
+			return
+		}
+		f.writeJSON(w, http.StatusOK, f.addContext(*body.Name).Context)
+	case len(parts) == 2 && parts[0] == "context":
+		c := f.contextByID(parts[1])
+		if c == nil {
+			f.writeJSON(w, http.StatusNotFound, map[string]string{"message": "Context not found."})
+			return
+		}
+		switch r.Method {
+		case "GET":
+			f.writeJSON(w, http.StatusOK, c.Context)
+		case "DELETE":
+			for i := range f.contexts {
+				if f.contexts[i] == c {
+					f.contexts = append(f.contexts[:i], f.contexts[i+1:]...)
+					break
+				}
+			}
+			f.writeJSON(w, http.StatusOK, map[string]string{"message": "Context deleted."})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case len(parts) >= 3 && parts[0] == "context" && parts[2] == "environment-variable":
+		c := f.contextByID(parts[1])
+		if c == nil {
+			f.writeJSON(w, http.StatusNotFound, map[string]string{"message": "Context not found."})
+			return
+		}
+		switch {
+		case len(parts) == 3 && r.Method == "GET":
+			items := make([]interface{}, len(c.variables))
+			for i, v := range c.variables {
+				items[i] = v
+			}
+			f.writePage(w, r, items)
+		case len(parts) == 4 && r.Method == "PUT":
+			var body circleci.ContextAddOrUpdateVariableOptions
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Value == nil {
+				f.writeJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid request body."})
+				return
+			}
+			f.writeJSON(w, http.StatusOK, f.setVariable(c, parts[3], *body.Value))
+		case len(parts) == 4 && r.Method == "DELETE":
+			for i, v := range c.variables {
+				if v.Variable == parts[3] {
+					c.variables = append(c.variables[:i], c.variables[i+1:]...)
+					f.writeJSON(w, http.StatusOK, map[string]string{"message": "Environment variable deleted."})
+					return
+				}
+			}
+			f.writeJSON(w, http.StatusNotFound, map[string]string{"message": "Environment variable not found."})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case len(parts) >= 5 && parts[0] == "project" && parts[4] == "envvar":
+		slug := strings.Join(parts[1:4], "/")
+		variables, ok := f.projects[slug]
+		if !ok {
+			f.writeJSON(w, http.StatusNotFound, map[string]string{"message": "Project not found"})
+			return
+		}
+		switch {
+		case len(parts) == 5 && r.Method == "GET":
+			items := make([]interface{}, len(variables))
+			for i, v := range variables {
+				items[i] = v
+			}
+			f.writePage(w, r, items)
+		case len(parts) == 5 && r.Method == "POST":
+			var body circleci.ProjectCreateVariableOptions
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Name == nil || body.Value == nil {
+				f.writeJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid request body."})
+				return
+			}
+			f.writeJSON(w, http.StatusCreated, f.setProjectVariable(slug, *body.Name, *body.Value))
+		case len(parts) == 6 && (r.Method == "GET" || r.Method == "DELETE"):
+			for i, v := range variables {
+				if v.Name != parts[5] {
+					continue
+				}
+				if r.Method == "DELETE" {
+					f.projects[slug] = append(variables[:i], variables[i+1:]...)
+					f.writeJSON(w, http.StatusOK, map[string]string{"message": "Environment variable deleted."})
+					return
+				}
+				f.writeJSON(w, http.StatusOK, v)
+				return
+			}
+			f.writeJSON(w, http.StatusNotFound, map[string]string{"message": "Environment variable not found."})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	default:
+		f.writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not found."})
+	}
+}
+
+// writePage writes the page of items selected by the request's page-token.
+func (f *fakeCircleCI) writePage(w http.ResponseWriter, r *http.Request, items []interface{}) {
+	start, _ := strconv.Atoi(r.URL.Query().Get("page-token"))
+	if start > len(items) {
+		start = len(items)
+	}
+	end := start + f.pageSize
+	nextPageToken := ""
+	if end < len(items) {
+		nextPageToken = strconv.Itoa(end)
+	} else {
+		end = len(items)
+	}
+	f.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"items":           items[start:end],
+		"next_page_token": nextPageToken,
+	})
+}
+
+func (f *fakeCircleCI) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestBackend_CircleCIClient(t *testing.T) {
+	t.Parallel()
+
+	t.Run("caches", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, _ := testBackendWithCircleCI(t)
+
+		client1, err := b.CircleCIClient(storage, defaultOrg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client2, err := b.CircleCIClient(storage, defaultOrg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Note: not a bug; literally checking object equality
+		if client1 != client2 {
+			t.Errorf("expected %#v to be %#v", client1, client2)
+		}
+	})
+
+	t.Run("invalidate", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, _ := testBackendWithCircleCI(t)
+
+		client1, err := b.CircleCIClient(storage, defaultOrg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.invalidate(context.Background(), "config")
+		client2, err := b.CircleCIClient(storage, defaultOrg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if client1 == client2 {
+			t.Errorf("expected %#v to not be %#v", client1, client2)
+		}
+	})
+
+	t.Run("concurrent_creation", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, _ := testBackendWithCircleCI(t)
+
+		var wg sync.WaitGroup
+		clients := make([]*apiClient, 10)
+		for i := range clients {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				client, err := b.CircleCIClient(storage, defaultOrg)
+				if err != nil {
+					t.Error(err)
+				}
+				clients[i] = client
+				b.ResetClient("unrelated")
+			}(i)
+		}
+		wg.Wait()
+
+		for _, client := range clients {
+			if client != clients[0] {
+				t.Errorf("expected all requests to share one client")
+			}
+		}
+	})
+}
+
+// TestBackend_ConcurrentRequests verifies that requests to the mount are not
+// serialized: the fake server holds back the variable call of every Vault
+// request until all of them are in flight at the same time.
+func TestBackend_ConcurrentRequests(t *testing.T) {
+	t.Parallel()
+
+	b, storage, server := testBackendWithCircleCI(t)
+	server.AddContext("my-context", "FOO")
+
+	const parallel = 8
+	var mu sync.Mutex
+	arrived := 0
+	allInFlight := make(chan struct{})
+	server.SetIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if !strings.Contains(r.URL.Path, "/environment-variable") {
+			return false
+		}
+
+		mu.Lock()
+		if arrived == parallel {
+			mu.Unlock()
+			return false
+		}
+		arrived++
+		if arrived == parallel {
+			close(allInFlight)
+		}
+		mu.Unlock()
+
+		select {
+		case <-allInFlight:
+			return false
+		case <-time.After(5 * time.Second):
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return true
+		}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			req := &logical.Request{
+				Storage:   storage,
+				Operation: logical.ListOperation,
+				Path:      "context/my-context/",
+			}
+			if i%2 == 1 {
+				req.Operation = logical.UpdateOperation
+				req.Path = "context/my-context/FOO"
+				req.Data = map[string]interface{}{"value": strconv.Itoa(i)}
+			}
+			if _, err := b.HandleRequest(context.Background(), req); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
 //
 //// testKMSClient creates a new KMS client with the default scopes and user
 //// agent.
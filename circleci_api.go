@@ -0,0 +1,261 @@
+package circleci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	circleci "github.com/bobthebuilderberlin/go-circleci"
+)
+
+// apiClient is the client for talking to CircleCI. It embeds the go-circleci
+// client and keeps its configuration for the API calls and fields go-circleci
+// does not cover, as well as the rate limiter shared by all its requests.
+type apiClient struct {
+	*circleci.Client
+
+	config  *circleci.Config
+	limiter *rateLimiter
+}
+
+// apiCollaboration is an organization the owner of the API token collaborates
+// on. go-circleci does not decode the organization's ID and slug.
+type apiCollaboration struct {
+	ID      string `json:"id"`
+	VcsType string `json:"vcs-type"`
+	Name    string `json:"name"`
+	Slug    string `json:"slug"`
+}
+
+// Collaborations lists the organizations the owner of the API token has
+// access to.
+func (c *apiClient) Collaborations(ctx context.Context) ([]*apiCollaboration, error) {
+	var cs []*apiCollaboration
+	if err := getJSON(ctx, c.config, "me/collaborations", nil, &cs); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// apiContextVariable is an environment variable of a context. Unlike
+// circleci.ContextVariable, it includes the time of the last update.
+type apiContextVariable struct {
+	Variable  string    `json:"variable"`
+	ContextID string    `json:"context_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// apiContextVariableList is a page of environment variables of a context.
+type apiContextVariableList struct {
+	Items         []*apiContextVariable `json:"items"`
+	NextPageToken string                `json:"next_page_token"`
+}
+
+// ListContextVariables lists one page of the environment variables of the
+// given context. go-circleci only ever requests the first page.
+func (c *apiClient) ListContextVariables(ctx context.Context, contextID, pageToken string) (*apiContextVariableList, error) {
+	if contextID == "" {
+		return nil, circleci.ErrRequiredContextID
+	}
+
+	query := url.Values{}
+	if pageToken != "" {
+		query.Set("page-token", pageToken)
+	}
+
+	list := &apiContextVariableList{}
+	if err := getJSON(ctx, c.config, "context/"+contextID+"/environment-variable", query, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// AllContextVariables walks through all pages of the environment variables of
+// the given context.
+func (c *apiClient) AllContextVariables(ctx context.Context, contextID string) ([]*apiContextVariable, error) {
+	var variables []*apiContextVariable
+	var nextPageToken string
+	for {
+		list, err := c.ListContextVariables(ctx, contextID, nextPageToken)
+		if err != nil {
+			return nil, err
+		}
+		variables = append(variables, list.Items...)
+		if list.NextPageToken == "" {
+			return variables, nil
+		}
+		nextPageToken = list.NextPageToken
+	}
+}
+
+// AddOrUpdateContextVariable creates or updates an environment variable of the
+// given context. Unlike go-circleci, it returns the time of the update.
+func (c *apiClient) AddOrUpdateContextVariable(ctx context.Context, contextID, variable, value string) (*apiContextVariable, error) {
+	if contextID == "" {
+		return nil, circleci.ErrRequiredContextID
+	}
+	if variable == "" {
+		return nil, circleci.ErrRequiredEnvironmentVariableName
+	}
+	if value == "" {
+		return nil, circleci.ErrRequiredEnvironmentVariableValue
+	}
+
+	contextVariable := &apiContextVariable{}
+	body := map[string]string{"value": value}
+	if err := doJSON(ctx, c.config, http.MethodPut, "context/"+contextID+"/environment-variable/"+variable, nil, body, contextVariable); err != nil {
+		return nil, err
+	}
+	return contextVariable, nil
+}
+
+// apiProjectVariable is an environment variable of a project. Unlike
+// circleci.ProjectVariable, it includes the time of its creation. CircleCI
+// only returns the value masked.
+type apiProjectVariable struct {
+	Name      string    `json:"name"`
+	Value     string    `json:"value"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// apiProjectVariableList is a page of environment variables of a project.
+type apiProjectVariableList struct {
+	Items         []*apiProjectVariable `json:"items"`
+	NextPageToken string                `json:"next_page_token"`
+}
+
+// ListProjectVariables lists one page of the environment variables of the
+// project with the given slug, e.g. gh/my-org/my-repo. go-circleci only ever
+// requests the first page.
+func (c *apiClient) ListProjectVariables(ctx context.Context, projectSlug, pageToken string) (*apiProjectVariableList, error) {
+	if projectSlug == "" {
+		return nil, circleci.ErrRequiredProjectSlug
+	}
+
+	query := url.Values{}
+	if pageToken != "" {
+		query.Set("page-token", pageToken)
+	}
+
+	list := &apiProjectVariableList{}
+	if err := getJSON(ctx, c.config, "project/"+projectSlug+"/envvar", query, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// AllProjectVariables walks through all pages of the environment variables of
+// the given project.
+func (c *apiClient) AllProjectVariables(ctx context.Context, projectSlug string) ([]*apiProjectVariable, error) {
+	var variables []*apiProjectVariable
+	var nextPageToken string
+	for {
+		list, err := c.ListProjectVariables(ctx, projectSlug, nextPageToken)
+		if err != nil {
+			return nil, err
+		}
+		variables = append(variables, list.Items...)
+		if list.NextPageToken == "" {
+			return variables, nil
+		}
+		nextPageToken = list.NextPageToken
+	}
+}
+
+// ProjectVariable returns the named environment variable of the given
+// project, with its value masked.
+func (c *apiClient) ProjectVariable(ctx context.Context, projectSlug, name string) (*apiProjectVariable, error) {
+	if projectSlug == "" {
+		return nil, circleci.ErrRequiredProjectSlug
+	}
+	if name == "" {
+		return nil, circleci.ErrRequiredProjectVariableName
+	}
+
+	projectVariable := &apiProjectVariable{}
+	if err := getJSON(ctx, c.config, "project/"+projectSlug+"/envvar/"+name, nil, projectVariable); err != nil {
+		return nil, err
+	}
+	return projectVariable, nil
+}
+
+// CreateProjectVariable creates or replaces an environment variable of the
+// given project. Unlike go-circleci, it returns the time of the creation.
+func (c *apiClient) CreateProjectVariable(ctx context.Context, projectSlug, name, value string) (*apiProjectVariable, error) {
+	if projectSlug == "" {
+		return nil, circleci.ErrRequiredProjectSlug
+	}
+	if name == "" {
+		return nil, circleci.ErrRequiredProjectVariableName
+	}
+	if value == "" {
+		return nil, circleci.ErrRequiredProjectVariableValue
+	}
+
+	projectVariable := &apiProjectVariable{}
+	body := map[string]string{"name": name, "value": value}
+	if err := doJSON(ctx, c.config, http.MethodPost, "project/"+projectSlug+"/envvar", nil, body, projectVariable); err != nil {
+		return nil, err
+	}
+	return projectVariable, nil
+}
+
+// getJSON performs a GET request against the CircleCI API described by the
+// given client configuration and decodes the JSON response into v. It is only
+// used for the endpoints or fields go-circleci does not cover. Non-2xx
+// responses are reported as *apiError by the client's transport.
+func getJSON(ctx context.Context, cfg *circleci.Config, path string, query url.Values, v interface{}) error {
+	return doJSON(ctx, cfg, http.MethodGet, path, query, nil, v)
+}
+
+// doJSON performs a request with the given method against the CircleCI API,
+// with body encoded as JSON unless it is nil, and decodes the JSON response
+// into v.
+func doJSON(ctx context.Context, cfg *circleci.Config, method, path string, query url.Values, body, v interface{}) error {
+	u, err := url.Parse(cfg.Address)
+	if err != nil {
+		return err
+	}
+	u.Path = strings.TrimSuffix(cfg.BasePath, "/") + "/" + path
+	u.RawQuery = query.Encode()
+
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reqBody)
+	if err != nil {
+		return err
+	}
+	for k, v := range cfg.Headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Circle-Token", cfg.Token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
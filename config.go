@@ -1,14 +1,70 @@
 package circleci
 
 import (
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"github.com/hashicorp/vault/sdk/framework"
+	"net/url"
 	"strings"
+	"time"
+)
+
+// defaultTimeout is the default timeout of a single request to CircleCI,
+// including its retries.
+const defaultTimeout = 60 * time.Second
+
+// The defaults of the retry policy for requests to CircleCI.
+const (
+	defaultRetryMaxAttempts = 3
+	defaultRetryBackoffBase = 1 * time.Second
+	defaultRetryBackoffCap  = 30 * time.Second
 )
 
 // Config is the stored configuration.
 type Config struct {
 	APIToken string `json:"api-token"`
 	OrgId    string `json:"org-id"`
+
+	// BaseURL, CACert, TLSSkipVerify, ProxyURL and Timeout configure the
+	// connection to CircleCI, e.g. to a self-hosted CircleCI server.
+	BaseURL       string        `json:"base-url,omitempty"`
+	CACert        string        `json:"ca-cert,omitempty"`
+	TLSSkipVerify bool          `json:"tls-skip-verify,omitempty"`
+	ProxyURL      string        `json:"proxy-url,omitempty"`
+	Timeout       time.Duration `json:"timeout,omitempty"`
+
+	// ContextCacheTTL and ContextCachePersist configure the cache of the
+	// organization's contexts. A TTL of 0 disables the cache.
+	ContextCacheTTL     time.Duration `json:"context-cache-ttl"`
+	ContextCachePersist bool          `json:"context-cache-persist,omitempty"`
+
+	// RetryMaxAttempts, RetryBackoffBase, RetryBackoffCap and RetryJitter
+	// configure the retries of idempotent requests to CircleCI that failed
+	// with a 429, a 5xx or a connection error.
+	RetryMaxAttempts int           `json:"retry-max-attempts"`
+	RetryBackoffBase time.Duration `json:"retry-backoff-base"`
+	RetryBackoffCap  time.Duration `json:"retry-backoff-cap"`
+	RetryJitter      bool          `json:"retry-jitter"`
+
+	// RateLimit and RateLimitBurst configure the token bucket that limits the
+	// requests per second to CircleCI. A RateLimit of 0 disables the limit.
+	RateLimit      float64 `json:"rate-limit,omitempty"`
+	RateLimitBurst int     `json:"rate-limit-burst,omitempty"`
+
+	// StoreValues enables storing the values of the environment variables
+	// written through Vault, so that they can be read back.
+	StoreValues bool `json:"store-values,omitempty"`
+
+	// MaxVersions is the number of stored versions kept per environment
+	// variable. 0 means defaultMaxVersions.
+	MaxVersions int `json:"max-versions,omitempty"`
+
+	// OrgName, OrgSlug and TokenOwner are resolved from CircleCI when the
+	// configuration is verified.
+	OrgName    string `json:"org-name,omitempty"`
+	OrgSlug    string `json:"org-slug,omitempty"`
+	TokenOwner string `json:"token-owner,omitempty"`
 }
 
 // DefaultConfig returns a config with the default values.
@@ -16,9 +72,29 @@ func DefaultConfig() *Config {
 	return &Config{
 		APIToken: "",
 		OrgId:    "",
+		Timeout:  defaultTimeout,
+
+		ContextCacheTTL: defaultContextCacheTTL,
+
+		RetryMaxAttempts: defaultRetryMaxAttempts,
+		RetryBackoffBase: defaultRetryBackoffBase,
+		RetryBackoffCap:  defaultRetryBackoffCap,
+		RetryJitter:      true,
 	}
 }
 
+// Redacted returns a copy of the configuration that is safe to log or return,
+// with the API token replaced by its fingerprint.
+func (c *Config) Redacted() *Config {
+	if c == nil {
+		return nil
+	}
+	redacted := *c
+	redacted.APIToken = tokenFingerprint(c.APIToken)
+	redacted.ProxyURL = redactURL(c.ProxyURL)
+	return &redacted
+}
+
 // Update updates the configuration from the given field data.
 func (c *Config) Update(d *framework.FieldData) (bool, error) {
 	if d == nil {
@@ -43,5 +119,214 @@ func (c *Config) Update(d *framework.FieldData) (bool, error) {
 		}
 	}
 
+	if v, ok := d.GetOk("base-url"); ok {
+		nv := strings.TrimSuffix(strings.TrimSpace(v.(string)), "/")
+		if nv != "" {
+			if err := validateHTTPURL(nv); err != nil {
+				return false, fmt.Errorf("invalid base-url: %v", err)
+			}
+		}
+		if nv != c.BaseURL {
+			c.BaseURL = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("ca-cert"); ok {
+		nv := strings.TrimSpace(v.(string))
+		if nv != "" {
+			if ok := x509.NewCertPool().AppendCertsFromPEM([]byte(nv)); !ok {
+				return false, errors.New("invalid ca-cert: no PEM encoded certificates found")
+			}
+		}
+		if nv != c.CACert {
+			c.CACert = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("tls-skip-verify"); ok {
+		nv := v.(bool)
+		if nv != c.TLSSkipVerify {
+			c.TLSSkipVerify = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("proxy-url"); ok {
+		nv := strings.TrimSpace(v.(string))
+		if nv != "" {
+			if err := validateHTTPURL(nv); err != nil {
+				return false, fmt.Errorf("invalid proxy-url: %v", err)
+			}
+		}
+		if nv != c.ProxyURL {
+			c.ProxyURL = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("timeout"); ok {
+		nv := time.Duration(v.(int)) * time.Second
+		if nv < 0 {
+			return false, errors.New("timeout must not be negative")
+		}
+		if nv == 0 {
+			nv = defaultTimeout
+		}
+		if nv != c.Timeout {
+			c.Timeout = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("context-cache-ttl"); ok {
+		nv := time.Duration(v.(int)) * time.Second
+		if nv < 0 {
+			return false, errors.New("context-cache-ttl must not be negative")
+		}
+		if nv != c.ContextCacheTTL {
+			c.ContextCacheTTL = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("context-cache-persist"); ok {
+		nv := v.(bool)
+		if nv != c.ContextCachePersist {
+			c.ContextCachePersist = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("retry-max-attempts"); ok {
+		nv := v.(int)
+		if nv < 0 {
+			return false, errors.New("retry-max-attempts must not be negative")
+		}
+		if nv == 0 {
+			nv = defaultRetryMaxAttempts
+		}
+		if nv != c.RetryMaxAttempts {
+			c.RetryMaxAttempts = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("retry-backoff-base"); ok {
+		nv := time.Duration(v.(int)) * time.Second
+		if nv < 0 {
+			return false, errors.New("retry-backoff-base must not be negative")
+		}
+		if nv == 0 {
+			nv = defaultRetryBackoffBase
+		}
+		if nv != c.RetryBackoffBase {
+			c.RetryBackoffBase = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("retry-backoff-cap"); ok {
+		nv := time.Duration(v.(int)) * time.Second
+		if nv < 0 {
+			return false, errors.New("retry-backoff-cap must not be negative")
+		}
+		if nv == 0 {
+			nv = defaultRetryBackoffCap
+		}
+		if nv != c.RetryBackoffCap {
+			c.RetryBackoffCap = nv
+			changed = true
+		}
+	}
+
+	if c.RetryBackoffCap < c.RetryBackoffBase {
+		return false, errors.New("retry-backoff-cap must not be less than retry-backoff-base")
+	}
+
+	if v, ok := d.GetOk("retry-jitter"); ok {
+		nv := v.(bool)
+		if nv != c.RetryJitter {
+			c.RetryJitter = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("rate-limit"); ok {
+		nv := v.(float64)
+		if nv < 0 {
+			return false, errors.New("rate-limit must not be negative")
+		}
+		if nv != c.RateLimit {
+			c.RateLimit = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("rate-limit-burst"); ok {
+		nv := v.(int)
+		if nv < 0 {
+			return false, errors.New("rate-limit-burst must not be negative")
+		}
+		if nv != c.RateLimitBurst {
+			c.RateLimitBurst = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("store-values"); ok {
+		nv := v.(bool)
+		if nv != c.StoreValues {
+			c.StoreValues = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("max-versions"); ok {
+		nv := v.(int)
+		if nv < 0 {
+			return false, errors.New("max-versions must not be negative")
+		}
+		if nv != c.MaxVersions {
+			c.MaxVersions = nv
+			changed = true
+		}
+	}
+
 	return changed, nil
 }
+
+// maxVersions returns the number of stored versions kept per environment
+// variable.
+func (c *Config) maxVersions() int {
+	if c.MaxVersions <= 0 {
+		return defaultMaxVersions
+	}
+	return c.MaxVersions
+}
+
+// validateHTTPURL checks that the given string is an absolute http or https
+// URL.
+func validateHTTPURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https, got %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("missing host")
+	}
+	return nil
+}
+
+// redactURL removes the password from the given URL, if any.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	return u.Redacted()
+}
@@ -1,154 +1,182 @@
 package circleci
-//
-//import (
-//	"reflect"
-//	"testing"
-//
-//	"github.com/hashicorp/vault/sdk/framework"
-//)
-//
-//func TestConfig_Update(t *testing.T) {
-//	t.Parallel()
-//
-//	cases := []struct {
-//		name    string
-//		new     *Config
-//		d       *framework.FieldData
-//		r       *Config
-//		changed bool
-//		err     bool
-//	}{
-//		{
-//			"empty",
-//			&Config{},
-//			nil,
-//			&Config{},
-//			false,
-//			false,
-//		},
-//		{
-//			"keeps_existing",
-//			&Config{
-//				Credentials: "creds",
-//			},
-//			nil,
-//			&Config{
-//				Credentials: "creds",
-//			},
-//			false,
-//			false,
-//		},
-//		{
-//			"overwrites_changes",
-//			&Config{
-//				Credentials: "creds",
-//			},
-//			&framework.FieldData{
-//				Raw: map[string]interface{}{
-//					"credentials": "foo",
-//				},
-//			},
-//			&Config{
-//				Credentials: "foo",
-//			},
-//			true,
-//			false,
-//		},
-//		{
-//			"overwrites_and_new",
-//			&Config{
-//				Credentials: "creds",
-//			},
-//			&framework.FieldData{
-//				Raw: map[string]interface{}{
-//					"credentials": "foo",
-//					"scopes":      "bar",
-//				},
-//			},
-//			&Config{
-//				Credentials: "foo",
-//				Scopes:      []string{"bar"},
-//			},
-//			true,
-//			false,
-//		},
-//		{
-//			"no_changes_order",
-//			&Config{
-//				Scopes: []string{"bar", "foo"},
-//			},
-//			&framework.FieldData{
-//				Raw: map[string]interface{}{
-//					"scopes": "foo,bar",
-//				},
-//			},
-//			&Config{
-//				Scopes: []string{"bar", "foo"},
-//			},
-//			false,
-//			false,
-//		},
-//		{
-//			"no_changes_caps",
-//			&Config{
-//				Scopes: []string{"bar", "foo"},
-//			},
-//			&framework.FieldData{
-//				Raw: map[string]interface{}{
-//					"scopes": "FOO,baR",
-//				},
-//			},
-//			&Config{
-//				Scopes: []string{"bar", "foo"},
-//			},
-//			false,
-//			false,
-//		},
-//		{
-//			"no_changes_dupes",
-//			&Config{
-//				Scopes: []string{"bar", "foo"},
-//			},
-//			&framework.FieldData{
-//				Raw: map[string]interface{}{
-//					"scopes": "foo, foo, foo, bar",
-//				},
-//			},
-//			&Config{
-//				Scopes: []string{"bar", "foo"},
-//			},
-//			false,
-//			false,
-//		},
-//	}
-//
-//	for _, tc := range cases {
-//		tc := tc
-//
-//		t.Run(tc.name, func(t *testing.T) {
-//			t.Parallel()
-//
-//			if tc.d != nil {
-//				var b backend
-//				tc.d.Schema = b.pathConfig().Fields
-//			}
-//
-//			changed, err := tc.new.Update(tc.d)
-//			if (err != nil) != tc.err {
-//				t.Fatal(err)
-//			}
-//
-//			if changed != tc.changed {
-//				t.Errorf("expected %t to be %t", changed, tc.changed)
-//			}
-//
-//			if v, exp := tc.new.Scopes, tc.r.Scopes; !reflect.DeepEqual(v, exp) {
-//				t.Errorf("expected %q to be %q", v, exp)
-//			}
-//
-//			if v, exp := tc.new.Credentials, tc.r.Credentials; v != exp {
-//				t.Errorf("expected %q to be %q", v, exp)
-//			}
-//		})
-//	}
-//}
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+)
+
+func TestConfig_Update(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		new     *Config
+		d       *framework.FieldData
+		r       *Config
+		changed bool
+		err     bool
+	}{
+		{
+			"empty",
+			&Config{},
+			nil,
+			&Config{},
+			false,
+			false,
+		},
+		{
+			"keeps_existing",
+			&Config{
+				APIToken: "token",
+			},
+			nil,
+			&Config{
+				APIToken: "token",
+			},
+			false,
+			false,
+		},
+		{
+			"overwrites_changes",
+			&Config{
+				APIToken: "token",
+			},
+			&framework.FieldData{
+				Raw: map[string]interface{}{
+					"api-token": "foo",
+				},
+			},
+			&Config{
+				APIToken: "foo",
+			},
+			true,
+			false,
+		},
+		{
+			"connection",
+			&Config{
+				APIToken: "token",
+			},
+			&framework.FieldData{
+				Raw: map[string]interface{}{
+					"base-url":        "https://circleci.example.com/",
+					"proxy-url":       "http://proxy.example.com:3128",
+					"tls-skip-verify": true,
+					"timeout":         "10s",
+				},
+			},
+			&Config{
+				APIToken:      "token",
+				BaseURL:       "https://circleci.example.com",
+				ProxyURL:      "http://proxy.example.com:3128",
+				TLSSkipVerify: true,
+				Timeout:       10 * time.Second,
+			},
+			true,
+			false,
+		},
+		{
+			"invalid_base_url",
+			&Config{},
+			&framework.FieldData{
+				Raw: map[string]interface{}{
+					"base-url": "circleci.example.com",
+				},
+			},
+			&Config{},
+			false,
+			true,
+		},
+		{
+			"invalid_ca_cert",
+			&Config{},
+			&framework.FieldData{
+				Raw: map[string]interface{}{
+					"ca-cert": "foo",
+				},
+			},
+			&Config{},
+			false,
+			true,
+		},
+		{
+			"retry",
+			DefaultConfig(),
+			&framework.FieldData{
+				Raw: map[string]interface{}{
+					"retry-max-attempts": 5,
+					"retry-backoff-base": "2s",
+					"retry-backoff-cap":  "1m",
+					"retry-jitter":       false,
+				},
+			},
+			&Config{
+				Timeout:          defaultTimeout,
+				ContextCacheTTL:  defaultContextCacheTTL,
+				RetryMaxAttempts: 5,
+				RetryBackoffBase: 2 * time.Second,
+				RetryBackoffCap:  time.Minute,
+				RetryJitter:      false,
+			},
+			true,
+			false,
+		},
+		{
+			"retry_cap_below_base",
+			DefaultConfig(),
+			&framework.FieldData{
+				Raw: map[string]interface{}{
+					"retry-backoff-base": "10s",
+					"retry-backoff-cap":  "5s",
+				},
+			},
+			DefaultConfig(),
+			false,
+			true,
+		},
+		{
+			"max_versions_negative",
+			DefaultConfig(),
+			&framework.FieldData{
+				Raw: map[string]interface{}{
+					"max-versions": -1,
+				},
+			},
+			DefaultConfig(),
+			false,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.d != nil {
+				var b backend
+				tc.d.Schema = b.pathConfig().Fields
+			}
+
+			changed, err := tc.new.Update(tc.d)
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if tc.err {
+				return
+			}
+
+			if changed != tc.changed {
+				t.Errorf("expected %t to be %t", changed, tc.changed)
+			}
+
+			if v, exp := tc.new, tc.r; !reflect.DeepEqual(v, exp) {
+				t.Errorf("expected %#v to be %#v", v, exp)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package circleci
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	circleci "github.com/bobthebuilderberlin/go-circleci"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// defaultContextCacheTTL is the default time for which the contexts of an
+// organization are cached.
+const defaultContextCacheTTL = 5 * time.Minute
+
+// contextCachePrefix is the storage prefix of persisted context caches. It is
+// local to the cluster and never replicated.
+const contextCachePrefix = "cache/contexts/"
+
+// contextCache caches the contexts of each organization, so that resolving a
+// context name to its ID does not require a walk through all pages of the
+// organization's contexts on every request. Concurrent cache misses for the
+// same organization share one page walk.
+type contextCache struct {
+	mu      sync.Mutex
+	entries map[string]*contextCacheEntry
+	calls   map[string]*contextCacheCall
+}
+
+// contextCacheEntry is a cached list of contexts. It is also the format of
+// persisted caches.
+type contextCacheEntry struct {
+	OrgId     string              `json:"org_id"`
+	FetchedAt time.Time           `json:"fetched_at"`
+	Contexts  []*circleci.Context `json:"contexts"`
+}
+
+// contextCacheCall is an in-flight page walk.
+type contextCacheCall struct {
+	done  chan struct{}
+	entry *contextCacheEntry
+	err   error
+}
+
+func newContextCache() *contextCache {
+	return &contextCache{
+		entries: make(map[string]*contextCacheEntry),
+		calls:   make(map[string]*contextCacheCall),
+	}
+}
+
+// Invalidate drops the cached contexts of the given organization.
+func (c *contextCache) Invalidate(org string) {
+	c.mu.Lock()
+	delete(c.entries, org)
+	c.mu.Unlock()
+}
+
+// fresh reports whether the entry was fetched for the given configuration and
+// is not older than the configured TTL.
+func (e *contextCacheEntry) fresh(config *Config) bool {
+	return e != nil && e.OrgId == config.OrgId && time.Since(e.FetchedAt) < config.ContextCacheTTL
+}
+
+// collectContexts returns all contexts of the given organization, from the
+// cache if possible. The returned slice must not be modified.
+func (b *backend) collectContexts(ctx context.Context, req *logical.Request, org string, config *Config) ([]*circleci.Context, error) {
+	if config.ContextCacheTTL <= 0 {
+		return b.fetchContexts(ctx, req.Storage, org, config)
+	}
+
+	c := b.contextCache
+	c.mu.Lock()
+	if entry := c.entries[org]; entry.fresh(config) {
+		c.mu.Unlock()
+		return entry.Contexts, nil
+	}
+
+	// Join an in-flight page walk, if any
+	if call, ok := c.calls[org]; ok {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+			if call.err != nil {
+				return nil, call.err
+			}
+			return call.entry.Contexts, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	call := &contextCacheCall{done: make(chan struct{})}
+	c.calls[org] = call
+	c.mu.Unlock()
+
+	call.entry, call.err = b.loadContexts(ctx, req.Storage, org, config)
+
+	c.mu.Lock()
+	if call.err == nil {
+		c.entries[org] = call.entry
+	}
+	delete(c.calls, org)
+	c.mu.Unlock()
+	close(call.done)
+
+	if call.err != nil {
+		return nil, call.err
+	}
+	return call.entry.Contexts, nil
+}
+
+// loadContexts loads the contexts of the given organization from the
+// persisted cache, if enabled and fresh, or otherwise from CircleCI. The page
+// walk is not canceled with the request, as other requests may be waiting for
+// it.
+func (b *backend) loadContexts(ctx context.Context, s logical.Storage, org string, config *Config) (*contextCacheEntry, error) {
+	if config.ContextCachePersist {
+		entry, err := b.persistedContexts(ctx, s, org)
+		if err != nil {
+			b.Logger().Warn("failed to read persisted context cache", "org", org, "error", err)
+		}
+		if entry.fresh(config) {
+			return entry, nil
+		}
+	}
+
+	// Retries of the page walk are counted for the request that started it,
+	// and its deadline bounds the time spent waiting for the rate limiter
+	fetchCtx := withRetryCounter(b.ctx, retryCounterFrom(ctx))
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		fetchCtx, cancel = context.WithDeadline(fetchCtx, deadline)
+		defer cancel()
+	}
+
+	fetchedAt := time.Now()
+	contexts, err := b.fetchContexts(fetchCtx, s, org, config)
+	if err != nil {
+		return nil, err
+	}
+	entry := &contextCacheEntry{
+		OrgId:     config.OrgId,
+		FetchedAt: fetchedAt,
+		Contexts:  contexts,
+	}
+
+	if config.ContextCachePersist {
+		storageEntry, err := logical.StorageEntryJSON(contextCachePrefix+org, entry)
+		if err == nil {
+			err = s.Put(ctx, storageEntry)
+		}
+		if err != nil {
+			b.Logger().Warn("failed to persist context cache", "org", org, "error", err)
+		}
+	}
+	return entry, nil
+}
+
+// persistedContexts reads the persisted context cache of the given
+// organization, if any.
+func (b *backend) persistedContexts(ctx context.Context, s logical.Storage, org string) (*contextCacheEntry, error) {
+	storageEntry, err := s.Get(ctx, contextCachePrefix+org)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to read context cache from storage: {{err}}", err)
+	}
+	if storageEntry == nil {
+		return nil, nil
+	}
+
+	var entry contextCacheEntry
+	if err := storageEntry.DecodeJSON(&entry); err != nil {
+		return nil, errwrap.Wrapf("failed to decode context cache: {{err}}", err)
+	}
+	return &entry, nil
+}
+
+// invalidateContexts drops the cached contexts of the given organization,
+// including the persisted cache. It is called whenever the plugin creates or
+// deletes a context.
+func (b *backend) invalidateContexts(ctx context.Context, s logical.Storage, org string) {
+	b.contextCache.Invalidate(org)
+	if err := s.Delete(ctx, contextCachePrefix+org); err != nil {
+		b.Logger().Warn("failed to delete persisted context cache", "org", org, "error", err)
+	}
+}
+
+// fetchContexts walks through all pages of the organization's contexts.
+func (b *backend) fetchContexts(ctx context.Context, s logical.Storage, org string, config *Config) ([]*circleci.Context, error) {
+	circleCIClient, err := b.CircleCIClient(s, org)
+	if err != nil {
+		return nil, err
+	}
+
+	var collectedContexts []*circleci.Context
+	var nextPageToken string
+	for {
+		contextList, err := circleCIClient.Contexts.List(ctx, circleci.ContextListOptions{OwnerID: &config.OrgId, PageToken: &nextPageToken})
+		if err != nil {
+			return nil, err
+		}
+		for _, contextListItem := range contextList.Items {
+			collectedContexts = append(collectedContexts, contextListItem)
+		}
+		if contextList.NextPageToken == "" {
+			break
+		}
+		nextPageToken = contextList.NextPageToken
+	}
+	return collectedContexts, nil
+}
@@ -0,0 +1,196 @@
+package circleci
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestBackend_ContextCache(t *testing.T) {
+	t.Parallel()
+
+	listContexts := func(tb testing.TB, b *backend, storage logical.Storage, data map[string]interface{}) []string {
+		tb.Helper()
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ListOperation,
+			Path:      "context/",
+			Data:      data,
+		})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		keys, _ := resp.Data["keys"].([]string)
+		return keys
+	}
+
+	t.Run("caches", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context", "FOO")
+
+		listContexts(t, b, storage, nil)
+		if _, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "context/my-context/FOO",
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if v := server.Requests("GET context"); v != 1 {
+			t.Errorf("expected 1 page walk, got %d", v)
+		}
+	})
+
+	t.Run("refresh", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+
+		listContexts(t, b, storage, nil)
+		server.AddContext("other-context")
+		if v := listContexts(t, b, storage, nil); len(v) != 1 {
+			t.Errorf("expected cached contexts, got %q", v)
+		}
+		if v := listContexts(t, b, storage, map[string]interface{}{"refresh": true}); len(v) != 2 {
+			t.Errorf("expected refreshed contexts, got %q", v)
+		}
+	})
+
+	t.Run("missing_context_refreshes", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+
+		listContexts(t, b, storage, nil)
+		server.AddContext("other-context")
+		if _, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "context/other-context/FOO",
+			Data: map[string]interface{}{
+				"value": "bar",
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("create_invalidates", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, _ := testBackendWithCircleCI(t)
+
+		listContexts(t, b, storage, nil)
+		if _, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "context",
+			Data: map[string]interface{}{
+				"context": "my-context",
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if v := listContexts(t, b, storage, nil); len(v) != 1 {
+			t.Errorf("expected the created context to be listed, got %q", v)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		if _, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "config",
+			Data: map[string]interface{}{
+				"context-cache-ttl": 0,
+				"verify":            false,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		listContexts(t, b, storage, nil)
+		listContexts(t, b, storage, nil)
+		if v := server.Requests("GET context"); v != 2 {
+			t.Errorf("expected 2 page walks, got %d", v)
+		}
+	})
+
+	t.Run("persist", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		if _, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "config",
+			Data: map[string]interface{}{
+				"context-cache-persist": true,
+				"verify":                false,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		listContexts(t, b, storage, nil)
+
+		// A new backend instance on the same storage uses the persisted cache.
+		config := logical.TestBackendConfig()
+		config.StorageView = storage
+		config.Logger = hclog.NewNullLogger()
+		b2, err := Factory(context.Background(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := listContexts(t, b2.(*backend), storage, nil); len(v) != 1 {
+			t.Errorf("expected cached contexts, got %q", v)
+		}
+		if v := server.Requests("GET context"); v != 1 {
+			t.Errorf("expected 1 page walk, got %d", v)
+		}
+	})
+
+	t.Run("coalesces", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		server.SetIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+			if r.URL.Path == "/api/v2/context" {
+				time.Sleep(200 * time.Millisecond)
+			}
+			return false
+		})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if v := listContexts(t, b, storage, nil); len(v) != 1 {
+					t.Errorf("expected 1 context, got %q", v)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if v := server.Requests("GET context"); v != 1 {
+			t.Errorf("expected 1 page walk, got %d", v)
+		}
+	})
+}
@@ -0,0 +1,248 @@
+package circleci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	circleci "github.com/bobthebuilderberlin/go-circleci"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// apiError is a 4xx or 5xx response of the CircleCI API.
+type apiError struct {
+	StatusCode int
+	Message    string
+
+	// RetryAfter is the delay requested by the Retry-After header, if any.
+	RetryAfter time.Duration
+}
+
+func (e *apiError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Is makes errors.Is report the go-circleci errors for the status codes
+// go-circleci handles itself.
+func (e *apiError) Is(target error) bool {
+	switch target {
+	case circleci.ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case circleci.ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// newAPIError reads the error response of the CircleCI API.
+func newAPIError(resp *http.Response) *apiError {
+	e := &apiError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+	var errResponse circleci.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errResponse); err == nil {
+		e.Message = errResponse.Message
+	}
+	return e
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// apiTransport turns 4xx and 5xx responses of the CircleCI API into *apiError, so
+// that the status code and the Retry-After header are not lost on the way
+// through go-circleci. Failed idempotent requests are retried according to
+// the retry policy, and every attempt waits for the rate limiter.
+type apiTransport struct {
+	next    http.RoundTripper
+	retry   retryPolicy
+	limiter *rateLimiter
+}
+
+func (t *apiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := t.retry.attempts(req)
+	for attempt := 1; ; attempt++ {
+		if err := t.limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+
+		resp, err := t.roundTrip(req)
+		if err == nil || attempt >= attempts {
+			return resp, err
+		}
+
+		delay, ok := t.retry.delay(attempt, err)
+		if !ok {
+			return nil, err
+		}
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < delay {
+			return nil, err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		retryCounterFrom(req.Context()).add()
+	}
+}
+
+// roundTrip performs a single attempt of the request.
+func (t *apiTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, newAPIError(resp)
+}
+
+// validationErrors are the errors go-circleci reports for missing arguments
+// before sending a request.
+var validationErrors = []error{
+	circleci.ErrRequiredEitherOrganizationIDOrSlug,
+	circleci.ErrRequiredContextID,
+	circleci.ErrRequiredEnvironmentVariableName,
+	circleci.ErrRequiredEnvironmentVariableValue,
+	circleci.ErrRequiredProjectSlug,
+	circleci.ErrRequiredProjectVariableName,
+	circleci.ErrRequiredProjectVariableValue,
+}
+
+// HandleRequest handles the request like framework.Backend does, and
+// translates the errors of the CircleCI API into the matching Vault status
+// codes. Retries of requests to CircleCI are logged and reported as a
+// warning.
+func (b *backend) HandleRequest(ctx context.Context, req *logical.Request) (*logical.Response, error) {
+	counter := &retryCounter{}
+	resp, err := b.Backend.HandleRequest(withRetryCounter(ctx, counter), req)
+
+	if retries := counter.count(); retries > 0 {
+		b.Logger().Warn("requests to CircleCI were retried", "path", req.Path, "retries", retries, "error", err)
+		if err == nil {
+			if resp == nil {
+				resp = &logical.Response{}
+			}
+			resp.AddWarning(fmt.Sprintf("requests to CircleCI were retried %d time(s)", retries))
+		}
+	}
+
+	if err != nil {
+		return translateError(req, resp, err)
+	}
+	return resp, nil
+}
+
+// translateError maps an error returned by a path to the status code Vault
+// responds with:
+//
+//   - 401 and 403 from CircleCI become 403, pointing at the configuration
+//   - 404 becomes 404
+//   - 409 becomes 409, other 4xx become 400
+//   - 429 becomes 429, naming the Retry-After delay of CircleCI
+//   - 5xx and transport errors become 502
+//   - requests held back by the client-side rate limit become 429
+//
+// Errors that already carry a status code are returned unchanged.
+func translateError(req *logical.Request, resp *logical.Response, err error) (*logical.Response, error) {
+	var codedErr logical.HTTPCodedError
+	if errors.As(err, &codedErr) {
+		return resp, err
+	}
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		switch code := apiErr.StatusCode; {
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return nil, logical.CodedError(http.StatusForbidden, fmt.Sprintf("CircleCI denied access: %v; check the api-token and org-id at %s", apiErr, configPathOf(req)))
+		case code == http.StatusNotFound:
+			return nil, logical.CodedError(http.StatusNotFound, fmt.Sprintf("not found in CircleCI: %v", apiErr))
+		case code == http.StatusConflict:
+			return nil, logical.CodedError(http.StatusConflict, fmt.Sprintf("conflict in CircleCI: %v", apiErr))
+		case code == http.StatusTooManyRequests:
+			return nil, rateLimited(fmt.Sprintf("CircleCI rate limit exceeded: %v", apiErr), apiErr.RetryAfter)
+		case code >= 400 && code <= 499:
+			return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("CircleCI rejected the request: %v", apiErr))
+		default:
+			return nil, logical.CodedError(http.StatusBadGateway, fmt.Sprintf("CircleCI failed to handle the request: %v", apiErr))
+		}
+	}
+
+	var rateLimitErr *rateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return nil, rateLimited(rateLimitErr.Error(), rateLimitErr.RetryAfter)
+	}
+
+	for _, validationErr := range validationErrors {
+		if errors.Is(err, validationErr) {
+			return nil, logical.CodedError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return nil, logical.CodedError(http.StatusBadGateway, fmt.Sprintf("failed to reach CircleCI: %v", urlErr.Err))
+	}
+
+	return resp, err
+}
+
+// rateLimited fails a rate limited request with 429, naming the delay after
+// which the request may be retried.
+func rateLimited(message string, retryAfter time.Duration) error {
+	if retryAfter > 0 {
+		seconds := int((retryAfter + time.Second - 1) / time.Second)
+		message = fmt.Sprintf("%s; retry after %ds", message, seconds)
+	}
+	return logical.CodedError(http.StatusTooManyRequests, message)
+}
+
+// configPathOf returns the path of the configuration used by the given
+// request, relative to the mount.
+func configPathOf(req *logical.Request) string {
+	if strings.HasPrefix(req.Path, "org/") {
+		org := strings.SplitN(strings.TrimPrefix(req.Path, "org/"), "/", 2)[0]
+		return "orgs/" + org
+	}
+	return "config"
+}
@@ -0,0 +1,232 @@
+package circleci
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	circleci "github.com/bobthebuilderberlin/go-circleci"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		value string
+		exp   time.Duration
+	}{
+		{"", 0},
+		{"30", 30 * time.Second},
+		{"-1", 0},
+		{"soon", 0},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+	}
+	for _, tc := range cases {
+		if v := parseRetryAfter(tc.value, now); v != tc.exp {
+			t.Errorf("%q: expected %v to be %v", tc.value, v, tc.exp)
+		}
+	}
+}
+
+func TestAPIError_Is(t *testing.T) {
+	t.Parallel()
+
+	if !errors.Is(&apiError{StatusCode: 401}, circleci.ErrUnauthorized) {
+		t.Errorf("expected 401 to be ErrUnauthorized")
+	}
+	if !errors.Is(&apiError{StatusCode: 404}, circleci.ErrNotFound) {
+		t.Errorf("expected 404 to be ErrNotFound")
+	}
+	if errors.Is(&apiError{StatusCode: 500}, circleci.ErrNotFound) {
+		t.Errorf("expected 500 not to be ErrNotFound")
+	}
+}
+
+func TestBackend_ErrorTranslation(t *testing.T) {
+	t.Parallel()
+
+	respond := func(status int, headers map[string]string) func(w http.ResponseWriter, r *http.Request) bool {
+		return func(w http.ResponseWriter, r *http.Request) bool {
+			for k, v := range headers {
+				w.Header().Set(k, v)
+			}
+			w.WriteHeader(status)
+			w.Write([]byte(`{"message": "injected"}`))
+			return true
+		}
+	}
+
+	cases := []struct {
+		name      string
+		intercept func(w http.ResponseWriter, r *http.Request) bool
+		exp       int
+		contains  string
+	}{
+		{"unauthorized", respond(401, nil), 403, "check the api-token and org-id at config"},
+		{"forbidden", respond(403, nil), 403, "check the api-token and org-id at config"},
+		{"not_found", respond(404, nil), 404, "injected"},
+		{"conflict", respond(409, nil), 409, "injected"},
+		{"bad_request", respond(422, nil), 400, "injected"},
+		{"server_error", respond(503, nil), 502, "injected"},
+		{"transport", func(w http.ResponseWriter, r *http.Request) bool {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return true
+			}
+			conn.Close()
+			return true
+		}, 502, "failed to reach CircleCI"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			b, storage, server := testBackendWithCircleCI(t)
+			server.SetIntercept(tc.intercept)
+
+			for _, req := range []*logical.Request{
+				{Operation: logical.ListOperation, Path: "context/"},
+				{Operation: logical.UpdateOperation, Path: "context/", Data: map[string]interface{}{"context": "my-context"}},
+			} {
+				req.Storage = storage
+				_, err := b.HandleRequest(context.Background(), req)
+				coded, ok := err.(logical.HTTPCodedError)
+				if !ok || coded.Code() != tc.exp {
+					t.Fatalf("%s %s: expected %d, got %v", req.Operation, req.Path, tc.exp, err)
+				}
+				if !strings.Contains(err.Error(), tc.contains) {
+					t.Errorf("%s %s: expected %q to contain %q", req.Operation, req.Path, err, tc.contains)
+				}
+			}
+		})
+	}
+
+	t.Run("rate_limited", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.SetIntercept(respond(429, map[string]string{"Retry-After": "30"}))
+
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ListOperation,
+			Path:      "context/",
+		})
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 429 || !strings.Contains(err.Error(), "retry after 30s") {
+			t.Errorf("expected 429 naming the retry delay, got %v", err)
+		}
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.SetIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+			if r.URL.Query().Get("redirected") != "" {
+				return false
+			}
+			query := r.URL.Query()
+			query.Set("redirected", "true")
+			http.Redirect(w, r, r.URL.Path+"?"+query.Encode(), http.StatusTemporaryRedirect)
+			return true
+		})
+
+		if _, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ListOperation,
+			Path:      "context/",
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("rate_limited_revoke", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		ctx := context.Background()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "context/",
+			Data:      map[string]interface{}{"context": "pr-1234", "ttl": "1h"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		revoke := &logical.Request{
+			Storage:   storage,
+			Operation: logical.RevokeOperation,
+			Secret:    resp.Secret,
+		}
+
+		// Vault retries revocations that fail, but drops the lease on success
+		server.SetIntercept(respond(429, map[string]string{"Retry-After": "30"}))
+		_, err = b.HandleRequest(ctx, revoke)
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 429 || !strings.Contains(err.Error(), "retry after 30s") {
+			t.Errorf("expected 429 error, got %v", err)
+		}
+		if server.Context("pr-1234") == nil {
+			t.Fatal("expected the context to be kept")
+		}
+
+		server.SetIntercept(nil)
+		if _, err := b.HandleRequest(ctx, revoke); err != nil {
+			t.Fatal(err)
+		}
+		if server.Context("pr-1234") != nil {
+			t.Errorf("expected the context to be deleted")
+		}
+	})
+
+	t.Run("org_hint", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		config, err := b.Config(context.Background(), storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := logical.StorageEntryJSON("orgs/other", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+		server.SetIntercept(respond(401, nil))
+
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ListOperation,
+			Path:      "org/other/context/",
+		})
+		if err == nil || !strings.Contains(err.Error(), "at orgs/other") {
+			t.Errorf("expected hint to orgs/other, got %v", err)
+		}
+	})
+
+	t.Run("coded_errors_unchanged", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, _ := testBackendWithCircleCI(t)
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "context/missing/FOO",
+		})
+		if err == nil || err.Error() != "context 'missing' was not found" {
+			t.Errorf("expected context not found error, got %v", err)
+		}
+	})
+}
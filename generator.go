@@ -0,0 +1,153 @@
+package circleci
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// The defaults and limits of generated values.
+const (
+	defaultGeneratedLength = 32
+	maxGeneratedLength     = 1024
+	defaultCharset         = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// valueGenerator generates random values for environment variables, either
+// from a Vault password policy or from a length and charset.
+type valueGenerator struct {
+	// PasswordPolicy is the name of the Vault password policy the values are
+	// generated from. If set, Length and Charset are ignored.
+	PasswordPolicy string `json:"password_policy,omitempty"`
+
+	// Length is the number of characters of the values.
+	Length int `json:"length"`
+
+	// Charset are the characters the values are made of.
+	Charset string `json:"charset"`
+}
+
+// defaultGenerator returns a generator with the default length and charset.
+func defaultGenerator() *valueGenerator {
+	return &valueGenerator{
+		Length:  defaultGeneratedLength,
+		Charset: defaultCharset,
+	}
+}
+
+// generatorFields returns the schemas of the fields configuring a
+// valueGenerator.
+func generatorFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"password_policy": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "The name of the Vault password policy generated values are generated from. Cannot be combined with length and charset.",
+		},
+		"length": &framework.FieldSchema{
+			Type:        framework.TypeInt,
+			Description: fmt.Sprintf("The number of characters of generated values. Defaults to %d.", defaultGeneratedLength),
+		},
+		"charset": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "The characters generated values are made of. Defaults to letters and digits.",
+		},
+	}
+}
+
+// generateFields returns the schemas of the fields of writes that may
+// generate the value.
+func generateFields() map[string]*framework.FieldSchema {
+	fields := map[string]*framework.FieldSchema{
+		"generate": &framework.FieldSchema{
+			Type:        framework.TypeBool,
+			Description: "Generate the value instead of passing it in value.",
+		},
+		"return_value": &framework.FieldSchema{
+			Type:        framework.TypeBool,
+			Description: "Return the generated value in the response. It cannot be read from CircleCI later.",
+		},
+	}
+	for name, schema := range generatorFields() {
+		fields[name] = schema
+	}
+	return fields
+}
+
+// generateOptionsSet returns the names of the fields of generateFields, other
+// than generate itself, that are set in the given field data.
+func generateOptionsSet(d *framework.FieldData) []string {
+	var names []string
+	for name := range generateFields() {
+		if name == "generate" {
+			continue
+		}
+		if _, ok := d.GetOk(name); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Update updates the generator from the given field data. Setting length or
+// charset switches from a password policy to them.
+func (g *valueGenerator) Update(d *framework.FieldData) error {
+	_, hasLength := d.GetOk("length")
+	_, hasCharset := d.GetOk("charset")
+	if v, ok := d.GetOk("password_policy"); ok {
+		g.PasswordPolicy = v.(string)
+		if g.PasswordPolicy != "" && (hasLength || hasCharset) {
+			return errors.New("password_policy cannot be combined with length or charset")
+		}
+	} else if hasLength || hasCharset {
+		g.PasswordPolicy = ""
+	}
+	if v, ok := d.GetOk("length"); ok {
+		g.Length = v.(int)
+	}
+	if v, ok := d.GetOk("charset"); ok {
+		g.Charset = v.(string)
+	}
+
+	if g.PasswordPolicy != "" {
+		return nil
+	}
+	if g.Length < 1 || g.Length > maxGeneratedLength {
+		return fmt.Errorf("length must be between 1 and %d", maxGeneratedLength)
+	}
+	if g.Charset == "" {
+		return errors.New("charset must not be empty")
+	}
+	return nil
+}
+
+// Generate generates a new random value. Values from password policies are
+// generated through the given system view.
+func (g *valueGenerator) Generate(ctx context.Context, system logical.SystemView) (string, error) {
+	if g.PasswordPolicy != "" {
+		value, err := system.GeneratePasswordFromPolicy(ctx, g.PasswordPolicy)
+		if err != nil {
+			return "", logical.CodedError(400, fmt.Sprintf("failed to generate value from password policy '%v': %v", g.PasswordPolicy, err))
+		}
+		return value, nil
+	}
+
+	charset := []rune(g.Charset)
+	max := big.NewInt(int64(len(charset)))
+
+	value := make([]rune, g.Length)
+	for i := range value {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate value: %v", err)
+		}
+		value[i] = charset[n.Int64()]
+	}
+	return string(value), nil
+}
@@ -0,0 +1,60 @@
+package circleci
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestValueGenerator(t *testing.T) {
+	t.Parallel()
+
+	g := defaultGenerator()
+	if err := g.Update(&framework.FieldData{
+		Raw:    map[string]interface{}{"length": 64, "charset": "ab"},
+		Schema: generatorFields(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	system := &logical.StaticSystemView{}
+	value, err := g.Generate(context.Background(), system)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(value) != 64 || strings.Trim(value, "ab") != "" {
+		t.Errorf("expected 64 characters of ab, got %q", value)
+	}
+
+	system.SetPasswordPolicy("my-policy", func() (string, error) { return "from-policy", nil })
+	g = defaultGenerator()
+	if err := g.Update(&framework.FieldData{
+		Raw:    map[string]interface{}{"password_policy": "my-policy"},
+		Schema: generatorFields(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := g.Generate(context.Background(), system); err != nil || value != "from-policy" {
+		t.Errorf("expected the value of the policy, got %q, %v", value, err)
+	}
+
+	g.PasswordPolicy = "unknown"
+	_, err = g.Generate(context.Background(), system)
+	if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 400 {
+		t.Errorf("expected 400 for an unknown policy, got %v", err)
+	}
+
+	for _, raw := range []map[string]interface{}{
+		{"password_policy": "my-policy", "length": 10},
+		{"length": 0},
+		{"length": maxGeneratedLength + 1},
+		{"charset": ""},
+	} {
+		g := defaultGenerator()
+		if err := g.Update(&framework.FieldData{Raw: raw, Schema: generatorFields()}); err == nil {
+			t.Errorf("%v: expected error", raw)
+		}
+	}
+}
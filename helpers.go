@@ -9,6 +9,48 @@ import (
 	"strings"
 )
 
+// defaultOrg is the name of the organization configured at "config" and used
+// by all paths that are not scoped to an organization.
+const defaultOrg = "default"
+
+// orgPrefix is the optional path prefix that scopes a path to one of the
+// organizations configured at "orgs/<name>".
+var orgPrefix = "(org/" + framework.GenericNameRegex("org") + "/)?"
+
+// orgField returns the schema of the field captured by orgPrefix.
+func orgField() *framework.FieldSchema {
+	return &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "The name of the organization configured at orgs/<name>. Defaults to the organization configured at config.",
+	}
+}
+
+// orgName returns the organization the request is scoped to.
+func orgName(d *framework.FieldData) string {
+	if org := d.Get("org").(string); org != "" {
+		return org
+	}
+	return defaultOrg
+}
+
+// refreshField returns the schema of the field that forces a refresh of the
+// cached contexts.
+func refreshField() *framework.FieldSchema {
+	return &framework.FieldSchema{
+		Type:        framework.TypeBool,
+		Description: "Refresh the cached contexts of the organization before handling the request.",
+	}
+}
+
+// commentField returns the schema of the comment recorded with a stored
+// version of an environment variable.
+func commentField() *framework.FieldSchema {
+	return &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "A comment recorded with the version of the value, if store-values is enabled.",
+	}
+}
+
 // withFieldValidator wraps an OperationFunc and validates the user-supplied
 // fields match the schema.
 func withFieldValidator(f framework.OperationFunc) framework.OperationFunc {
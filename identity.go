@@ -0,0 +1,189 @@
+package circleci
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/helper/identitytpl"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// multiValueDirectives are the identity templates that resolve to one value
+// per group of the entity. A pattern using them expands to one pattern per
+// group.
+var multiValueDirectives = map[string]func(*logical.Group) string{
+	"{{identity.groups.names}}": func(g *logical.Group) string { return g.Name },
+	"{{identity.groups.ids}}":   func(g *logical.Group) string { return g.ID },
+}
+
+// requestIdentity is the identity entity of a request and its groups.
+type requestIdentity struct {
+	entity *logical.Entity
+	groups []*logical.Group
+}
+
+// requestIdentity looks up the identity entity of the request through the
+// system view.
+func (b *backend) requestIdentity(req *logical.Request) (*requestIdentity, error) {
+	if req.EntityID == "" {
+		return nil, errors.New("the request has no identity entity")
+	}
+
+	entity, err := b.System().EntityInfo(req.EntityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up entity '%s': %v", req.EntityID, err)
+	}
+	if entity == nil {
+		return nil, fmt.Errorf("entity '%s' was not found", req.EntityID)
+	}
+
+	groups, err := b.System().GroupsForEntity(req.EntityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the groups of entity '%s': %v", req.EntityID, err)
+	}
+	return &requestIdentity{entity: entity, groups: groups}, nil
+}
+
+// resolveContextPatterns resolves the identity templates in the given context
+// patterns for the entity of the request, e.g.
+// {{identity.entity.metadata.team}}-*. Patterns without templates are
+// returned as they are. Patterns that cannot be resolved are left out and
+// reported as errors.
+func (b *backend) resolveContextPatterns(req *logical.Request, patterns []string) ([]string, []error) {
+	var resolved []string
+	var errs []error
+
+	var identity *requestIdentity
+	var identityErr error
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "{{") {
+			resolved = append(resolved, pattern)
+			continue
+		}
+
+		if identity == nil && identityErr == nil {
+			identity, identityErr = b.requestIdentity(req)
+		}
+		if identityErr != nil {
+			errs = append(errs, fmt.Errorf("pattern %q cannot be resolved: %v", pattern, identityErr))
+			continue
+		}
+
+		expanded, err := identity.expand(pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pattern %q cannot be resolved: %v", pattern, err))
+			continue
+		}
+		resolved = append(resolved, expanded...)
+	}
+	return resolved, errs
+}
+
+// globMetacharacters are the characters that would turn a resolved value
+// into a glob of its own.
+const globMetacharacters = "*?["
+
+// checkResolvedValue rejects resolved values containing glob metacharacters,
+// which would widen the pattern beyond the identity, e.g. a metadata value of
+// *.
+func checkResolvedValue(template, value string) error {
+	if strings.ContainsAny(value, globMetacharacters) {
+		return fmt.Errorf("%s resolves to %q, which contains glob metacharacters", template, value)
+	}
+	return nil
+}
+
+// expand resolves the identity templates in the given pattern.
+func (i *requestIdentity) expand(pattern string) ([]string, error) {
+	candidates := []string{pattern}
+	for directive, value := range multiValueDirectives {
+		if !strings.Contains(pattern, directive) {
+			continue
+		}
+		if len(i.groups) == 0 {
+			return nil, identitytpl.ErrNoGroupsAttachedToToken
+		}
+
+		var expanded []string
+		for _, candidate := range candidates {
+			for _, group := range i.groups {
+				if err := checkResolvedValue(directive, value(group)); err != nil {
+					return nil, err
+				}
+				expanded = append(expanded, strings.ReplaceAll(candidate, directive, value(group)))
+			}
+		}
+		candidates = expanded
+	}
+
+	resolved := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		out, err := i.populate(candidate)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, out)
+	}
+	return resolved, nil
+}
+
+// populate resolves the templates in the given pattern one at a time, so that
+// the value of each can be checked apart from the globs around it.
+func (i *requestIdentity) populate(pattern string) (string, error) {
+	var out strings.Builder
+	for {
+		start := strings.Index(pattern, "{{")
+		if start < 0 {
+			out.WriteString(pattern)
+			return out.String(), nil
+		}
+		end := strings.Index(pattern[start:], "}}")
+		if end < 0 {
+			return "", identitytpl.ErrUnbalancedTemplatingCharacter
+		}
+		end += start + len("}}")
+
+		template := pattern[start:end]
+		_, value, err := identitytpl.PopulateString(identitytpl.PopulateStringInput{
+			String:      template,
+			Entity:      i.entity,
+			Groups:      i.groups,
+			NamespaceID: i.entity.NamespaceID,
+			Mode:        identitytpl.ACLTemplating,
+		})
+		if err != nil {
+			return "", err
+		}
+		if err := checkResolvedValue(template, value); err != nil {
+			return "", err
+		}
+		out.WriteString(pattern[:start])
+		out.WriteString(value)
+		pattern = pattern[end:]
+	}
+}
+
+// validateContextPatterns checks the identity templates in the given context
+// patterns for balanced delimiters.
+func validateContextPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, _, err := identitytpl.PopulateString(identitytpl.PopulateStringInput{
+			String:            pattern,
+			ValidityCheckOnly: true,
+			Mode:              identitytpl.ACLTemplating,
+		}); err != nil {
+			return fmt.Errorf("pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// joinErrors joins the messages of the given errors.
+func joinErrors(errs []error) string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
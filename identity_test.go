@@ -0,0 +1,205 @@
+package circleci
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// testSetIdentity makes the backend's system view report the given entity and
+// groups for every entity ID.
+func testSetIdentity(tb testing.TB, b *backend, entity *logical.Entity, groups ...*logical.Group) {
+	tb.Helper()
+
+	system, ok := b.System().(*logical.StaticSystemView)
+	if !ok {
+		tb.Fatalf("unexpected system view %T", b.System())
+	}
+	system.EntityVal = entity
+	system.GroupsVal = groups
+}
+
+func TestBackend_ResolveContextPatterns(t *testing.T) {
+	t.Parallel()
+
+	b, _ := testBackend(t)
+	testSetIdentity(t, b,
+		&logical.Entity{ID: "entity-1", Name: "alice", Metadata: map[string]string{"team": "team-a"}},
+		&logical.Group{ID: "group-1", Name: "ops"},
+		&logical.Group{ID: "group-2", Name: "dev"},
+	)
+
+	patterns, errs := b.resolveContextPatterns(&logical.Request{EntityID: "entity-1"}, []string{
+		"shared",
+		"{{identity.entity.metadata.team}}-*",
+		"{{identity.groups.names}}-*",
+		"{{identity.entity.metadata.missing}}-*",
+	})
+	sort.Strings(patterns)
+	if exp := []string{"dev-*", "ops-*", "shared", "team-a-*"}; !reflect.DeepEqual(patterns, exp) {
+		t.Errorf("expected %q to be %q", patterns, exp)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "identity.entity.metadata.missing") {
+		t.Errorf("expected the missing metadata to be reported, got %v", errs)
+	}
+
+	patterns, errs = b.resolveContextPatterns(&logical.Request{}, []string{"shared", "{{identity.entity.name}}-*"})
+	if exp := []string{"shared"}; !reflect.DeepEqual(patterns, exp) {
+		t.Errorf("expected %q to be %q", patterns, exp)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "no identity entity") {
+		t.Errorf("expected the missing entity to be reported, got %v", errs)
+	}
+}
+
+func TestBackend_ResolveContextPatterns_GlobValues(t *testing.T) {
+	t.Parallel()
+
+	b, _ := testBackend(t)
+	testSetIdentity(t, b,
+		&logical.Entity{ID: "entity-1", Name: "alice", Metadata: map[string]string{"team": "*", "site": "berlin"}},
+		&logical.Group{ID: "group-1", Name: "ops?"},
+	)
+
+	patterns, errs := b.resolveContextPatterns(&logical.Request{EntityID: "entity-1"}, []string{
+		"{{identity.entity.metadata.team}}",
+		"{{identity.entity.metadata.site}}-*",
+		"{{identity.groups.names}}-*",
+	})
+	if exp := []string{"berlin-*"}; !reflect.DeepEqual(patterns, exp) {
+		t.Errorf("expected %q to be %q", patterns, exp)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("expected the metadata and group to be reported, got %v", errs)
+	}
+	for _, err := range errs {
+		if !strings.Contains(err.Error(), "glob metacharacters") {
+			t.Errorf("expected %q to report glob metacharacters", err)
+		}
+	}
+}
+
+func TestBackend_ContextAccess(t *testing.T) {
+	t.Parallel()
+
+	b, storage, server := testBackendWithCircleCI(t)
+	server.AddContext("team-a-dev")
+	server.AddContext("team-b-dev")
+	testSetIdentity(t, b, &logical.Entity{ID: "entity-1", Metadata: map[string]string{"team": "team-a"}})
+	ctx := context.Background()
+
+	if _, err := b.HandleRequest(ctx, &logical.Request{
+		Storage:   storage,
+		Operation: logical.UpdateOperation,
+		Path:      "config/access",
+		Data:      map[string]interface{}{"allowed_contexts": "{{identity.entity.metadata.team}}-*"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(entityID, pth string, data map[string]interface{}) error {
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      pth,
+			Data:      data,
+			EntityID:  entityID,
+		})
+		return err
+	}
+
+	if err := write("entity-1", "context/team-a-dev/FOO", map[string]interface{}{"value": "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("entity-1", "context/", map[string]interface{}{"context": "team-a-staging"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := write("entity-1", "context/team-b-dev/FOO", map[string]interface{}{"value": "bar"})
+	if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 403 {
+		t.Errorf("expected 403, got %v", err)
+	}
+
+	// Without an entity, the template cannot be resolved
+	err = write("", "context/team-a-dev/FOO", map[string]interface{}{"value": "bar"})
+	if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 403 || !strings.Contains(err.Error(), "cannot be resolved") {
+		t.Errorf("expected 403 for unresolvable template, got %v", err)
+	}
+	if server.Variable("team-b-dev", "FOO") != nil {
+		t.Errorf("expected variable not to be written")
+	}
+
+	// Templates in roles are resolved the same way
+	if _, err := b.HandleRequest(ctx, &logical.Request{
+		Storage:   storage,
+		Operation: logical.CreateOperation,
+		Path:      "roles/team",
+		Data: map[string]interface{}{
+			"allowed_contexts":  "{{identity.entity.metadata.team}}-*",
+			"allowed_env_names": ".*",
+			"operations":        "write_variable",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("entity-1", "role/team/context/team-a-dev/FOO", map[string]interface{}{"value": "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	err = write("entity-1", "role/team/context/team-b-dev/FOO", map[string]interface{}{"value": "bar"})
+	if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 403 {
+		t.Errorf("expected 403, got %v", err)
+	}
+	err = write("", "role/team/context/team-a-dev/FOO", map[string]interface{}{"value": "bar"})
+	if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 403 {
+		t.Errorf("expected 403, got %v", err)
+	}
+
+	// The access rule applies to roles that allow more
+	if _, err := b.HandleRequest(ctx, &logical.Request{
+		Storage:   storage,
+		Operation: logical.CreateOperation,
+		Path:      "roles/broad",
+		Data: map[string]interface{}{
+			"allowed_contexts":  "team-*",
+			"allowed_env_names": ".*",
+			"operations":        "write_variable",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	err = write("entity-1", "role/broad/context/team-b-dev/FOO", map[string]interface{}{"value": "bar"})
+	if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 403 || !strings.Contains(err.Error(), "config/access") {
+		t.Errorf("expected 403 by config/access, got %v", err)
+	}
+	if server.Variable("team-b-dev", "FOO") != nil {
+		t.Errorf("expected variable not to be written")
+	}
+}
+
+func TestBackend_PathConfigAccess(t *testing.T) {
+	t.Parallel()
+
+	t.Run("field_validation", func(t *testing.T) {
+		t.Parallel()
+		testFieldValidation(t, logical.UpdateOperation, "config/access")
+	})
+
+	t.Run("invalid_template", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage := testBackend(t)
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "config/access",
+			Data:      map[string]interface{}{"allowed_contexts": "{{identity.entity.name-*"},
+		})
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 400 {
+			t.Errorf("expected 400, got %v", err)
+		}
+	})
+}
@@ -2,7 +2,10 @@ package circleci
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
+	circleci "github.com/bobthebuilderberlin/go-circleci"
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
@@ -14,20 +17,9 @@ func (b *backend) pathConfig() *framework.Path {
 		Pattern: "config",
 
 		HelpSynopsis:    "Configure the CircleCI secrets engine",
-		HelpDescription: "Configure the CircleCI secrets engine with the api-token and the org-id",
+		HelpDescription: "Configure the CircleCI secrets engine with the api-token and the org-id, and optionally the connection to a self-hosted CircleCI server",
 
-		Fields: map[string]*framework.FieldSchema{
-			"api-token": &framework.FieldSchema{
-				Type:        framework.TypeString,
-				Description: `The CircleCI API token to use for authenticating to CircleCI.`,
-				Required:    true,
-			},
-			"org-id": &framework.FieldSchema{
-				Type:        framework.TypeString,
-				Description: `The ID of your CircleCI organization`,
-				Required:    true,
-			},
-		},
+		Fields: configFields(),
 
 		ExistenceCheck: b.pathConfigExists,
 
@@ -40,6 +32,94 @@ func (b *backend) pathConfig() *framework.Path {
 	}
 }
 
+// configFields returns the fields of the configuration of an organization.
+func configFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"api-token": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: `The CircleCI API token to use for authenticating to CircleCI.`,
+			Required:    true,
+			DisplayAttrs: &framework.DisplayAttributes{
+				Sensitive: true,
+			},
+		},
+		"org-id": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: `The ID of your CircleCI organization`,
+			Required:    true,
+		},
+		"base-url": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: `The address of the CircleCI installation, e.g. https://circleci.example.com. The API path /api/v2/ is used unless the URL has a path. Defaults to https://circleci.com.`,
+		},
+		"ca-cert": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: `PEM encoded CA certificates to trust in addition to the system roots when connecting to CircleCI.`,
+		},
+		"tls-skip-verify": &framework.FieldSchema{
+			Type:        framework.TypeBool,
+			Description: `Skip verification of the TLS certificate of CircleCI. Not recommended.`,
+		},
+		"proxy-url": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: `The URL of the HTTP proxy to connect to CircleCI through.`,
+			DisplayAttrs: &framework.DisplayAttributes{
+				Sensitive: true,
+			},
+		},
+		"timeout": &framework.FieldSchema{
+			Type:        framework.TypeDurationSecond,
+			Description: `The timeout of a single request to CircleCI, including its retries. Defaults to 60s.`,
+		},
+		"context-cache-ttl": &framework.FieldSchema{
+			Type:        framework.TypeDurationSecond,
+			Description: `The time for which the contexts of the organization are cached to resolve context names to IDs. Set to 0 to disable the cache. Defaults to 5m.`,
+		},
+		"context-cache-persist": &framework.FieldSchema{
+			Type:        framework.TypeBool,
+			Description: `Persist the context cache in the plugin's local storage, so that it survives plugin restarts.`,
+		},
+		"retry-max-attempts": &framework.FieldSchema{
+			Type:        framework.TypeInt,
+			Description: `The maximum number of attempts of an idempotent request to CircleCI that failed with a 429, a 5xx or a connection error. Set to 1 to disable retries. Defaults to 3.`,
+		},
+		"retry-backoff-base": &framework.FieldSchema{
+			Type:        framework.TypeDurationSecond,
+			Description: `The delay before the first retry, doubled with every further retry. Defaults to 1s.`,
+		},
+		"retry-backoff-cap": &framework.FieldSchema{
+			Type:        framework.TypeDurationSecond,
+			Description: `The maximum delay between retries. A Retry-After longer than this is not waited for. Defaults to 30s.`,
+		},
+		"retry-jitter": &framework.FieldSchema{
+			Type:        framework.TypeBool,
+			Description: `Randomize the delay between retries. Defaults to true.`,
+			Default:     true,
+		},
+		"rate-limit": &framework.FieldSchema{
+			Type:        framework.TypeFloat,
+			Description: `The maximum number of requests per second to CircleCI, shared by all operations on the organization. Set to 0 to disable the limit. Defaults to 0.`,
+		},
+		"rate-limit-burst": &framework.FieldSchema{
+			Type:        framework.TypeInt,
+			Description: `The number of requests to CircleCI that may exceed rate-limit in a burst. Defaults to one second worth of requests.`,
+		},
+		"store-values": &framework.FieldSchema{
+			Type:        framework.TypeBool,
+			Description: `Store the values of the environment variables written through Vault, seal-wrapped, so that they can be read back at context/<context>/<env>/value.`,
+		},
+		"max-versions": &framework.FieldSchema{
+			Type:        framework.TypeInt,
+			Description: `The number of versions kept per environment variable. Versions are only kept when store-values is enabled, and the versions and rollback paths answer with a 400 otherwise. Defaults to 10.`,
+		},
+		"verify": &framework.FieldSchema{
+			Type:        framework.TypeBool,
+			Description: `Verify the api-token and org-id against CircleCI before storing them. Set to false to write the configuration offline.`,
+			Default:     true,
+		},
+	}
+}
+
 // pathConfigExists checks if the configuration exists.
 func (b *backend) pathConfigExists(ctx context.Context, req *logical.Request, _ *framework.FieldData) (bool, error) {
 	entry, err := req.Storage.Get(ctx, "config")
@@ -50,26 +130,63 @@ func (b *backend) pathConfigExists(ctx context.Context, req *logical.Request, _
 }
 
 // pathConfigRead corresponds to READ gcpkms/config and is used to
-// read the current configuration.
+// read the current configuration. The API token is never returned, only its
+// fingerprint.
 func (b *backend) pathConfigRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
-	c, err := b.Config(ctx, req.Storage)
+	return b.orgConfigRead(ctx, req, defaultOrg)
+}
+
+// pathConfigWrite corresponds to both CREATE and UPDATE gcpkms/config and is
+// used to create or update the current configuration.
+func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	return b.orgConfigWrite(ctx, req, d, defaultOrg)
+}
+
+// pathConfigDelete corresponds to DELETE gcpkms/config and is used to delete
+// all the configuration.
+func (b *backend) pathConfigDelete(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	return b.orgConfigDelete(ctx, req, defaultOrg)
+}
+
+// orgConfigRead reads the configuration of the given organization.
+func (b *backend) orgConfigRead(ctx context.Context, req *logical.Request, org string) (*logical.Response, error) {
+	c, err := b.OrgConfig(ctx, req.Storage, org)
 	if err != nil {
 		return nil, err
 	}
 
 	return &logical.Response{
 		Data: map[string]interface{}{
-			"APIToken": c.APIToken,
-			"OrgId":    c.OrgId,
+			"APITokenFingerprint": tokenFingerprint(c.APIToken),
+			"OrgId":               c.OrgId,
+			"OrgName":             c.OrgName,
+			"OrgSlug":             c.OrgSlug,
+			"TokenOwner":          c.TokenOwner,
+			"BaseURL":             c.BaseURL,
+			"CACert":              c.CACert,
+			"TLSSkipVerify":       c.TLSSkipVerify,
+			"ProxyURL":            redactURL(c.ProxyURL),
+			"Timeout":             int64(c.Timeout.Seconds()),
+			"ContextCacheTTL":     int64(c.ContextCacheTTL.Seconds()),
+			"ContextCachePersist": c.ContextCachePersist,
+			"RetryMaxAttempts":    c.RetryMaxAttempts,
+			"RetryBackoffBase":    int64(c.RetryBackoffBase.Seconds()),
+			"RetryBackoffCap":     int64(c.RetryBackoffCap.Seconds()),
+			"RetryJitter":         c.RetryJitter,
+			"RateLimit":           c.RateLimit,
+			"RateLimitBurst":      c.RateLimitBurst,
+			"StoreValues":         c.StoreValues,
+			"MaxVersions":         c.maxVersions(),
+			"status":              b.rateLimitStatus(org, c),
 		},
 	}, nil
 }
 
-// pathConfigWrite corresponds to both CREATE and UPDATE gcpkms/config and is
-// used to create or update the current configuration.
-func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+// orgConfigWrite creates or updates the configuration of the given
+// organization.
+func (b *backend) orgConfigWrite(ctx context.Context, req *logical.Request, d *framework.FieldData, org string) (*logical.Response, error) {
 	// Get the current configuration, if it exists
-	c, err := b.Config(ctx, req.Storage)
+	c, err := b.OrgConfig(ctx, req.Storage, org)
 	if err != nil {
 		return nil, err
 	}
@@ -80,10 +197,25 @@ func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, d *
 		return nil, logical.CodedError(400, err.Error())
 	}
 
+	// Verify the credentials against CircleCI, unless explicitly disabled. The
+	// resolved organization and token owner are stored alongside the config.
+	if d.Get("verify").(bool) {
+		verified := *c
+		if err := verifyConfig(ctx, &verified); err != nil {
+			return nil, logical.CodedError(400, err.Error())
+		}
+		if verified != *c {
+			*c = verified
+			changed = true
+		}
+	} else if changed {
+		c.OrgName, c.OrgSlug, c.TokenOwner = "", "", ""
+	}
+
 	// Only do the following if the config is different
 	if changed {
 		// Generate a new storage entry
-		entry, err := logical.StorageEntryJSON("config", c)
+		entry, err := logical.StorageEntryJSON(orgConfigKey(org), c)
 		if err != nil {
 			return nil, errwrap.Wrapf("failed to generate JSON configuration: {{err}}", err)
 		}
@@ -93,22 +225,64 @@ func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, d *
 			return nil, errwrap.Wrapf("failed to persist configuration to storage: {{err}}", err)
 		}
 
-		// Invalidate existing client so it reads the new configuration
-		b.ResetClient()
+		// Invalidate existing client and cached contexts so they reflect the
+		// new configuration
+		b.ResetClient(org)
+		b.invalidateContexts(ctx, req.Storage, org)
 	}
 
 	return nil, nil
 }
 
-// pathConfigDelete corresponds to DELETE gcpkms/config and is used to delete
-// all the configuration.
-func (b *backend) pathConfigDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	if err := req.Storage.Delete(ctx, "config"); err != nil {
+// orgConfigDelete deletes the configuration of the given organization.
+func (b *backend) orgConfigDelete(ctx context.Context, req *logical.Request, org string) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, orgConfigKey(org)); err != nil {
 		return nil, errwrap.Wrapf("failed to delete from storage: {{err}}", err)
 	}
 
-	// Invalidate existing client so it reads the new configuration
-	b.ResetClient()
+	// Invalidate existing client and cached contexts so they reflect the new
+	// configuration
+	b.ResetClient(org)
+	b.invalidateContexts(ctx, req.Storage, org)
 
 	return nil, nil
 }
+
+// verifyConfig checks that the API token is accepted by CircleCI and that its
+// owner has access to the configured organization. On success, the resolved
+// organization name and slug and the token owner are set on the config.
+func verifyConfig(ctx context.Context, c *Config) error {
+	if c.APIToken == "" {
+		return errors.New("api-token is required")
+	}
+	if c.OrgId == "" {
+		return errors.New("org-id is required")
+	}
+
+	client, err := newCircleCIClient(c)
+	if err != nil {
+		return err
+	}
+
+	me, err := client.Users.Me(ctx)
+	if err != nil {
+		if errors.Is(err, circleci.ErrUnauthorized) {
+			return errors.New("api-token was rejected by CircleCI")
+		}
+		return fmt.Errorf("failed to verify api-token with CircleCI: %v", err)
+	}
+
+	orgs, err := client.Collaborations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list the organizations of the api-token owner: %v", err)
+	}
+	for _, org := range orgs {
+		if org.ID == c.OrgId {
+			c.OrgName = org.Name
+			c.OrgSlug = org.Slug
+			c.TokenOwner = me.Login
+			return nil
+		}
+	}
+	return fmt.Errorf("the owner of the api-token (%s) has no access to the organization with org-id '%s'", me.Login, c.OrgId)
+}
@@ -0,0 +1,128 @@
+package circleci
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// accessRuleKey is the storage key of the context access rule.
+const accessRuleKey = "config/access"
+
+// accessRule restricts the contexts that can be written through the
+// context/ paths, per identity entity.
+type accessRule struct {
+	// AllowedContexts are globs of context names that may contain identity
+	// templates, e.g. {{identity.entity.metadata.team}}-*.
+	AllowedContexts []string `json:"allowed_contexts"`
+}
+
+// pathConfigAccess defines the circleci/config/access path on the backend.
+func (b *backend) pathConfigAccess() *framework.Path {
+	return &framework.Path{
+		Pattern: "config/access",
+
+		HelpSynopsis: "Restrict the contexts that can be written per identity",
+		HelpDescription: "Restrict the contexts in which contexts and environment variables can be created, updated and " +
+			"deleted through the context/ and role/<name>/ paths. The allowed context globs may contain identity templates, which are " +
+			"resolved for the entity of each request. Templates resolving to values with glob metacharacters do not match. Without a rule, all contexts can be written.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"allowed_contexts": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Globs of the names of the contexts that may be written, e.g. {{identity.entity.metadata.team}}-* or {{identity.groups.names}}-*.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathConfigAccessWrite)},
+			logical.ReadOperation:   &framework.PathOperation{Callback: withFieldValidator(b.pathConfigAccessRead)},
+			logical.DeleteOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathConfigAccessDelete)},
+		},
+	}
+}
+
+// pathConfigAccessRead corresponds to READ circleci/config/access.
+func (b *backend) pathConfigAccessRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	rule, err := b.AccessRule(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if rule == nil {
+		return nil, nil
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"allowed_contexts": rule.AllowedContexts,
+		},
+	}, nil
+}
+
+// pathConfigAccessWrite corresponds to UPDATE circleci/config/access.
+func (b *backend) pathConfigAccessWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rule := &accessRule{
+		AllowedContexts: d.Get("allowed_contexts").([]string),
+	}
+	if err := validateContextPatterns(rule.AllowedContexts); err != nil {
+		return nil, logical.CodedError(400, fmt.Sprintf("invalid allowed_contexts: %v", err))
+	}
+
+	entry, err := logical.StorageEntryJSON(accessRuleKey, rule)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to generate JSON access rule: {{err}}", err)
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, errwrap.Wrapf("failed to persist access rule to storage: {{err}}", err)
+	}
+	return nil, nil
+}
+
+// pathConfigAccessDelete corresponds to DELETE circleci/config/access.
+func (b *backend) pathConfigAccessDelete(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, accessRuleKey); err != nil {
+		return nil, errwrap.Wrapf("failed to delete access rule from storage: {{err}}", err)
+	}
+	return nil, nil
+}
+
+// AccessRule returns the context access rule, or nil if there is none.
+func (b *backend) AccessRule(ctx context.Context, s logical.Storage) (*accessRule, error) {
+	entry, err := s.Get(ctx, accessRuleKey)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to get access rule from storage: {{err}}", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var rule accessRule
+	if err := entry.DecodeJSON(&rule); err != nil {
+		return nil, errwrap.Wrapf("failed to decode access rule: {{err}}", err)
+	}
+	return &rule, nil
+}
+
+// checkContextAccess checks that the access rule allows the entity of the
+// request to write the named context. Patterns that cannot be resolved for
+// the entity never match, and are named in the error.
+func (b *backend) checkContextAccess(ctx context.Context, req *logical.Request, contextName string) error {
+	rule, err := b.AccessRule(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+	if rule == nil {
+		return nil
+	}
+
+	patterns, errs := b.resolveContextPatterns(req, rule.AllowedContexts)
+	if matchesGlob(patterns, contextName) {
+		return nil
+	}
+	if len(errs) > 0 {
+		return logical.CodedError(403, fmt.Sprintf("access to context '%v' denied: %s", contextName, joinErrors(errs)))
+	}
+	return logical.CodedError(403, fmt.Sprintf("access to context '%v' denied by config/access", contextName))
+}
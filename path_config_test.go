@@ -2,8 +2,12 @@ package circleci
 
 import (
 	"context"
+	"encoding/pem"
+	"net/http"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/logical"
 )
@@ -30,8 +34,8 @@ func TestBackend_PathConfigRead(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if _, ok := resp.Data["APIToken"]; !ok {
-			t.Errorf("expected %q to include %q", resp.Data, "api-token")
+		if _, ok := resp.Data["APITokenFingerprint"]; !ok {
+			t.Errorf("expected %q to include %q", resp.Data, "api-token fingerprint")
 		}
 		if _, ok := resp.Data["OrgId"]; !ok {
 			t.Errorf("expected %q to include %q", resp.Data, "org-id")
@@ -44,7 +48,7 @@ func TestBackend_PathConfigRead(t *testing.T) {
 		b, storage := testBackend(t)
 
 		entry, err := logical.StorageEntryJSON("config", &Config{
-			APIToken: "my-token",
+			APIToken: "my-very-secret-token",
 			OrgId:    "my-org-id",
 		})
 		if err != nil {
@@ -64,8 +68,14 @@ func TestBackend_PathConfigRead(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if resp.Data["APIToken"].(string) != "my-token" {
-			t.Errorf("expected api-token to be 'my-token'")
+		if _, ok := resp.Data["APIToken"]; ok {
+			t.Errorf("expected %q to not include the api-token", resp.Data)
+		}
+		if v, exp := resp.Data["APITokenFingerprint"].(string), tokenFingerprint("my-very-secret-token"); v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+		if v := resp.Data["APITokenFingerprint"].(string); strings.Contains(v, "my-very-secret") {
+			t.Errorf("expected %q to not contain the api-token", v)
 		}
 		if resp.Data["OrgId"].(string) != "my-org-id" {
 			t.Errorf("expected org-id to be 'my-org-id'")
@@ -92,6 +102,7 @@ func TestBackend_PathConfigUpdate(t *testing.T) {
 			Data: map[string]interface{}{
 				"api-token": "my-token",
 				"org-id":    "my-org-id",
+				"verify":    false,
 			},
 		}); err != nil {
 			t.Fatal(err)
@@ -134,6 +145,7 @@ func TestBackend_PathConfigUpdate(t *testing.T) {
 			Data: map[string]interface{}{
 				"api-token": "my-new-token",
 				"org-id":    "my-new-org-id",
+				"verify":    false,
 			},
 		}); err != nil {
 			t.Fatal(err)
@@ -218,3 +230,207 @@ func TestBackend_PathConfigDelete(t *testing.T) {
 		}
 	})
 }
+
+func TestBackend_PathConfigVerify(t *testing.T) {
+	t.Parallel()
+
+	writeConfig := func(b *backend, storage logical.Storage, data map[string]interface{}) error {
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "config",
+			Data:      data,
+		})
+		return err
+	}
+
+	t.Run("success", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage := testBackend(t)
+		server := newFakeCircleCI(t)
+		if err := writeConfig(b, storage, map[string]interface{}{
+			"api-token": testAPIToken,
+			"org-id":    testOrgID,
+			"base-url":  server.URL,
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := b.Config(context.Background(), storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, exp := config.OrgName, "my-org"; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+		if v, exp := config.OrgSlug, "gh/my-org"; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+		if v, exp := config.TokenOwner, "my-user"; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+	})
+
+	t.Run("bad_token", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage := testBackend(t)
+		server := newFakeCircleCI(t)
+		err := writeConfig(b, storage, map[string]interface{}{
+			"api-token": "not-my-token",
+			"org-id":    testOrgID,
+			"base-url":  server.URL,
+		})
+		if err == nil || !strings.Contains(err.Error(), "rejected") {
+			t.Fatalf("expected token to be rejected, got %v", err)
+		}
+
+		config, err := b.Config(context.Background(), storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if def := DefaultConfig(); !reflect.DeepEqual(config, def) {
+			t.Errorf("expected %v to be %v", config, def)
+		}
+	})
+
+	t.Run("bad_org", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage := testBackend(t)
+		server := newFakeCircleCI(t)
+		err := writeConfig(b, storage, map[string]interface{}{
+			"api-token": testAPIToken,
+			"org-id":    "not-my-org-id",
+			"base-url":  server.URL,
+		})
+		if err == nil || !strings.Contains(err.Error(), "no access") {
+			t.Fatalf("expected org to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("ca_cert", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage := testBackend(t)
+		server := newFakeCircleCITLS(t)
+		data := map[string]interface{}{
+			"api-token": testAPIToken,
+			"org-id":    testOrgID,
+			"base-url":  server.URL,
+		}
+		if err := writeConfig(b, storage, data); err == nil {
+			t.Fatal("expected error for untrusted certificate")
+		}
+
+		data["ca-cert"] = string(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: server.Certificate().Raw,
+		}))
+		if err := writeConfig(b, storage, data); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("tls_skip_verify", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage := testBackend(t)
+		server := newFakeCircleCITLS(t)
+		if err := writeConfig(b, storage, map[string]interface{}{
+			"api-token":       testAPIToken,
+			"org-id":          testOrgID,
+			"base-url":        server.URL,
+			"tls-skip-verify": true,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("proxy_url", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage := testBackend(t)
+		server := newFakeCircleCI(t)
+		if err := writeConfig(b, storage, map[string]interface{}{
+			"api-token": testAPIToken,
+			"org-id":    testOrgID,
+			"base-url":  "http://circleci.invalid",
+			"proxy-url": server.URL,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if server.Requests("GET me") != 1 {
+			t.Errorf("expected the request to go through the proxy")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage := testBackend(t)
+		server := newFakeCircleCI(t)
+		server.SetIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return true
+		})
+		start := time.Now()
+		err := writeConfig(b, storage, map[string]interface{}{
+			"api-token": testAPIToken,
+			"org-id":    testOrgID,
+			"base-url":  server.URL,
+			"timeout":   1,
+		})
+		if err == nil {
+			t.Fatal("expected timeout")
+		}
+		if d := time.Since(start); d > 4*time.Second {
+			t.Errorf("expected request to time out after 1s, took %s", d)
+		}
+	})
+
+	t.Run("invalid_fields", func(t *testing.T) {
+		t.Parallel()
+
+		for _, data := range []map[string]interface{}{
+			{"base-url": "ftp://circleci.example.com"},
+			{"base-url": "circleci.example.com"},
+			{"proxy-url": "not a url"},
+			{"ca-cert": "not a certificate"},
+		} {
+			b, storage := testBackend(t)
+			data["api-token"] = testAPIToken
+			data["org-id"] = testOrgID
+			data["verify"] = false
+			if err := writeConfig(b, storage, data); err == nil {
+				t.Errorf("expected error for %v", data)
+			}
+		}
+	})
+}
+
+func TestBackend_CircleCIClient_BaseURL(t *testing.T) {
+	t.Parallel()
+
+	b, storage, server := testBackendWithCircleCI(t)
+	server.AddContext("my-context")
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.ListOperation,
+		Path:      "context/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, exp := resp.Data["keys"], []string{"my-context"}; !reflect.DeepEqual(v, exp) {
+		t.Errorf("expected %q to be %q", v, exp)
+	}
+	if server.Requests("GET context") != 1 {
+		t.Errorf("expected the context list to be requested from the configured base-url")
+	}
+}
@@ -0,0 +1,208 @@
+package circleci
+
+import (
+	"context"
+	"errors"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// vaultConfigKey is the storage key of the connection to the Vault API that
+// vault-token/ mints tokens through.
+const vaultConfigKey = "config/vault"
+
+// vaultConfig is the connection to the Vault API that vault-token/ mints
+// tokens through.
+type vaultConfig struct {
+	Address   string `json:"address"`
+	Token     string `json:"token"`
+	Namespace string `json:"namespace,omitempty"`
+	CACert    string `json:"ca_cert,omitempty"`
+}
+
+// pathConfigVault defines the circleci/config/vault path on the backend.
+func (b *backend) pathConfigVault() *framework.Path {
+	return &framework.Path{
+		Pattern: "config/vault",
+
+		HelpSynopsis: "Configure the connection to Vault that tokens are minted through",
+		HelpDescription: "Configure the address of the Vault API and the token that vault-token/<role> creates tokens " +
+			"with. Orphan tokens require a token with sudo on auth/token/create-orphan.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"address": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The address of the Vault API, e.g. https://vault.example.com:8200.",
+			},
+			"token": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The Vault token to create tokens with. It must be allowed to create, renew and revoke tokens.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Sensitive: true,
+				},
+			},
+			"namespace": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The Vault namespace to create tokens in.",
+			},
+			"ca_cert": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "PEM encoded CA certificates to verify the TLS certificate of Vault with, instead of the system roots.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathConfigVaultWrite)},
+			logical.ReadOperation:   &framework.PathOperation{Callback: withFieldValidator(b.pathConfigVaultRead)},
+			logical.DeleteOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathConfigVaultDelete)},
+		},
+	}
+}
+
+// pathConfigVaultRead corresponds to READ circleci/config/vault. The token is
+// never returned.
+func (b *backend) pathConfigVaultRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	c, err := b.VaultConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, nil
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"address":   c.Address,
+			"namespace": c.Namespace,
+			"ca_cert":   c.CACert,
+		},
+	}, nil
+}
+
+// pathConfigVaultWrite corresponds to UPDATE circleci/config/vault.
+func (b *backend) pathConfigVaultWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	c, err := b.VaultConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		c = &vaultConfig{}
+	}
+	if v, ok := d.GetOk("address"); ok {
+		c.Address = v.(string)
+	}
+	if v, ok := d.GetOk("token"); ok {
+		c.Token = v.(string)
+	}
+	if v, ok := d.GetOk("namespace"); ok {
+		c.Namespace = v.(string)
+	}
+	if v, ok := d.GetOk("ca_cert"); ok {
+		c.CACert = v.(string)
+	}
+	if c.Address == "" || c.Token == "" {
+		return nil, logical.CodedError(400, "address and token are required")
+	}
+	if _, err := newVaultClient(c); err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	entry, err := logical.StorageEntryJSON(vaultConfigKey, c)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to generate JSON Vault configuration: {{err}}", err)
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, errwrap.Wrapf("failed to persist Vault configuration to storage: {{err}}", err)
+	}
+	b.ResetVaultClient()
+	return nil, nil
+}
+
+// pathConfigVaultDelete corresponds to DELETE circleci/config/vault.
+func (b *backend) pathConfigVaultDelete(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, vaultConfigKey); err != nil {
+		return nil, errwrap.Wrapf("failed to delete Vault configuration from storage: {{err}}", err)
+	}
+	b.ResetVaultClient()
+	return nil, nil
+}
+
+// VaultConfig returns the connection to the Vault API, or nil if it is not
+// configured.
+func (b *backend) VaultConfig(ctx context.Context, s logical.Storage) (*vaultConfig, error) {
+	entry, err := s.Get(ctx, vaultConfigKey)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to get Vault configuration from storage: {{err}}", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var c vaultConfig
+	if err := entry.DecodeJSON(&c); err != nil {
+		return nil, errwrap.Wrapf("failed to decode Vault configuration: {{err}}", err)
+	}
+	return &c, nil
+}
+
+// ResetVaultClient drops the cached Vault client, if any.
+func (b *backend) ResetVaultClient() {
+	b.vaultClientLock.Lock()
+	defer b.vaultClientLock.Unlock()
+	b.vaultClient = nil
+}
+
+// VaultClient returns the client for talking to the Vault API, creating it if
+// needed. The client is safe for concurrent use.
+func (b *backend) VaultClient(ctx context.Context, s logical.Storage) (*api.Client, error) {
+	b.vaultClientLock.Lock()
+	defer b.vaultClientLock.Unlock()
+
+	if b.vaultClient != nil {
+		return b.vaultClient, nil
+	}
+
+	c, err := b.VaultConfig(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, logical.CodedError(400, "the connection to Vault is not configured at config/vault")
+	}
+
+	client, err := newVaultClient(c)
+	if err != nil {
+		return nil, err
+	}
+	b.vaultClient = client
+	return client, nil
+}
+
+// newVaultClient creates a new Vault client from the given configuration,
+// which takes precedence over the VAULT_* environment variables of the plugin
+// process.
+func newVaultClient(c *vaultConfig) (*api.Client, error) {
+	config := api.DefaultConfig()
+	if config.Error != nil {
+		return nil, config.Error
+	}
+	config.Address = c.Address
+	if c.CACert != "" {
+		if err := config.ConfigureTLS(&api.TLSConfig{CACertBytes: []byte(c.CACert)}); err != nil {
+			return nil, errwrap.Wrapf("invalid ca_cert: {{err}}", err)
+		}
+	}
+
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token == "" {
+		return nil, errors.New("token must not be empty")
+	}
+	client.SetToken(c.Token)
+	client.SetNamespace(c.Namespace)
+	return client, nil
+}
@@ -4,44 +4,54 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
+
+	circleci "github.com/bobthebuilderberlin/go-circleci"
+	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
-	circleci "github.com/bobthebuilderberlin/go-circleci"
 )
 
 func (b *backend) pathContext() *framework.Path {
 	return &framework.Path{
-		Pattern: "context/?$",
+		Pattern: orgPrefix + "context/?$",
 
 		HelpSynopsis:    "List contexts, create new contexts.",
 		HelpDescription: "TODO: write description for path",
 
 		Fields: map[string]*framework.FieldSchema{
+			"org":     orgField(),
+			"refresh": refreshField(),
 			"context": &framework.FieldSchema{
 				Type:        framework.TypeString,
 				Description: "The name of the CircleCI context you would like to create.",
 			},
+			"ttl":     contextTTLField(),
+			"max_ttl": contextMaxTTLField(),
 		},
 
 		Operations: map[logical.Operation]framework.OperationHandler{
-			logical.ListOperation:   &framework.PathOperation{ Callback: withFieldValidator(b.pathContextsList)},
-			logical.CreateOperation: &framework.PathOperation{ Callback: withFieldValidator(b.pathContextWrite)},
-			logical.UpdateOperation: &framework.PathOperation{ Callback: withFieldValidator(b.pathContextWrite)},
-			logical.DeleteOperation: &framework.PathOperation{ Callback: withFieldValidator(b.pathContextDelete)},
+			logical.ListOperation:   &framework.PathOperation{Callback: withFieldValidator(b.pathContextsList)},
+			logical.CreateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathContextWrite)},
+			logical.UpdateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathContextWrite)},
+			logical.DeleteOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathContextDelete)},
 		},
 	}
 }
 
-// pathContextsList corresponds to PUT/POST gcpkms/decrypt/:key and is
-// used to decrypt the ciphertext string using the named key.
+// pathContextsList corresponds to LIST circleci/context and lists the names
+// of the contexts of the organization.
 func (b *backend) pathContextsList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-
-	config, err := b.Config(b.ctx, req.Storage)
+	org := orgName(d)
+	if d.Get("refresh").(bool) {
+		b.invalidateContexts(ctx, req.Storage, org)
+	}
+	config, err := b.OrgConfig(b.ctx, req.Storage, org)
 	if err != nil {
 		return nil, err
 	}
 
-	collectedContexts, err := b.collectContexts(ctx, req, config)
+	collectedContexts, err := b.collectContexts(ctx, req, org, config)
 	if err != nil {
 		return nil, err
 	}
@@ -53,31 +63,87 @@ func (b *backend) pathContextsList(ctx context.Context, req *logical.Request, d
 	return logical.ListResponse(collectedContextNames), nil
 }
 
-// pathContextsList corresponds to PUT/POST gcpkms/decrypt/:key and is
-// used to decrypt the ciphertext string using the named key.
+// pathContextWrite corresponds to both CREATE and UPDATE circleci/context
+// and creates the named context.
 func (b *backend) pathContextWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	circleCIClient, closer, err := b.CircleCIClient(req.Storage)
-	defer closer()
+	if err := b.checkContextAccess(ctx, req, d.Get("context").(string)); err != nil {
+		return nil, err
+	}
+	return b.contextWrite(ctx, req, d, orgName(d))
+}
+
+// contextWrite creates the context named by the request in the given
+// organization.
+func (b *backend) contextWrite(ctx context.Context, req *logical.Request, d *framework.FieldData, org string) (*logical.Response, error) {
+	if d.Get("refresh").(bool) {
+		b.invalidateContexts(ctx, req.Storage, org)
+	}
+	circleCIClient, err := b.CircleCIClient(req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
 
 	circleCIContext := d.Get("context").(string)
 	if circleCIContext == "" {
 		return nil, errors.New("'context' variable is required to create a new CircleCI context")
 	}
-	config, err := b.Config(b.ctx, req.Storage)
+	config, err := b.OrgConfig(b.ctx, req.Storage, org)
 	if err != nil {
 		return nil, err
 	}
 
+	ttl, maxTTL, err := leaseTTLs(d)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ephemeral contexts are deleted again if the request fails before their
+	// lease is returned
+	var walID string
+	if ttl > 0 {
+		now := time.Now().UTC()
+		timeout := config.Timeout
+		if timeout <= 0 {
+			timeout = walRollbackMinAge
+		}
+		walID, err = framework.PutWAL(ctx, req.Storage, walTypeContext, &walContext{
+			Org:       org,
+			Name:      circleCIContext,
+			CreatedAt: now,
+			Deadline:  now.Add(timeout),
+		})
+		if err != nil {
+			return nil, errwrap.Wrapf("failed to write WAL entry: {{err}}", err)
+		}
+	}
+
 	createdContext, err := circleCIClient.Contexts.Create(ctx, circleci.ContextCreateOptions{
 		Name: &circleCIContext,
 		Owner: &circleci.OwnerOptions{
 			ID: &config.OrgId,
 		},
 	})
-
 	if err != nil {
+		// A context CircleCI rejected was not created. Its WAL entry is
+		// deleted, so that rolling it back cannot delete a context created by
+		// a retry
+		if walID != "" && createRejected(err) {
+			if err := framework.DeleteWAL(ctx, req.Storage, walID); err != nil {
+				b.Logger().Warn("Failed to delete WAL entry", "walID", walID, "error", err)
+			}
+		}
 		return nil, err
 	}
+	b.invalidateContexts(ctx, req.Storage, org)
+
+	if ttl > 0 {
+		resp := b.contextLease(org, createdContext, ttl, maxTTL)
+		if err := b.deleteContextWALs(ctx, req.Storage, org, circleCIContext); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+
 	return &logical.Response{
 		Data: map[string]interface{}{
 			"context": createdContext,
@@ -86,64 +152,82 @@ func (b *backend) pathContextWrite(ctx context.Context, req *logical.Request, d
 }
 
 func (b *backend) pathContextDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	org := orgName(d)
+	if d.Get("refresh").(bool) {
+		b.invalidateContexts(ctx, req.Storage, org)
+	}
 	circleCIContext := d.Get("context").(string)
 	if circleCIContext == "" {
 		return nil, errors.New("'context' variable is required to delete CircleCI context")
 	}
-	config, err := b.Config(b.ctx, req.Storage)
+	if err := b.checkContextAccess(ctx, req, circleCIContext); err != nil {
+		return nil, err
+	}
+	config, err := b.OrgConfig(b.ctx, req.Storage, org)
 	if err != nil {
 		return nil, err
 	}
 
-	collectedContexts, err := b.collectContexts(ctx, req, config)
+	foundContext, err := b.findContext(ctx, req, org, config, circleCIContext)
 	if err != nil {
 		return nil, err
 	}
 
-	circleCIClient, closer, err := b.CircleCIClient(req.Storage)
+	circleCIClient, err := b.CircleCIClient(req.Storage, org)
 	if err != nil {
 		return nil, err
 	}
 
-	defer closer()
-	for i := 0; i < len(collectedContexts); i++ {
-		if collectedContexts[i].Name == circleCIContext {
-			err := circleCIClient.Contexts.Delete(ctx, collectedContexts[i].ID)
-			if err != nil {
-				return nil, err
-			}
-			return &logical.Response{
-				Data: map[string]interface{}{
-					"deletionSuccessful": true,
-				},
-			}, nil
-		}
+	if err := circleCIClient.Contexts.Delete(ctx, foundContext.ID); err != nil {
+		return nil, err
 	}
-
-	return nil, fmt.Errorf("context '%v'was not found", circleCIContext)
+	b.invalidateContexts(ctx, req.Storage, org)
+	if err := b.deleteContextState(ctx, req.Storage, org, foundContext.Name); err != nil {
+		return nil, err
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"deletionSuccessful": true,
+		},
+	}, nil
 }
 
-func (b *backend) collectContexts(ctx context.Context, req *logical.Request, config *Config) ([]*circleci.Context, error) {
-	circleCIClient, closer, err := b.CircleCIClient(req.Storage)
-	if err != nil {
-		return nil, err
+// deleteContextState deletes everything Vault keeps about the given context:
+// the records of its variables, its enforcement and its rotations.
+func (b *backend) deleteContextState(ctx context.Context, s logical.Storage, org, contextName string) error {
+	if err := b.deleteStoredContext(ctx, s, org, contextName); err != nil {
+		return err
+	}
+	if err := s.Delete(ctx, enforceKey(org, contextName)); err != nil {
+		return errwrap.Wrapf("failed to delete enforcement from storage: {{err}}", err)
 	}
-	defer closer()
+	return b.deleteRotations(ctx, s, org, contextName)
+}
+
+// findContext resolves a context name to the CircleCI context, using the
+// context cache. A context that does not exist is reported as a 404 error.
+func (b *backend) findContext(ctx context.Context, req *logical.Request, org string, config *Config, name string) (*circleci.Context, error) {
+	// A context that is missing from the cache may have been created outside
+	// of Vault, so the cache is refreshed once before giving up.
+	for attempt := 0; attempt < 2; attempt++ {
+		if attempt > 0 {
+			b.invalidateContexts(ctx, req.Storage, org)
+		}
 
-	var collectedContexts []*circleci.Context
-	var nextPageToken string
-	for {
-		contextList, err := circleCIClient.Contexts.List(ctx, circleci.ContextListOptions{OwnerID: &config.OrgId, PageToken: &nextPageToken})
+		collectedContexts, err := b.collectContexts(ctx, req, org, config)
 		if err != nil {
 			return nil, err
 		}
-		for _, contextListItem := range contextList.Items {
-			collectedContexts = append(collectedContexts, contextListItem)
+
+		for _, collectedContext := range collectedContexts {
+			if collectedContext.Name == name {
+				return collectedContext, nil
+			}
 		}
-		if contextList.NextPageToken == "" {
+
+		if config.ContextCacheTTL <= 0 {
 			break
 		}
-		nextPageToken = contextList.NextPageToken
 	}
-	return collectedContexts, nil
+	return nil, logical.CodedError(404, fmt.Sprintf("context '%v' was not found", name))
 }
@@ -2,19 +2,30 @@ package circleci
 
 import (
 	"context"
-	"fmt"
+	"sort"
+
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
 func (b *backend) pathContextEnvList() *framework.Path {
 	return &framework.Path{
-		Pattern: "context/" + framework.GenericNameRegex("context") + "/?$",
+		Pattern: orgPrefix + "context/" + framework.GenericNameRegex("context") + "/?$",
 
-		HelpSynopsis:    "List a context's environment variables",
+		HelpSynopsis:    "Read a context and list its environment variables",
 		HelpDescription: "TODO: write description for path",
 
 		Fields: map[string]*framework.FieldSchema{
+			"org":     orgField(),
+			"refresh": refreshField(),
+			"after": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "List only the variables whose names sort after the given name.",
+			},
+			"limit": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "The maximum number of variables to list.",
+			},
 			"context": &framework.FieldSchema{
 				Type:        framework.TypeString,
 				Description: "The name of the CircleCI context you would like to create.",
@@ -23,43 +34,113 @@ func (b *backend) pathContextEnvList() *framework.Path {
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.ListOperation: withFieldValidator(b.pathContextEnvLister),
+			logical.ReadOperation: withFieldValidator(b.pathContextRead),
 		},
 	}
 }
 
-// pathContextsList corresponds to PUT/POST gcpkms/decrypt/:key and is
-// used to decrypt the ciphertext string using the named key.
+// pathContextEnvLister corresponds to LIST circleci/context/:context and
+// lists the environment variables of the context.
 func (b *backend) pathContextEnvLister(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	org := orgName(d)
+	if d.Get("refresh").(bool) {
+		b.invalidateContexts(ctx, req.Storage, org)
+	}
+	circleCIContext := d.Get("context").(string)
+
+	config, err := b.OrgConfig(b.ctx, req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+
+	foundContext, err := b.findContext(ctx, req, org, config, circleCIContext)
+	if err != nil {
+		return nil, err
+	}
+
+	circleCIClient, err := b.CircleCIClient(req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+
+	contextVariables, err := circleCIClient.AllContextVariables(ctx, foundContext.ID)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(contextVariables, func(i, j int) bool {
+		return contextVariables[i].Variable < contextVariables[j].Variable
+	})
+
+	// Page through the sorted variables with after and limit
+	if after := d.Get("after").(string); after != "" {
+		start := sort.Search(len(contextVariables), func(i int) bool {
+			return contextVariables[i].Variable > after
+		})
+		contextVariables = contextVariables[start:]
+	}
+	if limit := d.Get("limit").(int); limit > 0 && limit < len(contextVariables) {
+		contextVariables = contextVariables[:limit]
+	}
+
+	listOfVariableNames := make([]string, len(contextVariables))
+	variableInfo := make(map[string]interface{}, len(contextVariables))
+	for i, contextVariable := range contextVariables {
+		listOfVariableNames[i] = contextVariable.Variable
+		variableInfo[contextVariable.Variable] = map[string]interface{}{
+			"context_id": contextVariable.ContextID,
+			"created_at": contextVariable.CreatedAt,
+			"updated_at": contextVariable.UpdatedAt,
+		}
+	}
+	return logical.ListResponseWithInfo(listOfVariableNames, variableInfo), nil
+}
+
+// pathContextRead corresponds to READ circleci/context/:context and returns the
+// context's metadata together with a summary of its environment variables.
+// CircleCI does not report the owner of a context, so none is returned.
+func (b *backend) pathContextRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	org := orgName(d)
+	if d.Get("refresh").(bool) {
+		b.invalidateContexts(ctx, req.Storage, org)
+	}
 	circleCIContext := d.Get("context").(string)
 
-	config, err := b.Config(b.ctx, req.Storage)
+	config, err := b.OrgConfig(ctx, req.Storage, org)
 	if err != nil {
 		return nil, err
 	}
 
-	collectedContexts, err := b.collectContexts(ctx, req, config)
+	foundContext, err := b.findContext(ctx, req, org, config, circleCIContext)
 	if err != nil {
 		return nil, err
 	}
 
-	circleCIClient, closer, err := b.CircleCIClient(req.Storage)
+	circleCIClient, err := b.CircleCIClient(req.Storage, org)
 	if err != nil {
 		return nil, err
 	}
-	defer closer()
-
-	for i := 0; i < len(collectedContexts); i++ {
-		if collectedContexts[i].Name == circleCIContext {
-			contextVariableList, err := circleCIClient.Contexts.ListVariables(ctx, collectedContexts[i].ID)
-			listOfVariableNames := make([]string, len(contextVariableList.Items))
-			for i:=0; i < len(contextVariableList.Items) ;i++ {
-				listOfVariableNames[i] = contextVariableList.Items[i].Variable
-			}
-			if err != nil {
-				return nil, err
-			}
-			return logical.ListResponse(listOfVariableNames), nil
+
+	contextVariables, err := circleCIClient.AllContextVariables(ctx, foundContext.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	variables := make([]map[string]interface{}, len(contextVariables))
+	for i, contextVariable := range contextVariables {
+		variables[i] = map[string]interface{}{
+			"variable":   contextVariable.Variable,
+			"created_at": contextVariable.CreatedAt,
+			"updated_at": contextVariable.UpdatedAt,
 		}
 	}
-	return nil, fmt.Errorf("no context with name '%v' was found", circleCIContext)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"id":             foundContext.ID,
+			"name":           foundContext.Name,
+			"created_at":     foundContext.CreatedAt,
+			"variable_count": len(variables),
+			"variables":      variables,
+		},
+	}, nil
 }
@@ -0,0 +1,95 @@
+package circleci
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestBackend_PathContextRead(t *testing.T) {
+	t.Parallel()
+
+	t.Run("field_validation", func(t *testing.T) {
+		t.Parallel()
+		testFieldValidation(t, logical.ReadOperation, "context/my-context")
+	})
+}
+
+func TestBackend_PathContextEnvList(t *testing.T) {
+	t.Parallel()
+
+	t.Run("field_validation", func(t *testing.T) {
+		t.Parallel()
+		testFieldValidation(t, logical.ListOperation, "context/my-context/")
+	})
+
+	t.Run("paginates", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.pageSize = 2
+		server.AddContext("my-context", "E", "D", "C", "B", "A")
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ListOperation,
+			Path:      "context/my-context/",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, exp := resp.Data["keys"], []string{"A", "B", "C", "D", "E"}; !reflect.DeepEqual(v, exp) {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+		if v := server.Requests("GET context/" + server.Context("my-context").ID + "/environment-variable"); v != 3 {
+			t.Errorf("expected 3 pages to be requested, got %d", v)
+		}
+
+		keyInfo := resp.Data["key_info"].(map[string]interface{})
+		info := keyInfo["A"].(map[string]interface{})
+		if v := info["updated_at"].(time.Time); v.IsZero() {
+			t.Errorf("expected updated_at to be set")
+		}
+	})
+
+	t.Run("limit_after", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context", "E", "D", "C", "B", "A")
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ListOperation,
+			Path:      "context/my-context/",
+			Data: map[string]interface{}{
+				"after": "B",
+				"limit": 2,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, exp := resp.Data["keys"], []string{"C", "D"}; !reflect.DeepEqual(v, exp) {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+	})
+
+	t.Run("not_found", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, _ := testBackendWithCircleCI(t)
+
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ListOperation,
+			Path:      "context/my-context/",
+		})
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 404 {
+			t.Errorf("expected 404, got %v", err)
+		}
+	})
+}
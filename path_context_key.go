@@ -3,78 +3,270 @@ package circleci
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strings"
+
+	circleci "github.com/bobthebuilderberlin/go-circleci"
+	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
-	circleci "github.com/bobthebuilderberlin/go-circleci"
 )
 
 func (b *backend) pathContextKey() *framework.Path {
+	fields := map[string]*framework.FieldSchema{
+		"org":     orgField(),
+		"refresh": refreshField(),
+		"context": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "The name of the CircleCI context you would like to alter.",
+			Required:    true,
+		},
+		"env": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "The name of the environment variable you want to read or write in the given CircleCI context.",
+			Required:    true,
+		},
+		"value": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "The value of the environment variable. Required unless generate is set.",
+		},
+		"comment": commentField(),
+		"ttl":     variableTTLField(),
+		"max_ttl": variableMaxTTLField(),
+	}
+	for name, schema := range generateFields() {
+		fields[name] = schema
+	}
+
 	return &framework.Path{
-		Pattern: "context/" + framework.GenericNameRegex("context") + "/" + framework.GenericNameRegex("env"),
+		Pattern: orgPrefix + "context/" + framework.GenericNameRegex("context") + "/" + framework.GenericNameRegex("env"),
 
-		HelpSynopsis:    "Read and write environment variables in CircleCI contexts",
+		HelpSynopsis:    "Read, write and delete environment variables in CircleCI contexts",
 		HelpDescription: "TODO: write description for path",
 
-		Fields: map[string]*framework.FieldSchema{
-			"context": &framework.FieldSchema{
-				Type:        framework.TypeString,
-				Description: "The name of the CircleCI context you would like to alter.",
-				Required:    true,
-			},
-			"env": &framework.FieldSchema{
-				Type:        framework.TypeString,
-				Description: "The name of the environment variable you want to read or write in the given CircleCI context.",
-				Required:    true,
-			},
-			"value": &framework.FieldSchema{
-				Type:        framework.TypeString,
-				Description: "The name of the environment variable you want to read or write in the given CircleCI context.",
-				Required:    true,
-			},
-		},
+		Fields: fields,
 
 		Operations: map[logical.Operation]framework.OperationHandler{
-			logical.CreateOperation: &framework.PathOperation{ Callback: withFieldValidator(b.pathContextKeyWrite)},
-			logical.UpdateOperation: &framework.PathOperation{ Callback: withFieldValidator(b.pathContextKeyWrite)},
+			logical.CreateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathContextKeyWrite)},
+			logical.UpdateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathContextKeyWrite)},
+			logical.ReadOperation:   &framework.PathOperation{Callback: withFieldValidator(b.pathContextKeyRead)},
+			logical.DeleteOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathContextKeyDelete)},
 		},
 	}
 }
 
-// pathContextsList corresponds to PUT/POST gcpkms/decrypt/:key and is
-// used to decrypt the ciphertext string using the named key.
+// pathContextKeyWrite corresponds to both CREATE and UPDATE
+// circleci/context/:context/:env and writes the environment variable.
 func (b *backend) pathContextKeyWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if err := b.checkContextAccess(ctx, req, d.Get("context").(string)); err != nil {
+		return nil, err
+	}
+	return b.contextKeyWrite(ctx, req, d, orgName(d))
+}
+
+// contextKeyWrite creates or updates the environment variable named by the
+// request in the given organization.
+func (b *backend) contextKeyWrite(ctx context.Context, req *logical.Request, d *framework.FieldData, org string) (*logical.Response, error) {
+	if d.Get("refresh").(bool) {
+		b.invalidateContexts(ctx, req.Storage, org)
+	}
 	circleCIContext := d.Get("context").(string)
 	envVariable := d.Get("env").(string)
 	value := d.Get("value").(string)
-	config, err := b.Config(b.ctx, req.Storage)
+	config, err := b.OrgConfig(b.ctx, req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl, maxTTL, err := leaseTTLs(d)
+	if err != nil {
+		return nil, err
+	}
+
+	var generator *valueGenerator
+	if d.Get("generate").(bool) {
+		if _, ok := d.GetOk("value"); ok {
+			return nil, logical.CodedError(400, "value cannot be combined with generate")
+		}
+		generator = defaultGenerator()
+		if err := generator.Update(d); err != nil {
+			return nil, logical.CodedError(400, err.Error())
+		}
+	} else if names := generateOptionsSet(d); len(names) > 0 {
+		return nil, logical.CodedError(400, fmt.Sprintf("%s cannot be set without generate", strings.Join(names, ", ")))
+	} else if value == "" {
+		return nil, logical.CodedError(400, "value is required unless generate is set")
+	}
+
+	foundContext, err := b.findContext(ctx, req, org, config, circleCIContext)
+	if err != nil {
+		return nil, err
+	}
+
+	circleCIClient, err := b.CircleCIClient(req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+
+	if generator != nil {
+		value, err = generator.Generate(ctx, b.System())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	contextVariable, err := circleCIClient.AddOrUpdateContextVariable(ctx, foundContext.ID, envVariable, value)
+	if err != nil {
+		return nil, err
+	}
+	b.Logger().Debug("Variable in context successfully created or updated", "context", foundContext.Name, "contextID", foundContext.ID, "envVariable", contextVariable.Variable)
+
+	// A time-limited write keeps the version it replaced until the lease ends
+	var version *variableVersion
+	var previousVersion int
+	if ttl > 0 {
+		version, previousVersion, err = b.recordLeasedVariable(ctx, req, org, config, foundContext.Name, contextVariable, value, d.Get("comment").(string))
+	} else {
+		version, err = b.recordVariable(ctx, req, org, config, foundContext.Name, contextVariable, value, d.Get("comment").(string))
+	}
+	if err != nil {
+		return nil, errwrap.Wrapf("the variable was written to CircleCI, but its value could not be stored: {{err}}", err)
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"contextEnvironmentVariable": contextVariable.Variable,
+		},
+	}
+	if version != nil {
+		resp.Data["version"] = version.Version
+	}
+	if generator != nil && d.Get("return_value").(bool) {
+		resp.Data["value"] = value
+	}
+
+	if ttl > 0 {
+		return b.variableLease(secretTypeVariable, resp.Data, org, foundContext.Name, contextVariable, previousVersion, ttl, maxTTL), nil
+	}
+	return resp, nil
+}
+
+// pathContextKeyRead corresponds to READ circleci/context/:context/:env and is
+// used to read the metadata of a single environment variable. CircleCI never
+// returns the value itself.
+func (b *backend) pathContextKeyRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	return b.contextKeyRead(ctx, req, d, orgName(d))
+}
+
+// contextKeyRead reads the metadata of the environment variable named by the
+// request in the given organization.
+func (b *backend) contextKeyRead(ctx context.Context, req *logical.Request, d *framework.FieldData, org string) (*logical.Response, error) {
+	if d.Get("refresh").(bool) {
+		b.invalidateContexts(ctx, req.Storage, org)
+	}
+	circleCIContext := d.Get("context").(string)
+	envVariable := d.Get("env").(string)
+	config, err := b.OrgConfig(ctx, req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+
+	contextVariable, err := b.findContextVariable(ctx, req, org, config, circleCIContext, envVariable)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"variable":   contextVariable.Variable,
+			"context":    circleCIContext,
+			"context_id": contextVariable.ContextID,
+			"created_at": contextVariable.CreatedAt,
+			"updated_at": contextVariable.UpdatedAt,
+		},
+	}, nil
+}
+
+// pathContextKeyDelete corresponds to DELETE circleci/context/:context/:env
+// and removes the environment variable from the CircleCI context.
+func (b *backend) pathContextKeyDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if err := b.checkContextAccess(ctx, req, d.Get("context").(string)); err != nil {
+		return nil, err
+	}
+	return b.contextKeyDelete(ctx, req, d, orgName(d))
+}
+
+// contextKeyDelete removes the environment variable named by the request from
+// its context in the given organization.
+func (b *backend) contextKeyDelete(ctx context.Context, req *logical.Request, d *framework.FieldData, org string) (*logical.Response, error) {
+	if d.Get("refresh").(bool) {
+		b.invalidateContexts(ctx, req.Storage, org)
+	}
+	circleCIContext := d.Get("context").(string)
+	envVariable := d.Get("env").(string)
+	config, err := b.OrgConfig(ctx, req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+
+	contextVariable, err := b.findContextVariable(ctx, req, org, config, circleCIContext, envVariable)
+	if err != nil {
+		return nil, err
+	}
+
+	circleCIClient, err := b.CircleCIClient(req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := circleCIClient.Contexts.RemoveVariable(ctx, contextVariable.ContextID, contextVariable.Variable); err != nil {
+		if errors.Is(err, circleci.ErrNotFound) {
+			return nil, logical.CodedError(404, fmt.Sprintf("variable '%v' was not found in context '%v'", envVariable, circleCIContext))
+		}
+		return nil, err
+	}
+	b.Logger().Debug("Variable in context successfully deleted", "context", circleCIContext, "contextID", contextVariable.ContextID, "envVariable", contextVariable.Variable)
+
+	return nil, b.forgetVariable(ctx, req.Storage, org, circleCIContext, envVariable)
+}
+
+// forgetVariable deletes the record and the rotation of the given environment
+// variable, once it was removed from CircleCI.
+func (b *backend) forgetVariable(ctx context.Context, s logical.Storage, org, contextName, envVariable string) error {
+	if err := b.deleteStoredVariable(ctx, s, org, contextName, envVariable); err != nil {
+		return err
+	}
+	lock := b.rotationLock(org, contextName, envVariable)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := s.Delete(ctx, rotateKey(org, contextName, envVariable)); err != nil {
+		return errwrap.Wrapf("failed to delete rotation from storage: {{err}}", err)
+	}
+	return nil
+}
+
+// findContextVariable resolves the named context to its ID and looks up the
+// given environment variable in it. Missing contexts or variables are
+// reported as 404 errors.
+func (b *backend) findContextVariable(ctx context.Context, req *logical.Request, org string, config *Config, contextName, envVariable string) (*apiContextVariable, error) {
+	circleCIContext, err := b.findContext(ctx, req, org, config, contextName)
 	if err != nil {
 		return nil, err
 	}
 
-	contextList, err := b.collectContexts(ctx, req, config)
+	circleCIClient, err := b.CircleCIClient(req.Storage, org)
 	if err != nil {
 		return nil, err
 	}
 
-	circleCIClient, closer, err := b.CircleCIClient(req.Storage)
+	contextVariables, err := circleCIClient.AllContextVariables(ctx, circleCIContext.ID)
 	if err != nil {
 		return nil, err
 	}
-	defer closer()
-
-	for _, context := range contextList {
-		if context.Name == circleCIContext {
-			contextVariable, err := circleCIClient.Contexts.AddOrUpdateVariable(ctx, context.ID, envVariable, circleci.ContextAddOrUpdateVariableOptions{Value: &value})
-			if err != nil {
-				return nil, err
-			}
-			b.Logger().Debug("Variable in context successfully created or updated", "context", context.Name, "contextID", context.ID, "envVariable", contextVariable.Variable)
-			return &logical.Response{
-				Data: map[string]interface{}{
-					"contextEnvironmentVariable": contextVariable.Variable,
-				},
-			}, nil
+	for _, contextVariable := range contextVariables {
+		if contextVariable.Variable == envVariable {
+			return contextVariable, nil
 		}
 	}
-	return nil, errors.New("context with that name was not found")
+	return nil, logical.CodedError(404, fmt.Sprintf("variable '%v' was not found in context '%v'", envVariable, contextName))
 }
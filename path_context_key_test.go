@@ -1,4 +1,252 @@
 package circleci
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestBackend_PathContextKeyRead(t *testing.T) {
+	t.Parallel()
+
+	t.Run("field_validation", func(t *testing.T) {
+		t.Parallel()
+		testFieldValidation(t, logical.ReadOperation, "context/my-context/FOO")
+	})
+
+	t.Run("metadata", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context", "FOO")
+		variable := server.Variable("my-context", "FOO")
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "context/my-context/FOO",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, exp := range map[string]interface{}{
+			"variable":   "FOO",
+			"context":    "my-context",
+			"context_id": variable.ContextID,
+		} {
+			if v := resp.Data[k]; v != exp {
+				t.Errorf("%s: expected %q to be %q", k, v, exp)
+			}
+		}
+		for _, k := range []string{"created_at", "updated_at"} {
+			if v, ok := resp.Data[k].(time.Time); !ok || !v.Equal(variable.CreatedAt) {
+				t.Errorf("%s: expected %v to be %v", k, resp.Data[k], variable.CreatedAt)
+			}
+		}
+	})
+
+	t.Run("not_found", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context", "FOO")
+
+		for _, pth := range []string{"context/my-context/BAR", "context/other-context/FOO"} {
+			_, err := b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.ReadOperation,
+				Path:      pth,
+			})
+			if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 404 {
+				t.Errorf("%s: expected 404, got %v", pth, err)
+			}
+		}
+	})
+}
+
+func TestBackend_PathContextKeyDelete(t *testing.T) {
+	t.Parallel()
+
+	t.Run("field_validation", func(t *testing.T) {
+		t.Parallel()
+		testFieldValidation(t, logical.DeleteOperation, "context/my-context/FOO")
+	})
+
+	t.Run("deletes", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context", "FOO", "BAR")
+
+		if _, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.DeleteOperation,
+			Path:      "context/my-context/FOO",
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n := server.Requests("DELETE context/" + server.Context("my-context").ID + "/environment-variable/FOO"); n != 1 {
+			t.Errorf("expected CircleCI to be called once, got %d", n)
+		}
+		if server.Variable("my-context", "FOO") != nil {
+			t.Errorf("expected FOO to be deleted")
+		}
+		if server.Variable("my-context", "BAR") == nil {
+			t.Errorf("expected BAR to be kept")
+		}
+	})
+
+	t.Run("not_found", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context", "FOO")
+
+		for _, pth := range []string{"context/my-context/BAR", "context/other-context/FOO"} {
+			_, err := b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.DeleteOperation,
+				Path:      pth,
+			})
+			if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 404 {
+				t.Errorf("%s: expected 404, got %v", pth, err)
+			}
+		}
+		if server.Variable("my-context", "FOO") == nil {
+			t.Errorf("expected FOO to be kept")
+		}
+	})
+}
+
+func TestBackend_PathContextKey(t *testing.T) {
+	t.Parallel()
+
+	b, storage, server := testBackendWithCircleCI(t)
+	server.AddContext("my-context", "FOO")
+	ctx := context.Background()
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Storage:   storage,
+		Operation: logical.ReadOperation,
+		Path:      "context/my-context/FOO",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, exp := resp.Data["context_id"], server.Context("my-context").ID; v != exp {
+		t.Errorf("expected %q to be %q", v, exp)
+	}
+	if v := resp.Data["updated_at"].(time.Time); v.IsZero() {
+		t.Errorf("expected updated_at to be set")
+	}
+
+	if _, err := b.HandleRequest(ctx, &logical.Request{
+		Storage:   storage,
+		Operation: logical.DeleteOperation,
+		Path:      "context/my-context/FOO",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if server.Variable("my-context", "FOO") != nil {
+		t.Errorf("expected variable to be deleted")
+	}
+
+	for _, pth := range []string{"context/my-context/FOO", "context/other-context/FOO"} {
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      pth,
+		})
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 404 {
+			t.Errorf("%s: expected 404, got %v", pth, err)
+		}
+	}
+}
+
+func TestBackend_PathContextKeyValueRequired(t *testing.T) {
+	t.Parallel()
+
+	b, storage, server := testBackendWithCircleCI(t)
+	server.AddContext("my-context", "FOO")
+	value := server.Value("my-context", "FOO")
+
+	for _, data := range []map[string]interface{}{
+		nil,
+		{"value": ""},
+		{"comment": "no value"},
+	} {
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "context/my-context/FOO",
+			Data:      data,
+		})
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 400 || !strings.Contains(err.Error(), "value is required") {
+			t.Errorf("%v: expected 400, got %v", data, err)
+		}
+	}
+	if v := server.Value("my-context", "FOO"); v != value {
+		t.Errorf("expected %q not to be overwritten, got %q", value, v)
+	}
+}
+
+func TestBackend_PathContextKeyGenerate(t *testing.T) {
+	t.Parallel()
+
+	b, storage, server := testBackendWithCircleCI(t)
+	server.AddContext("my-context")
+	b.System().(*logical.StaticSystemView).SetPasswordPolicy("my-policy", func() (string, error) { return "from-policy", nil })
+	ctx := context.Background()
+
+	write := func(data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "context/my-context/FOO",
+			Data:      data,
+		})
+	}
+
+	resp, err := write(map[string]interface{}{"generate": true, "password_policy": "my-policy", "return_value": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, exp := server.Value("my-context", "FOO"), "from-policy"; v != exp {
+		t.Errorf("expected %q to be %q", v, exp)
+	}
+	if v, exp := resp.Data["value"], "from-policy"; v != exp {
+		t.Errorf("expected %q to be %q", v, exp)
+	}
+
+	resp, err = write(map[string]interface{}{"generate": true, "length": 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := server.Value("my-context", "FOO"); len(v) != 16 {
+		t.Errorf("expected a generated value of 16 characters, got %q", v)
+	}
+	if _, ok := resp.Data["value"]; ok {
+		t.Errorf("expected the value not to be returned")
+	}
+
+	for _, data := range []map[string]interface{}{
+		{"generate": true, "value": "bar"},
+		{"generate": true, "password_policy": "unknown"},
+		{"generate": true, "password_policy": "my-policy", "charset": "ab"},
+		{"value": "bar", "length": 64},
+		{"value": "bar", "return_value": true},
+		{"value": "bar", "password_policy": "my-policy"},
+	} {
+		_, err := write(data)
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 400 {
+			t.Errorf("%v: expected 400, got %v", data, err)
+		}
+	}
+}
+
 //
 //import (
 //	"context"
@@ -0,0 +1,78 @@
+package circleci
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// pathContextKeyValue defines the circleci/context/:context/:env/value path
+// on the backend.
+func (b *backend) pathContextKeyValue() *framework.Path {
+	return &framework.Path{
+		Pattern: orgPrefix + "context/" + framework.GenericNameRegex("context") + "/" + framework.GenericNameRegex("env") + "/value",
+
+		HelpSynopsis: "Read the stored value of an environment variable in a CircleCI context",
+		HelpDescription: "Read the value of an environment variable as it was last written through Vault. " +
+			"Values are only stored if the organization is configured with store-values, as CircleCI never returns them. " +
+			"Older versions can be read with version=<n>. Grant access to this path separately from context/<context>/<env>.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"org": orgField(),
+			"context": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the CircleCI context.",
+				Required:    true,
+			},
+			"env": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the environment variable in the given CircleCI context.",
+				Required:    true,
+			},
+			"version": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "The version of the value to read. Defaults to the current version.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathContextKeyValueRead)},
+		},
+	}
+}
+
+// pathContextKeyValueRead corresponds to READ
+// circleci/context/:context/:env/value.
+func (b *backend) pathContextKeyValueRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	circleCIContext := d.Get("context").(string)
+	envVariable := d.Get("env").(string)
+
+	v, err := b.StoredVariable(ctx, req.Storage, orgName(d), circleCIContext, envVariable)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil || v.Value == "" {
+		return nil, logical.CodedError(404, fmt.Sprintf("no value is stored for variable '%v' in context '%v'", envVariable, circleCIContext))
+	}
+
+	version := &variableVersion{Version: v.CurrentVersion(), Value: v.Value, WrittenAt: v.WrittenAt}
+	if n := d.Get("version").(int); n != 0 {
+		version = v.Version(n)
+		if version == nil {
+			return nil, logical.CodedError(404, fmt.Sprintf("version %d of variable '%v' in context '%v' is not stored", n, envVariable, circleCIContext))
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"variable":   envVariable,
+			"context":    circleCIContext,
+			"context_id": v.ContextID,
+			"value":      version.Value,
+			"version":    version.Version,
+			"written_at": version.WrittenAt,
+		},
+	}, nil
+}
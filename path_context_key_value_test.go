@@ -0,0 +1,120 @@
+package circleci
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestBackend_PathContextKeyValue(t *testing.T) {
+	t.Parallel()
+
+	t.Run("field_validation", func(t *testing.T) {
+		t.Parallel()
+		testFieldValidation(t, logical.ReadOperation, "context/my-context/FOO/value")
+	})
+
+	readValue := func(tb testing.TB, b *backend, storage logical.Storage, pth string) (*logical.Response, error) {
+		tb.Helper()
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      pth,
+		})
+	}
+	write := func(tb testing.TB, b *backend, storage logical.Storage, op logical.Operation, pth string, data map[string]interface{}) {
+		tb.Helper()
+		if _, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      pth,
+			Data:      data,
+		}); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+
+		write(t, b, storage, logical.UpdateOperation, "context/my-context/FOO", map[string]interface{}{"value": "bar"})
+		_, err := readValue(t, b, storage, "context/my-context/FOO/value")
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 404 {
+			t.Errorf("expected 404, got %v", err)
+		}
+	})
+
+	t.Run("stored", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		write(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"store-values": true})
+
+		write(t, b, storage, logical.UpdateOperation, "context/my-context/FOO", map[string]interface{}{"value": "bar"})
+		write(t, b, storage, logical.UpdateOperation, "context/my-context/FOO", map[string]interface{}{"value": "baz"})
+
+		resp, err := readValue(t, b, storage, "context/my-context/FOO/value")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, exp := resp.Data["value"], "baz"; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+		if v, exp := resp.Data["context_id"], server.Context("my-context").ID; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+
+		// The value is not part of the metadata
+		resp, err = readValue(t, b, storage, "context/my-context/FOO")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := resp.Data["value"]; ok {
+			t.Errorf("expected no value in %v", resp.Data)
+		}
+
+		write(t, b, storage, logical.DeleteOperation, "context/my-context/FOO", nil)
+		_, err = readValue(t, b, storage, "context/my-context/FOO/value")
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 404 {
+			t.Errorf("expected 404 after delete, got %v", err)
+		}
+	})
+
+	t.Run("context_deleted", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		write(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"store-values": true})
+		write(t, b, storage, logical.UpdateOperation, "context/my-context/FOO", map[string]interface{}{"value": "bar"})
+
+		write(t, b, storage, logical.DeleteOperation, "context/", map[string]interface{}{"context": "my-context"})
+		keys, err := storage.List(context.Background(), variablesPrefix+defaultOrg+"/my-context/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 0 {
+			t.Errorf("expected no stored variables, got %q", keys)
+		}
+	})
+
+	t.Run("seal_wrapped", func(t *testing.T) {
+		t.Parallel()
+
+		b, _ := testBackend(t)
+		found := false
+		for _, p := range b.PathsSpecial.SealWrapStorage {
+			if p == variablesPrefix {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected %q to be seal-wrapped", variablesPrefix)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package circleci
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// pathContextKeyVersions defines the circleci/context/:context/:env/versions
+// path on the backend.
+func (b *backend) pathContextKeyVersions() *framework.Path {
+	return &framework.Path{
+		Pattern: orgPrefix + "context/" + framework.GenericNameRegex("context") + "/" + framework.GenericNameRegex("env") + "/versions",
+
+		HelpSynopsis: "List the stored versions of an environment variable in a CircleCI context",
+		HelpDescription: "List the versions of an environment variable written through Vault, oldest first, with the time, " +
+			"the entity and the comment of each write. The values are not returned, read them at context/<context>/<env>/value. " +
+			"Versions are only kept for organizations configured with store-values.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"org": orgField(),
+			"context": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the CircleCI context.",
+				Required:    true,
+			},
+			"env": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the environment variable in the given CircleCI context.",
+				Required:    true,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathContextKeyVersionsRead)},
+		},
+	}
+}
+
+// pathContextKeyRollback defines the circleci/context/:context/:env/rollback
+// path on the backend.
+func (b *backend) pathContextKeyRollback() *framework.Path {
+	return &framework.Path{
+		Pattern: orgPrefix + "context/" + framework.GenericNameRegex("context") + "/" + framework.GenericNameRegex("env") + "/rollback",
+
+		HelpSynopsis: "Roll an environment variable in a CircleCI context back to a stored version",
+		HelpDescription: "Write the value of a stored version of an environment variable to CircleCI again. " +
+			"The rollback is recorded as a new version. Versions are only kept for organizations configured with store-values.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"org":     orgField(),
+			"refresh": refreshField(),
+			"context": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the CircleCI context.",
+				Required:    true,
+			},
+			"env": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the environment variable in the given CircleCI context.",
+				Required:    true,
+			},
+			"version": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "The version to roll back to.",
+				Required:    true,
+			},
+			"comment": commentField(),
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathContextKeyRollbackWrite)},
+		},
+	}
+}
+
+// pathContextKeyVersionsRead corresponds to READ
+// circleci/context/:context/:env/versions.
+func (b *backend) pathContextKeyVersionsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	circleCIContext := d.Get("context").(string)
+	envVariable := d.Get("env").(string)
+	config, err := b.OrgConfig(ctx, req.Storage, orgName(d))
+	if err != nil {
+		return nil, err
+	}
+	if !config.StoreValues {
+		return nil, logical.CodedError(400, "versions are only kept with store-values enabled for the organization")
+	}
+
+	v, err := b.StoredVariable(ctx, req.Storage, orgName(d), circleCIContext, envVariable)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil || len(v.Versions) == 0 {
+		return nil, logical.CodedError(404, fmt.Sprintf("no versions are stored for variable '%v' in context '%v'", envVariable, circleCIContext))
+	}
+
+	versions := make([]map[string]interface{}, len(v.Versions))
+	for i, version := range v.Versions {
+		versions[i] = map[string]interface{}{
+			"version":    version.Version,
+			"written_at": version.WrittenAt,
+			"written_by": version.WrittenBy,
+			"comment":    version.Comment,
+		}
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"variable":        envVariable,
+			"context":         circleCIContext,
+			"context_id":      v.ContextID,
+			"current_version": v.CurrentVersion(),
+			"versions":        versions,
+		},
+	}, nil
+}
+
+// pathContextKeyRollbackWrite corresponds to PUT/POST
+// circleci/context/:context/:env/rollback.
+func (b *backend) pathContextKeyRollbackWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if err := b.checkContextAccess(ctx, req, d.Get("context").(string)); err != nil {
+		return nil, err
+	}
+	return b.contextKeyRollback(ctx, req, d, orgName(d))
+}
+
+// contextKeyRollback writes the stored version named by the request to its
+// environment variable in the given organization.
+func (b *backend) contextKeyRollback(ctx context.Context, req *logical.Request, d *framework.FieldData, org string) (*logical.Response, error) {
+	if d.Get("refresh").(bool) {
+		b.invalidateContexts(ctx, req.Storage, org)
+	}
+	circleCIContext := d.Get("context").(string)
+	envVariable := d.Get("env").(string)
+	n := d.Get("version").(int)
+	config, err := b.OrgConfig(ctx, req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+	if !config.StoreValues {
+		return nil, logical.CodedError(400, "rollback requires store-values to be enabled for the organization, versions are only kept with it")
+	}
+
+	v, err := b.StoredVariable(ctx, req.Storage, org, circleCIContext, envVariable)
+	if err != nil {
+		return nil, err
+	}
+	var target *variableVersion
+	if v != nil {
+		target = v.Version(n)
+	}
+	if target == nil {
+		return nil, logical.CodedError(404, fmt.Sprintf("version %d of variable '%v' in context '%v' is not stored", n, envVariable, circleCIContext))
+	}
+
+	foundContext, err := b.findContext(ctx, req, org, config, circleCIContext)
+	if err != nil {
+		return nil, err
+	}
+
+	circleCIClient, err := b.CircleCIClient(req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+
+	contextVariable, err := circleCIClient.AddOrUpdateContextVariable(ctx, foundContext.ID, envVariable, target.Value)
+	if err != nil {
+		return nil, err
+	}
+	b.Logger().Debug("Variable in context rolled back", "context", foundContext.Name, "contextID", foundContext.ID, "envVariable", envVariable, "version", n)
+
+	comment := d.Get("comment").(string)
+	if comment == "" {
+		comment = fmt.Sprintf("rollback to version %d", n)
+	}
+	version, err := b.recordVariable(ctx, req, org, config, foundContext.Name, contextVariable, target.Value, comment)
+	if err != nil {
+		return nil, errwrap.Wrapf("the variable was rolled back in CircleCI, but the rollback could not be stored: {{err}}", err)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"variable":       envVariable,
+			"context":        circleCIContext,
+			"version":        version.Version,
+			"rolled_back_to": n,
+		},
+	}, nil
+}
@@ -0,0 +1,217 @@
+package circleci
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestStoredVariable_AddVersion(t *testing.T) {
+	t.Parallel()
+
+	var v storedVariable
+	for _, value := range []string{"a", "b", "c", "d"} {
+		v.addVersion(&variableVersion{Value: value}, 3)
+	}
+	if v.Value != "d" || v.CurrentVersion() != 4 {
+		t.Errorf("expected version 4 with value d, got %d with %q", v.CurrentVersion(), v.Value)
+	}
+	if len(v.Versions) != 3 || v.Versions[0].Version != 2 {
+		t.Errorf("expected versions 2 to 4 to be kept, got %d versions starting at %d", len(v.Versions), v.Versions[0].Version)
+	}
+	if v.Version(1) != nil {
+		t.Errorf("expected version 1 to be dropped")
+	}
+	if version := v.Version(3); version == nil || version.Value != "c" {
+		t.Errorf("expected version 3 to be c, got %v", version)
+	}
+
+	// Versions pinned by a lease are kept beyond the maximum
+	v.Version(2).Leases = 1
+	v.addVersion(&variableVersion{Value: "e"}, 3)
+	if len(v.Versions) != 3 || v.Versions[0].Version != 2 || v.Versions[1].Version != 4 {
+		t.Errorf("expected versions 2, 4 and 5 to be kept, got %v", v.Versions)
+	}
+}
+
+func TestBackend_PathContextKeyVersions(t *testing.T) {
+	t.Parallel()
+
+	t.Run("field_validation", func(t *testing.T) {
+		t.Parallel()
+		testFieldValidation(t, logical.ReadOperation, "context/my-context/FOO/versions")
+		testFieldValidation(t, logical.UpdateOperation, "context/my-context/FOO/rollback")
+	})
+
+	request := func(tb testing.TB, b *backend, storage logical.Storage, op logical.Operation, pth string, data map[string]interface{}) (*logical.Response, error) {
+		tb.Helper()
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      pth,
+			Data:      data,
+			EntityID:  "entity-1",
+		})
+	}
+
+	t.Run("rollback", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		if _, err := request(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"store-values": true, "max-versions": 2}); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, data := range []map[string]interface{}{
+			{"value": "v1"},
+			{"value": "v2", "comment": "rotated"},
+			{"value": "v3", "comment": "bad push"},
+		} {
+			resp, err := request(t, b, storage, logical.UpdateOperation, "context/my-context/FOO", data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Data["version"] == nil {
+				t.Errorf("expected the version to be returned")
+			}
+		}
+
+		resp, err := request(t, b, storage, logical.ReadOperation, "context/my-context/FOO/versions", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions := resp.Data["versions"].([]map[string]interface{})
+		if len(versions) != 2 || versions[0]["version"] != 2 || versions[1]["comment"] != "bad push" {
+			t.Errorf("expected versions 2 and 3, got %v", versions)
+		}
+		if v, exp := versions[0]["written_by"], "entity-1"; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+		if _, ok := versions[0]["value"]; ok {
+			t.Errorf("expected no values in %v", versions)
+		}
+		if v, exp := resp.Data["current_version"], 3; v != exp {
+			t.Errorf("expected %v to be %v", v, exp)
+		}
+
+		// Version 1 was dropped by max-versions
+		_, err = request(t, b, storage, logical.UpdateOperation, "context/my-context/FOO/rollback", map[string]interface{}{"version": 1})
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 404 {
+			t.Errorf("expected 404, got %v", err)
+		}
+
+		resp, err = request(t, b, storage, logical.UpdateOperation, "context/my-context/FOO/rollback", map[string]interface{}{"version": 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, exp := resp.Data["version"], 4; v != exp {
+			t.Errorf("expected %v to be %v", v, exp)
+		}
+		if v, exp := server.Value("my-context", "FOO"), "v2"; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+
+		resp, err = request(t, b, storage, logical.ReadOperation, "context/my-context/FOO/value", map[string]interface{}{"version": 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, exp := resp.Data["value"], "v3"; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+
+		resp, err = request(t, b, storage, logical.ReadOperation, "context/my-context/FOO/versions", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = resp.Data["versions"].([]map[string]interface{})
+		if v, exp := versions[len(versions)-1]["comment"], "rollback to version 2"; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+	})
+
+	t.Run("store_values_disabled", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		if _, err := request(t, b, storage, logical.UpdateOperation, "context/my-context/FOO", map[string]interface{}{"value": "v1"}); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := request(t, b, storage, logical.UpdateOperation, "context/my-context/FOO/rollback", map[string]interface{}{"version": 1})
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 400 {
+			t.Errorf("expected 400, got %v", err)
+		}
+		_, err = request(t, b, storage, logical.ReadOperation, "context/my-context/FOO/versions", nil)
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 400 || !strings.Contains(err.Error(), "store-values") {
+			t.Errorf("expected 400 naming store-values, got %v", err)
+		}
+	})
+	t.Run("store_values_toggled", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		for _, data := range []map[string]interface{}{
+			{"store-values": true},
+			{"store-values": false},
+			{"store-values": true},
+		} {
+			if _, err := request(t, b, storage, logical.UpdateOperation, "config", data); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := request(t, b, storage, logical.UpdateOperation, "context/my-context/FOO", map[string]interface{}{"value": fmt.Sprint(data["store-values"])}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The write with store-values disabled kept version 1
+		resp, err := request(t, b, storage, logical.ReadOperation, "context/my-context/FOO/versions", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions := resp.Data["versions"].([]map[string]interface{})
+		if len(versions) != 2 || versions[0]["version"] != 1 || versions[1]["version"] != 2 {
+			t.Errorf("expected versions 1 and 2, got %v", versions)
+		}
+	})
+
+	t.Run("concurrent_writes", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		if _, err := request(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"store-values": true}); err != nil {
+			t.Fatal(err)
+		}
+
+		const writes = 8
+		var wg sync.WaitGroup
+		for i := 0; i < writes; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if _, err := request(t, b, storage, logical.UpdateOperation, "context/my-context/FOO", map[string]interface{}{"value": fmt.Sprint(i)}); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		resp, err := request(t, b, storage, logical.ReadOperation, "context/my-context/FOO/versions", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, exp := len(resp.Data["versions"].([]map[string]interface{})), writes; v != exp {
+			t.Errorf("expected %d versions, got %d", exp, v)
+		}
+		if v, exp := resp.Data["current_version"], writes; v != exp {
+			t.Errorf("expected %v to be %v", v, exp)
+		}
+	})
+}
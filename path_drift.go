@@ -0,0 +1,253 @@
+package circleci
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	circleci "github.com/bobthebuilderberlin/go-circleci"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// contextDrift is the difference between the environment variables of a
+// context in CircleCI and the ones written through Vault.
+type contextDrift struct {
+	// Changed are the variables updated in CircleCI after they were last
+	// written through Vault.
+	Changed []string
+
+	// Unmanaged are the variables in CircleCI that were never written
+	// through Vault.
+	Unmanaged []string
+
+	// Missing are the variables written through Vault that are not in
+	// CircleCI anymore.
+	Missing []string
+}
+
+// Drifted reports whether there is any difference.
+func (c *contextDrift) Drifted() bool {
+	return len(c.Changed) > 0 || len(c.Unmanaged) > 0 || len(c.Missing) > 0
+}
+
+// Data returns the response data of the difference.
+func (c *contextDrift) Data() map[string]interface{} {
+	return map[string]interface{}{
+		"drifted":   c.Drifted(),
+		"changed":   nonNil(c.Changed),
+		"unmanaged": nonNil(c.Unmanaged),
+		"missing":   nonNil(c.Missing),
+	}
+}
+
+// pathContextDrift defines the circleci/context/:context/drift path on the
+// backend.
+func (b *backend) pathContextDrift() *framework.Path {
+	return &framework.Path{
+		Pattern: orgPrefix + "context/" + framework.GenericNameRegex("context") + "/drift",
+
+		HelpSynopsis: "Report the environment variables of a context that drifted from Vault",
+		HelpDescription: "Compare the environment variables of a CircleCI context with the ones written through Vault. " +
+			"Reports the variables changed outside of Vault, present in CircleCI but never written through Vault, " +
+			"and written through Vault but missing in CircleCI. As this path takes precedence, a variable named drift " +
+			"cannot be managed through context/<context>/<env>.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"org":     orgField(),
+			"refresh": refreshField(),
+			"context": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the CircleCI context.",
+				Required:    true,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathContextDriftRead)},
+		},
+	}
+}
+
+// pathDrift defines the circleci/drift path on the backend.
+func (b *backend) pathDrift() *framework.Path {
+	return &framework.Path{
+		Pattern: orgPrefix + "drift/?$",
+
+		HelpSynopsis: "Report the contexts of an organization that drifted from Vault",
+		HelpDescription: "Compare the environment variables of all contexts with variables written through Vault with " +
+			"CircleCI, and report the contexts that drifted, as context/<context>/drift does.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"org":     orgField(),
+			"refresh": refreshField(),
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathDriftRead)},
+		},
+	}
+}
+
+// pathContextDriftRead corresponds to READ circleci/context/:context/drift.
+func (b *backend) pathContextDriftRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	org := orgName(d)
+	if d.Get("refresh").(bool) {
+		b.invalidateContexts(ctx, req.Storage, org)
+	}
+	circleCIContext := d.Get("context").(string)
+	config, err := b.OrgConfig(ctx, req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+
+	foundContext, err := b.findContext(ctx, req, org, config, circleCIContext)
+	if err != nil {
+		return nil, err
+	}
+
+	drift, err := b.contextDrift(ctx, req, org, foundContext)
+	if err != nil {
+		return nil, err
+	}
+
+	data := drift.Data()
+	data["context"] = foundContext.Name
+	data["context_id"] = foundContext.ID
+	return &logical.Response{Data: data}, nil
+}
+
+// pathDriftRead corresponds to READ circleci/drift.
+func (b *backend) pathDriftRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	org := orgName(d)
+	if d.Get("refresh").(bool) {
+		b.invalidateContexts(ctx, req.Storage, org)
+	}
+	config, err := b.OrgConfig(ctx, req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+
+	contextNames, err := b.recordedContexts(ctx, req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+
+	collectedContexts, err := b.collectContexts(ctx, req, org, config)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*circleci.Context, len(collectedContexts))
+	for _, collectedContext := range collectedContexts {
+		byName[collectedContext.Name] = collectedContext
+	}
+
+	contexts := make(map[string]interface{})
+	var missingContexts []string
+	for _, name := range contextNames {
+		foundContext, ok := byName[name]
+		if !ok {
+			missingContexts = append(missingContexts, name)
+			continue
+		}
+
+		drift, err := b.contextDrift(ctx, req, org, foundContext)
+		if err != nil {
+			return nil, err
+		}
+		if drift.Drifted() {
+			contexts[name] = drift.Data()
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"drifted":          len(contexts) > 0 || len(missingContexts) > 0,
+			"contexts":         contexts,
+			"missing_contexts": nonNil(missingContexts),
+		},
+	}, nil
+}
+
+// contextDrift compares the environment variables of the given context with
+// the ones recorded for it.
+func (b *backend) contextDrift(ctx context.Context, req *logical.Request, org string, circleCIContext *circleci.Context) (*contextDrift, error) {
+	circleCIClient, err := b.CircleCIClient(req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+	contextVariables, err := circleCIClient.AllContextVariables(ctx, circleCIContext.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := req.Storage.List(ctx, variablesPrefix+org+"/"+circleCIContext.Name+"/")
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to list variables: {{err}}", err)
+	}
+	recorded := make(map[string]*storedVariable, len(names))
+	for _, name := range names {
+		v, err := b.StoredVariable(ctx, req.Storage, org, circleCIContext.Name, name)
+		if err != nil {
+			return nil, err
+		}
+		// Records of a context recreated outside of Vault do not apply
+		if v != nil && v.ContextID == circleCIContext.ID {
+			recorded[name] = v
+		}
+	}
+
+	drift := &contextDrift{}
+	for _, contextVariable := range contextVariables {
+		v, ok := recorded[contextVariable.Variable]
+		delete(recorded, contextVariable.Variable)
+		switch {
+		case !ok:
+			drift.Unmanaged = append(drift.Unmanaged, contextVariable.Variable)
+		case v.drifted(contextVariable):
+			drift.Changed = append(drift.Changed, contextVariable.Variable)
+		}
+	}
+	for name := range recorded {
+		drift.Missing = append(drift.Missing, name)
+	}
+
+	sort.Strings(drift.Changed)
+	sort.Strings(drift.Unmanaged)
+	sort.Strings(drift.Missing)
+	return drift, nil
+}
+
+// drifted reports whether the given variable was updated in CircleCI after it
+// was last written through Vault. Records without the time of the update,
+// written before it was recorded, never drift.
+func (v *storedVariable) drifted(contextVariable *apiContextVariable) bool {
+	return !v.UpdatedAt.IsZero() && contextVariable.UpdatedAt.After(v.UpdatedAt)
+}
+
+// recordedContexts returns the names of the contexts of the given
+// organization with environment variables written through Vault.
+func (b *backend) recordedContexts(ctx context.Context, s logical.Storage, org string) ([]string, error) {
+	keys, err := s.List(ctx, variablesPrefix+org+"/")
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to list variables: {{err}}", err)
+	}
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if strings.HasSuffix(key, "/") {
+			names = append(names, strings.TrimSuffix(key, "/"))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// nonNil returns an empty slice instead of nil, so that empty lists are
+// returned as [] rather than null.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
@@ -0,0 +1,84 @@
+package circleci
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestBackend_PathDrift(t *testing.T) {
+	t.Parallel()
+
+	t.Run("field_validation", func(t *testing.T) {
+		t.Parallel()
+		testFieldValidation(t, logical.ReadOperation, "context/my-context/drift")
+		testFieldValidation(t, logical.ReadOperation, "drift")
+	})
+
+	b, storage, server := testBackendWithCircleCI(t)
+	server.AddContext("my-context")
+	server.AddContext("other-context")
+	server.AddContext("gone-context")
+	ctx := context.Background()
+
+	request := func(op logical.Operation, pth string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      pth,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for _, pth := range []string{
+		"context/my-context/CHANGED",
+		"context/my-context/UNCHANGED",
+		"context/my-context/MISSING",
+		"context/other-context/FOO",
+		"context/gone-context/FOO",
+	} {
+		request(logical.UpdateOperation, pth, map[string]interface{}{"value": "bar"})
+	}
+
+	resp := request(logical.ReadOperation, "drift", nil)
+	if resp.Data["drifted"] != false {
+		t.Errorf("expected no drift yet, got %v", resp.Data)
+	}
+
+	server.SetVariable("my-context", "CHANGED", "changed")
+	server.SetVariable("my-context", "UNMANAGED", "bar")
+	server.RemoveVariable("my-context", "MISSING")
+	request(logical.DeleteOperation, "context/", map[string]interface{}{"context": "other-context"})
+	server.AddContext("other-context")
+	request(logical.UpdateOperation, "context/", map[string]interface{}{"context": "new-context"})
+	server.RemoveContext("gone-context")
+
+	resp = request(logical.ReadOperation, "context/my-context/drift", map[string]interface{}{"refresh": true})
+	exp := map[string]interface{}{
+		"context":    "my-context",
+		"context_id": server.Context("my-context").ID,
+		"drifted":    true,
+		"changed":    []string{"CHANGED"},
+		"unmanaged":  []string{"UNMANAGED"},
+		"missing":    []string{"MISSING"},
+	}
+	if !reflect.DeepEqual(resp.Data, exp) {
+		t.Errorf("expected %v to be %v", resp.Data, exp)
+	}
+
+	resp = request(logical.ReadOperation, "drift", nil)
+	contexts := resp.Data["contexts"].(map[string]interface{})
+	if _, ok := contexts["my-context"]; !ok || len(contexts) != 1 {
+		t.Errorf("expected only my-context to drift, got %v", contexts)
+	}
+	if v, exp := resp.Data["missing_contexts"], []string{"gone-context"}; !reflect.DeepEqual(v, exp) {
+		t.Errorf("expected %q to be %q", v, exp)
+	}
+}
@@ -0,0 +1,408 @@
+package circleci
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// enforcePrefix is the storage prefix of the enforcement settings of the
+// contexts.
+const enforcePrefix = "enforce/"
+
+// defaultEnforceInterval is the default time between two checks of an
+// enforced context.
+const defaultEnforceInterval = 5 * time.Minute
+
+// maxRemediationLog is the number of remediations kept per context.
+const maxRemediationLog = 50
+
+// enforcement enables the remediation of drift in a context. The values
+// written through Vault are written to CircleCI again whenever the variables
+// are changed or deleted outside of Vault.
+type enforcement struct {
+	// Interval is the minimum time between two checks of the context.
+	Interval time.Duration `json:"interval"`
+
+	// DryRun only logs the remediations, without writing to CircleCI.
+	DryRun bool `json:"dry_run"`
+
+	// LastRun is the time of the last check of the context.
+	LastRun time.Time `json:"last_run"`
+
+	// Log are the latest remediations, oldest first.
+	Log []*remediation `json:"log,omitempty"`
+}
+
+// remediation is an entry of the remediation log of a context.
+type remediation struct {
+	Time     time.Time `json:"time"`
+	Variable string    `json:"variable,omitempty"`
+	Reason   string    `json:"reason"`
+	DryRun   bool      `json:"dry_run"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// The reasons of remediations.
+const (
+	remediationChanged        = "changed"
+	remediationMissing        = "missing"
+	remediationContextMissing = "context_missing"
+)
+
+// reported reports whether the given dry-run finding is the latest entry of
+// its variable in the log, so that a finding that did not change is logged
+// once.
+func (e *enforcement) reported(r *remediation) bool {
+	if !r.DryRun {
+		return false
+	}
+	for i := len(e.Log) - 1; i >= 0; i-- {
+		if e.Log[i].Variable == r.Variable {
+			return e.Log[i].DryRun && e.Log[i].Reason == r.Reason
+		}
+	}
+	return false
+}
+
+// enforceKey returns the storage key of the enforcement settings of the given
+// context.
+func enforceKey(org, contextName string) string {
+	return enforcePrefix + org + "/" + contextName
+}
+
+// pathEnforceList defines the circleci/enforce base path on the backend.
+func (b *backend) pathEnforceList() *framework.Path {
+	return &framework.Path{
+		Pattern: orgPrefix + "enforce/?$",
+
+		HelpSynopsis:    "List the contexts with enforced variables",
+		HelpDescription: "List the names of the contexts whose variables are enforced.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"org": orgField(),
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathEnforceListRead)},
+		},
+	}
+}
+
+// pathEnforce defines the circleci/enforce/:context path on the backend.
+func (b *backend) pathEnforce() *framework.Path {
+	return &framework.Path{
+		Pattern: orgPrefix + "enforce/" + framework.GenericNameRegex("context"),
+
+		HelpSynopsis: "Enforce the variables written through Vault in a CircleCI context",
+		HelpDescription: "Periodically check the variables of a context written through Vault, and write their stored " +
+			"values to CircleCI again whenever they were changed or deleted outside of Vault. Requires store-values. " +
+			"Reading returns the settings and the latest remediations.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"org": orgField(),
+			"context": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the CircleCI context.",
+				Required:    true,
+			},
+			"interval": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "The minimum time between two checks of the context. Checks run at most about once a minute. Defaults to 5m.",
+			},
+			"dry_run": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "Only log the remediations, without writing to CircleCI.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.CreateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathEnforceWrite)},
+			logical.UpdateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathEnforceWrite)},
+			logical.ReadOperation:   &framework.PathOperation{Callback: withFieldValidator(b.pathEnforceRead)},
+			logical.DeleteOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathEnforceDelete)},
+		},
+	}
+}
+
+// pathEnforceListRead corresponds to LIST circleci/enforce.
+func (b *backend) pathEnforceListRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	contexts, err := req.Storage.List(ctx, enforcePrefix+orgName(d)+"/")
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to list enforced contexts: {{err}}", err)
+	}
+	return logical.ListResponse(contexts), nil
+}
+
+// pathEnforceRead corresponds to READ circleci/enforce/:context.
+func (b *backend) pathEnforceRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	e, err := b.Enforcement(ctx, req.Storage, orgName(d), d.Get("context").(string))
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"interval": int64(e.Interval.Seconds()),
+			"dry_run":  e.DryRun,
+			"last_run": e.LastRun,
+			"log":      e.Log,
+		},
+	}, nil
+}
+
+// pathEnforceWrite corresponds to both CREATE and UPDATE
+// circleci/enforce/:context.
+func (b *backend) pathEnforceWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	org := orgName(d)
+	contextName := d.Get("context").(string)
+	if err := b.checkContextAccess(ctx, req, contextName); err != nil {
+		return nil, err
+	}
+
+	config, err := b.OrgConfig(ctx, req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+	if !config.StoreValues {
+		return nil, logical.CodedError(400, "enforcing requires store-values to be enabled")
+	}
+	if _, err := b.findContext(ctx, req, org, config, contextName); err != nil {
+		return nil, err
+	}
+
+	e, err := b.Enforcement(ctx, req.Storage, org, contextName)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		e = &enforcement{Interval: defaultEnforceInterval}
+	}
+	if v, ok := d.GetOk("interval"); ok {
+		e.Interval = time.Duration(v.(int)) * time.Second
+		if e.Interval < 0 {
+			return nil, logical.CodedError(400, "interval must not be negative")
+		}
+		if e.Interval == 0 {
+			e.Interval = defaultEnforceInterval
+		}
+	}
+	if v, ok := d.GetOk("dry_run"); ok {
+		e.DryRun = v.(bool)
+	}
+
+	if err := b.putEnforcement(ctx, req.Storage, org, contextName, e); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// pathEnforceDelete corresponds to DELETE circleci/enforce/:context.
+func (b *backend) pathEnforceDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	contextName := d.Get("context").(string)
+	if err := b.checkContextAccess(ctx, req, contextName); err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Delete(ctx, enforceKey(orgName(d), contextName)); err != nil {
+		return nil, errwrap.Wrapf("failed to delete enforcement from storage: {{err}}", err)
+	}
+	return nil, nil
+}
+
+// Enforcement returns the enforcement settings of the given context, or nil if
+// the context is not enforced.
+func (b *backend) Enforcement(ctx context.Context, s logical.Storage, org, contextName string) (*enforcement, error) {
+	entry, err := s.Get(ctx, enforceKey(org, contextName))
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to get enforcement from storage: {{err}}", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var e enforcement
+	if err := entry.DecodeJSON(&e); err != nil {
+		return nil, errwrap.Wrapf("failed to decode enforcement: {{err}}", err)
+	}
+	return &e, nil
+}
+
+// putEnforcement stores the enforcement settings of the given context.
+func (b *backend) putEnforcement(ctx context.Context, s logical.Storage, org, contextName string, e *enforcement) error {
+	entry, err := logical.StorageEntryJSON(enforceKey(org, contextName), e)
+	if err != nil {
+		return errwrap.Wrapf("failed to generate JSON enforcement: {{err}}", err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return errwrap.Wrapf("failed to persist enforcement to storage: {{err}}", err)
+	}
+	return nil
+}
+
+// enforceContexts checks all enforced contexts that are due, and remediates
+// their drift.
+func (b *backend) enforceContexts(ctx context.Context, s logical.Storage) error {
+	orgs, err := s.List(ctx, enforcePrefix)
+	if err != nil {
+		return errwrap.Wrapf("failed to list enforced contexts: {{err}}", err)
+	}
+
+	var errs []error
+	for _, orgKey := range orgs {
+		org := orgKey[:len(orgKey)-1]
+		contextNames, err := s.List(ctx, enforcePrefix+orgKey)
+		if err != nil {
+			return errwrap.Wrapf("failed to list enforced contexts: {{err}}", err)
+		}
+
+		for _, contextName := range contextNames {
+			e, err := b.Enforcement(ctx, s, org, contextName)
+			if err != nil {
+				return err
+			}
+			if e == nil || time.Since(e.LastRun) < e.Interval {
+				continue
+			}
+
+			if err := b.enforceContext(ctx, s, org, contextName, e); err != nil {
+				errs = append(errs, fmt.Errorf("context '%v' of organization '%v': %v", contextName, org, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to enforce contexts: %s", joinErrors(errs))
+	}
+	return nil
+}
+
+// enforceContext writes the stored values of the variables of the given
+// context that were changed or deleted outside of Vault to CircleCI again,
+// and records the remediations.
+func (b *backend) enforceContext(ctx context.Context, s logical.Storage, org, contextName string, e *enforcement) error {
+	remediations, err := b.remediateContext(ctx, s, org, contextName, e)
+	if err != nil {
+		return err
+	}
+
+	e.LastRun = time.Now().UTC()
+	e.Log = append(e.Log, remediations...)
+	if len(e.Log) > maxRemediationLog {
+		e.Log = e.Log[len(e.Log)-maxRemediationLog:]
+	}
+	return b.putEnforcement(ctx, s, org, contextName, e)
+}
+
+// remediateContext compares the variables of the given context with their
+// records and writes the stored values that drifted to CircleCI again, unless
+// the enforcement is a dry run. Dry-run findings already at the end of the log
+// are not reported again.
+func (b *backend) remediateContext(ctx context.Context, s logical.Storage, org, contextName string, e *enforcement) ([]*remediation, error) {
+	dryRun := e.DryRun
+	config, err := b.OrgConfig(ctx, s, org)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &logical.Request{Storage: s}
+	foundContext, err := b.findContext(ctx, req, org, config, contextName)
+	if coded, ok := err.(logical.HTTPCodedError); ok && coded.Code() == 404 {
+		r := &remediation{Time: time.Now().UTC(), Reason: remediationContextMissing, DryRun: dryRun, Error: err.Error()}
+		if e.reported(r) {
+			return nil, nil
+		}
+		b.Logger().Warn("Enforced context was not found", "org", org, "context", contextName)
+		return []*remediation{r}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	circleCIClient, err := b.CircleCIClient(s, org)
+	if err != nil {
+		return nil, err
+	}
+	contextVariables, err := circleCIClient.AllContextVariables(ctx, foundContext.ID)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]*apiContextVariable, len(contextVariables))
+	for _, contextVariable := range contextVariables {
+		current[contextVariable.Variable] = contextVariable
+	}
+
+	names, err := s.List(ctx, variablesPrefix+org+"/"+contextName+"/")
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to list variables: {{err}}", err)
+	}
+
+	var remediations []*remediation
+	for _, name := range names {
+		v, err := b.StoredVariable(ctx, s, org, contextName, name)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil || v.Value == "" {
+			continue
+		}
+
+		r := &remediation{Time: time.Now().UTC(), Variable: name, DryRun: dryRun}
+		contextVariable, ok := current[name]
+		switch {
+		case !ok:
+			r.Reason = remediationMissing
+		case v.ContextID != foundContext.ID || v.drifted(contextVariable):
+			r.Reason = remediationChanged
+		default:
+			continue
+		}
+		if e.reported(r) {
+			continue
+		}
+		remediations = append(remediations, r)
+
+		if dryRun {
+			b.Logger().Info("Variable drifted, not remediating in dry-run mode", "org", org, "context", contextName, "envVariable", name, "reason", r.Reason)
+			continue
+		}
+
+		written, err := circleCIClient.AddOrUpdateContextVariable(ctx, foundContext.ID, name, v.Value)
+		if err != nil {
+			b.Logger().Error("Failed to remediate drifted variable", "org", org, "context", contextName, "envVariable", name, "reason", r.Reason, "error", err)
+			r.Error = err.Error()
+			continue
+		}
+		b.Logger().Info("Remediated drifted variable", "org", org, "context", contextName, "envVariable", name, "reason", r.Reason)
+
+		if err := b.recordRemediation(ctx, s, org, contextName, v.WrittenAt, written); err != nil {
+			return nil, err
+		}
+	}
+	return remediations, nil
+}
+
+// recordRemediation records the update CircleCI reported for a remediation of
+// the record of a variable written at writtenAt. Records written again in the
+// meantime are left alone; the next check remediates them if needed.
+func (b *backend) recordRemediation(ctx context.Context, s logical.Storage, org, contextName string, writtenAt time.Time, written *apiContextVariable) error {
+	lock := b.variableLock(org, contextName, written.Variable)
+	lock.Lock()
+	defer lock.Unlock()
+
+	v, err := b.StoredVariable(ctx, s, org, contextName, written.Variable)
+	if err != nil {
+		return err
+	}
+	if v == nil || !v.WrittenAt.Equal(writtenAt) {
+		return nil
+	}
+	v.ContextID = written.ContextID
+	v.UpdatedAt = written.UpdatedAt
+	return b.putStoredVariable(ctx, s, org, contextName, written.Variable, v)
+}
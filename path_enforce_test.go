@@ -0,0 +1,162 @@
+package circleci
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestBackend_PathEnforce(t *testing.T) {
+	t.Parallel()
+
+	t.Run("field_validation", func(t *testing.T) {
+		t.Parallel()
+		testFieldValidation(t, logical.UpdateOperation, "enforce/my-context")
+	})
+
+	request := func(tb testing.TB, b *backend, storage logical.Storage, op logical.Operation, pth string, data map[string]interface{}) (*logical.Response, error) {
+		tb.Helper()
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      pth,
+			Data:      data,
+		})
+	}
+	setup := func(tb testing.TB, dryRun bool) (*backend, logical.Storage, *fakeCircleCI) {
+		tb.Helper()
+
+		b, storage, server := testBackendWithCircleCI(tb)
+		server.AddContext("my-context")
+		for _, r := range []struct {
+			pth  string
+			data map[string]interface{}
+		}{
+			{"config", map[string]interface{}{"store-values": true}},
+			{"context/my-context/CHANGED", map[string]interface{}{"value": "desired"}},
+			{"context/my-context/DELETED", map[string]interface{}{"value": "desired"}},
+			{"context/my-context/UNCHANGED", map[string]interface{}{"value": "desired"}},
+			{"enforce/my-context", map[string]interface{}{"interval": "1h", "dry_run": dryRun}},
+		} {
+			if _, err := request(tb, b, storage, logical.UpdateOperation, r.pth, r.data); err != nil {
+				tb.Fatal(err)
+			}
+		}
+
+		server.SetVariable("my-context", "CHANGED", "edited")
+		server.RemoveVariable("my-context", "DELETED")
+		return b, storage, server
+	}
+	rollback := func(tb testing.TB, b *backend, storage logical.Storage) {
+		tb.Helper()
+		if _, err := request(tb, b, storage, logical.RollbackOperation, "", nil); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	log := func(tb testing.TB, b *backend, storage logical.Storage) []*remediation {
+		tb.Helper()
+		resp, err := request(tb, b, storage, logical.ReadOperation, "enforce/my-context", nil)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return resp.Data["log"].([]*remediation)
+	}
+
+	t.Run("remediate", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := setup(t, false)
+		rollback(t, b, storage)
+
+		for _, name := range []string{"CHANGED", "DELETED", "UNCHANGED"} {
+			if v, exp := server.Value("my-context", name), "desired"; v != exp {
+				t.Errorf("%s: expected %q to be %q", name, v, exp)
+			}
+		}
+		entries := log(t, b, storage)
+		if len(entries) != 2 || entries[0].Reason != remediationChanged || entries[1].Reason != remediationMissing {
+			t.Errorf("expected a changed and a missing remediation, got %v", entries)
+		}
+
+		// Not due again before the interval passed
+		server.SetVariable("my-context", "CHANGED", "edited")
+		rollback(t, b, storage)
+		if v, exp := server.Value("my-context", "CHANGED"), "edited"; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+
+		e, err := b.Enforcement(context.Background(), storage, defaultOrg, "my-context")
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.LastRun = e.LastRun.Add(-time.Hour)
+		if err := b.putEnforcement(context.Background(), storage, defaultOrg, "my-context", e); err != nil {
+			t.Fatal(err)
+		}
+		rollback(t, b, storage)
+		if v, exp := server.Value("my-context", "CHANGED"), "desired"; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+		if entries := log(t, b, storage); len(entries) != 3 {
+			t.Errorf("expected 3 remediations, got %d", len(entries))
+		}
+	})
+
+	t.Run("dry_run", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := setup(t, true)
+		rollback(t, b, storage)
+
+		if v, exp := server.Value("my-context", "CHANGED"), "edited"; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+		if server.Variable("my-context", "DELETED") != nil {
+			t.Errorf("expected variable not to be restored")
+		}
+		entries := log(t, b, storage)
+		if len(entries) != 2 || !entries[0].DryRun {
+			t.Errorf("expected 2 dry-run remediations, got %v", entries)
+		}
+
+		// The same findings are not logged again
+		e, err := b.Enforcement(context.Background(), storage, defaultOrg, "my-context")
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.LastRun = e.LastRun.Add(-time.Hour)
+		if err := b.putEnforcement(context.Background(), storage, defaultOrg, "my-context", e); err != nil {
+			t.Fatal(err)
+		}
+		rollback(t, b, storage)
+		if entries := log(t, b, storage); len(entries) != 2 {
+			t.Errorf("expected 2 dry-run remediations, got %v", entries)
+		}
+	})
+
+	t.Run("standby", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := setup(t, false)
+		b.System().(*logical.StaticSystemView).ReplicationStateVal = consts.ReplicationPerformanceStandby
+		rollback(t, b, storage)
+
+		if v, exp := server.Value("my-context", "CHANGED"), "edited"; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+	})
+
+	t.Run("requires_store_values", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		_, err := request(t, b, storage, logical.UpdateOperation, "enforce/my-context", nil)
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 400 {
+			t.Errorf("expected 400, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package circleci
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// pathOrgsList defines the circleci/orgs base path on the backend.
+func (b *backend) pathOrgsList() *framework.Path {
+	return &framework.Path{
+		Pattern: "orgs/?$",
+
+		HelpSynopsis:    "List the configured CircleCI organizations",
+		HelpDescription: "List the names of the CircleCI organizations configured at orgs/<name>. The default organization configured at config is not included.",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathOrgsListRead)},
+		},
+	}
+}
+
+// pathOrgs defines the circleci/orgs/:name path on the backend.
+func (b *backend) pathOrgs() *framework.Path {
+	fields := configFields()
+	fields["name"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "The name of the organization, used in org/<name>/ paths.",
+		Required:    true,
+	}
+
+	return &framework.Path{
+		Pattern: "orgs/" + framework.GenericNameRegex("name"),
+
+		HelpSynopsis: "Configure an additional CircleCI organization",
+		HelpDescription: "Configure an additional CircleCI organization with its own api-token, org-id and connection " +
+			"settings. Its contexts are managed through the org/<name>/context paths.",
+
+		Fields: fields,
+
+		ExistenceCheck: b.pathOrgsExists,
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.CreateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathOrgsWrite)},
+			logical.UpdateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathOrgsWrite)},
+			logical.ReadOperation:   &framework.PathOperation{Callback: withFieldValidator(b.pathOrgsRead)},
+			logical.DeleteOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathOrgsDelete)},
+		},
+	}
+}
+
+// pathOrgsExists checks if the organization is configured.
+func (b *backend) pathOrgsExists(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	entry, err := req.Storage.Get(ctx, orgConfigKey(d.Get("name").(string)))
+	if err != nil {
+		return false, errwrap.Wrapf("failed to get configuration from storage: {{err}}", err)
+	}
+	return entry != nil, nil
+}
+
+// pathOrgsListRead corresponds to LIST circleci/orgs.
+func (b *backend) pathOrgsListRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	orgs, err := req.Storage.List(ctx, "orgs/")
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to list organizations: {{err}}", err)
+	}
+	return logical.ListResponse(orgs), nil
+}
+
+// pathOrgsRead corresponds to READ circleci/orgs/:name.
+func (b *backend) pathOrgsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	org, err := configurableOrgName(d)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := b.pathOrgsExists(ctx, req, d)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+	return b.orgConfigRead(ctx, req, org)
+}
+
+// pathOrgsWrite corresponds to both CREATE and UPDATE circleci/orgs/:name.
+func (b *backend) pathOrgsWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	org, err := configurableOrgName(d)
+	if err != nil {
+		return nil, err
+	}
+	return b.orgConfigWrite(ctx, req, d, org)
+}
+
+// pathOrgsDelete corresponds to DELETE circleci/orgs/:name.
+func (b *backend) pathOrgsDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	org, err := configurableOrgName(d)
+	if err != nil {
+		return nil, err
+	}
+	return b.orgConfigDelete(ctx, req, org)
+}
+
+// configurableOrgName returns the organization name of an orgs/:name request.
+// The default organization can only be configured at config.
+func configurableOrgName(d *framework.FieldData) (string, error) {
+	org := d.Get("name").(string)
+	if org == defaultOrg {
+		return "", logical.CodedError(400, fmt.Sprintf("the '%v' organization is configured at config", defaultOrg))
+	}
+	return org, nil
+}
@@ -0,0 +1,178 @@
+package circleci
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestBackend_PathOrgs(t *testing.T) {
+	t.Parallel()
+
+	t.Run("field_validation", func(t *testing.T) {
+		t.Parallel()
+		testFieldValidation(t, logical.UpdateOperation, "orgs/my-org")
+	})
+
+	t.Run("default_reserved", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage := testBackend(t)
+		if _, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "orgs/default",
+			Data: map[string]interface{}{
+				"api-token": testAPIToken,
+				"org-id":    testOrgID,
+				"verify":    false,
+			},
+		}); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("crud", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage := testBackend(t)
+		server := newFakeCircleCI(t)
+		ctx := context.Background()
+
+		if _, err := b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.CreateOperation,
+			Path:      "orgs/team-a",
+			Data: map[string]interface{}{
+				"api-token": testAPIToken,
+				"org-id":    testOrgID,
+				"base-url":  server.URL,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.ListOperation,
+			Path:      "orgs/",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, exp := resp.Data["keys"], []string{"team-a"}; !reflect.DeepEqual(v, exp) {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "orgs/team-a",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, exp := resp.Data["OrgName"], "my-org"; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+		if _, ok := resp.Data["APIToken"]; ok {
+			t.Errorf("expected %q to not include the api-token", resp.Data)
+		}
+
+		// The default organization is left untouched.
+		config, err := b.Config(ctx, storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if def := DefaultConfig(); !reflect.DeepEqual(config, def) {
+			t.Errorf("expected %v to be %v", config, def)
+		}
+
+		if _, err := b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.DeleteOperation,
+			Path:      "orgs/team-a",
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "orgs/team-a",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp != nil {
+			t.Errorf("expected %v to be nil", resp)
+		}
+	})
+}
+
+func TestBackend_OrgScopedContexts(t *testing.T) {
+	t.Parallel()
+
+	b, storage, defaultServer := testBackendWithCircleCI(t)
+	defaultServer.AddContext("default-context")
+
+	server := newFakeCircleCI(t)
+	server.AddContext("team-a-context")
+
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.APIToken = testAPIToken
+	config.OrgId = testOrgID
+	config.BaseURL = server.URL
+
+	entry, err := logical.StorageEntryJSON("orgs/team-a", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	for pth, exp := range map[string][]string{
+		"context/":             {"default-context"},
+		"org/default/context/": {"default-context"},
+		"org/team-a/context/":  {"team-a-context"},
+	} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.ListOperation,
+			Path:      pth,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := resp.Data["keys"]; !reflect.DeepEqual(v, exp) {
+			t.Errorf("%s: expected %q to be %q", pth, v, exp)
+		}
+	}
+
+	if _, err := b.HandleRequest(ctx, &logical.Request{
+		Storage:   storage,
+		Operation: logical.UpdateOperation,
+		Path:      "org/team-a/context/team-a-context/FOO",
+		Data: map[string]interface{}{
+			"value": "bar",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if v, exp := server.Value("team-a-context", "FOO"), "bar"; v != exp {
+		t.Errorf("expected %q to be %q", v, exp)
+	}
+
+	_, err = b.HandleRequest(ctx, &logical.Request{
+		Storage:   storage,
+		Operation: logical.ListOperation,
+		Path:      "org/unknown/context/",
+	})
+	if err == nil {
+		t.Fatal("expected error for unconfigured organization")
+	}
+}
@@ -0,0 +1,204 @@
+package circleci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	circleci "github.com/bobthebuilderberlin/go-circleci"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// projectPattern matches the slug of a project, e.g. gh/my-org/my-repo. The
+// organization in the slug is captured as org_name, as org is captured by
+// orgPrefix.
+var projectPattern = "project/" + framework.GenericNameRegex("vcs") + "/" + framework.GenericNameRegex("org_name") + "/" + framework.GenericNameRegex("repo")
+
+// projectFields returns the fields captured by orgPrefix and projectPattern.
+func projectFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"org": orgField(),
+		"vcs": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "The VCS of the project as in its slug, e.g. gh or bb.",
+			Required:    true,
+		},
+		"org_name": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "The name of the organization of the project in the VCS.",
+			Required:    true,
+		},
+		"repo": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "The name of the repository of the project.",
+			Required:    true,
+		},
+	}
+}
+
+// projectSlug returns the slug of the project named by the request.
+func projectSlug(d *framework.FieldData) string {
+	return d.Get("vcs").(string) + "/" + d.Get("org_name").(string) + "/" + d.Get("repo").(string)
+}
+
+// pathProjectEnvList defines the circleci/project/:vcs/:org_name/:repo base
+// path on the backend.
+func (b *backend) pathProjectEnvList() *framework.Path {
+	return &framework.Path{
+		Pattern: orgPrefix + projectPattern + "/?$",
+
+		HelpSynopsis: "List the environment variables of a CircleCI project",
+		HelpDescription: "List the names of the environment variables of a project, with their masked values and creation times. " +
+			"The access rules of config/access only apply to contexts, not to projects.",
+
+		Fields: projectFields(),
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathProjectEnvListRead)},
+		},
+	}
+}
+
+// pathProjectKey defines the circleci/project/:vcs/:org_name/:repo/:env path
+// on the backend.
+func (b *backend) pathProjectKey() *framework.Path {
+	fields := projectFields()
+	fields["env"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "The name of the environment variable in the given CircleCI project.",
+		Required:    true,
+	}
+	fields["value"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "The value of the environment variable. Required when writing.",
+	}
+
+	return &framework.Path{
+		Pattern: orgPrefix + projectPattern + "/" + framework.GenericNameRegex("env"),
+
+		HelpSynopsis: "Read, write and delete environment variables in CircleCI projects",
+		HelpDescription: "Create or replace, read the metadata of, and delete environment variables of a project. " +
+			"CircleCI only ever returns the values masked. The access rules of config/access only apply to contexts, " +
+			"not to projects; restrict the project/ paths with Vault policies instead.",
+
+		Fields: fields,
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.CreateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathProjectKeyWrite)},
+			logical.UpdateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathProjectKeyWrite)},
+			logical.ReadOperation:   &framework.PathOperation{Callback: withFieldValidator(b.pathProjectKeyRead)},
+			logical.DeleteOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathProjectKeyDelete)},
+		},
+	}
+}
+
+// pathProjectEnvListRead corresponds to LIST
+// circleci/project/:vcs/:org_name/:repo.
+func (b *backend) pathProjectEnvListRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	circleCIClient, err := b.CircleCIClient(req.Storage, orgName(d))
+	if err != nil {
+		return nil, err
+	}
+
+	projectVariables, err := circleCIClient.AllProjectVariables(ctx, projectSlug(d))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(projectVariables, func(i, j int) bool {
+		return projectVariables[i].Name < projectVariables[j].Name
+	})
+
+	names := make([]string, len(projectVariables))
+	variableInfo := make(map[string]interface{}, len(projectVariables))
+	for i, projectVariable := range projectVariables {
+		names[i] = projectVariable.Name
+		variableInfo[projectVariable.Name] = map[string]interface{}{
+			"masked_value": projectVariable.Value,
+			"created_at":   projectVariable.CreatedAt,
+		}
+	}
+	return logical.ListResponseWithInfo(names, variableInfo), nil
+}
+
+// pathProjectKeyWrite corresponds to both CREATE and UPDATE
+// circleci/project/:vcs/:org_name/:repo/:env. CircleCI replaces existing
+// variables.
+func (b *backend) pathProjectKeyWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	slug := projectSlug(d)
+	envVariable := d.Get("env").(string)
+	value := d.Get("value").(string)
+	if value == "" {
+		return nil, logical.CodedError(400, "value is required")
+	}
+
+	circleCIClient, err := b.CircleCIClient(req.Storage, orgName(d))
+	if err != nil {
+		return nil, err
+	}
+
+	projectVariable, err := circleCIClient.CreateProjectVariable(ctx, slug, envVariable, value)
+	if err != nil {
+		return nil, err
+	}
+	b.Logger().Debug("Variable in project successfully created or updated", "project", slug, "envVariable", projectVariable.Name)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"projectEnvironmentVariable": projectVariable.Name,
+		},
+	}, nil
+}
+
+// pathProjectKeyRead corresponds to READ
+// circleci/project/:vcs/:org_name/:repo/:env and is used to read the metadata
+// of a single environment variable.
+func (b *backend) pathProjectKeyRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	slug := projectSlug(d)
+	envVariable := d.Get("env").(string)
+
+	circleCIClient, err := b.CircleCIClient(req.Storage, orgName(d))
+	if err != nil {
+		return nil, err
+	}
+
+	projectVariable, err := circleCIClient.ProjectVariable(ctx, slug, envVariable)
+	if errors.Is(err, circleci.ErrNotFound) {
+		return nil, logical.CodedError(404, fmt.Sprintf("variable '%v' was not found in project '%v'", envVariable, slug))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"variable":     projectVariable.Name,
+			"project":      slug,
+			"masked_value": projectVariable.Value,
+			"created_at":   projectVariable.CreatedAt,
+		},
+	}, nil
+}
+
+// pathProjectKeyDelete corresponds to DELETE
+// circleci/project/:vcs/:org_name/:repo/:env and removes the environment
+// variable from the project.
+func (b *backend) pathProjectKeyDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	slug := projectSlug(d)
+	envVariable := d.Get("env").(string)
+
+	circleCIClient, err := b.CircleCIClient(req.Storage, orgName(d))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := circleCIClient.Projects.DeleteVariable(ctx, slug, envVariable); err != nil {
+		if errors.Is(err, circleci.ErrNotFound) {
+			return nil, logical.CodedError(404, fmt.Sprintf("variable '%v' was not found in project '%v'", envVariable, slug))
+		}
+		return nil, err
+	}
+	b.Logger().Debug("Variable in project successfully deleted", "project", slug, "envVariable", envVariable)
+	return nil, nil
+}
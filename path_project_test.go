@@ -0,0 +1,119 @@
+package circleci
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestBackend_PathProject(t *testing.T) {
+	t.Parallel()
+
+	t.Run("field_validation", func(t *testing.T) {
+		t.Parallel()
+		testFieldValidation(t, logical.ListOperation, "project/gh/my-org/my-repo/")
+		testFieldValidation(t, logical.UpdateOperation, "project/gh/my-org/my-repo/FOO")
+		testFieldValidation(t, logical.ReadOperation, "project/gh/my-org/my-repo/FOO")
+		testFieldValidation(t, logical.DeleteOperation, "project/gh/my-org/my-repo/FOO")
+	})
+
+	request := func(b *backend, storage logical.Storage, op logical.Operation, pth string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      pth,
+			Data:      data,
+		})
+	}
+
+	t.Run("lifecycle", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddProject("gh/my-org/my-repo")
+
+		for _, name := range []string{"FOO", "BAR"} {
+			if _, err := request(b, storage, logical.UpdateOperation, "project/gh/my-org/my-repo/"+name, map[string]interface{}{"value": "secret-" + name}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if v, _ := server.ProjectValue("gh/my-org/my-repo", "FOO"); v != "secret-FOO" {
+			t.Errorf("expected %q to be %q", v, "secret-FOO")
+		}
+
+		resp, err := request(b, storage, logical.ListOperation, "project/gh/my-org/my-repo/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys, exp := resp.Data["keys"], []string{"BAR", "FOO"}; !reflect.DeepEqual(keys, exp) {
+			t.Errorf("expected %q to be %q", keys, exp)
+		}
+
+		resp, err = request(b, storage, logical.ReadOperation, "project/gh/my-org/my-repo/FOO", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, exp := resp.Data["masked_value"], "xxxx-FOO"; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+		if v, exp := resp.Data["project"], "gh/my-org/my-repo"; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+
+		if _, err := request(b, storage, logical.DeleteOperation, "project/gh/my-org/my-repo/FOO", nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := server.ProjectValue("gh/my-org/my-repo", "FOO"); ok {
+			t.Errorf("expected the variable to be deleted")
+		}
+	})
+
+	t.Run("not_found", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddProject("gh/my-org/my-repo")
+
+		for _, req := range []struct {
+			op  logical.Operation
+			pth string
+		}{
+			{logical.ReadOperation, "project/gh/my-org/my-repo/MISSING"},
+			{logical.DeleteOperation, "project/gh/my-org/my-repo/MISSING"},
+			{logical.ListOperation, "project/gh/my-org/missing-repo/"},
+		} {
+			_, err := request(b, storage, req.op, req.pth, nil)
+			if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 404 {
+				t.Errorf("%s %s: expected 404, got %v", req.op, req.pth, err)
+			}
+		}
+	})
+
+	t.Run("value_required", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddProject("gh/my-org/my-repo")
+		for _, data := range []map[string]interface{}{nil, {"value": ""}} {
+			_, err := request(b, storage, logical.UpdateOperation, "project/gh/my-org/my-repo/FOO", data)
+			if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 400 {
+				t.Errorf("%v: expected 400, got %v", data, err)
+			}
+		}
+		if _, ok := server.ProjectValue("gh/my-org/my-repo", "FOO"); ok {
+			t.Errorf("expected the variable not to be written")
+		}
+	})
+
+	t.Run("unconfigured_org", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, _ := testBackendWithCircleCI(t)
+		_, err := request(b, storage, logical.ListOperation, "org/other/project/gh/my-org/my-repo/", nil)
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 404 {
+			t.Errorf("expected 404, got %v", err)
+		}
+	})
+}
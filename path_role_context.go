@@ -0,0 +1,156 @@
+package circleci
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// rolePrefix is the path prefix that scopes a path to one of the roles
+// configured at roles/<name>.
+var rolePrefix = "role/" + framework.GenericNameRegex("role") + "/"
+
+// orgOperationFunc is a handler of a request on the contexts of the given
+// organization.
+type orgOperationFunc func(ctx context.Context, req *logical.Request, d *framework.FieldData, org string) (*logical.Response, error)
+
+func (b *backend) pathRoleContext() *framework.Path {
+	return &framework.Path{
+		Pattern: rolePrefix + "context/?$",
+
+		HelpSynopsis:    "Create contexts restricted by a role",
+		HelpDescription: "Create contexts in the organization of the role, if the role allows the create_context operation and the name of the context.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"role":    roleField(),
+			"refresh": refreshField(),
+			"context": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the CircleCI context you would like to create.",
+			},
+			"ttl":     contextTTLField(),
+			"max_ttl": contextMaxTTLField(),
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.CreateOperation: &framework.PathOperation{Callback: b.withRole(roleOperationCreateContext, b.contextWrite)},
+			logical.UpdateOperation: &framework.PathOperation{Callback: b.withRole(roleOperationCreateContext, b.contextWrite)},
+		},
+	}
+}
+
+func (b *backend) pathRoleContextKey() *framework.Path {
+	fields := map[string]*framework.FieldSchema{
+		"role":    roleField(),
+		"refresh": refreshField(),
+		"context": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "The name of the CircleCI context you would like to alter.",
+			Required:    true,
+		},
+		"env": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "The name of the environment variable you want to read or write in the given CircleCI context.",
+			Required:    true,
+		},
+		"value": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "The value of the environment variable. Required unless generate is set.",
+		},
+		"comment": commentField(),
+		"ttl":     variableTTLField(),
+		"max_ttl": variableMaxTTLField(),
+	}
+	for name, schema := range generateFields() {
+		fields[name] = schema
+	}
+
+	return &framework.Path{
+		Pattern: rolePrefix + "context/" + framework.GenericNameRegex("context") + "/" + framework.GenericNameRegex("env"),
+
+		HelpSynopsis:    "Read, write and delete environment variables restricted by a role",
+		HelpDescription: "Read, write and delete environment variables in the contexts and with the names the role allows. Writes and deletes also require the write_variable and delete_variable operations.",
+
+		Fields: fields,
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.CreateOperation: &framework.PathOperation{Callback: b.withRole(roleOperationWriteVariable, b.contextKeyWrite)},
+			logical.UpdateOperation: &framework.PathOperation{Callback: b.withRole(roleOperationWriteVariable, b.contextKeyWrite)},
+			logical.ReadOperation:   &framework.PathOperation{Callback: b.withRole("", b.contextKeyRead)},
+			logical.DeleteOperation: &framework.PathOperation{Callback: b.withRole(roleOperationDeleteVariable, b.contextKeyDelete)},
+		},
+	}
+}
+
+// resolveRole returns a copy of the role with the identity templates in its
+// context globs resolved for the entity of the request. Denied globs that
+// cannot be resolved deny the request, allowed globs that cannot be resolved
+// never match.
+func (b *backend) resolveRole(req *logical.Request, name string, r *role) (*role, error) {
+	resolved := *r
+
+	var errs []error
+	resolved.AllowedContexts, errs = b.resolveContextPatterns(req, r.AllowedContexts)
+	if len(resolved.AllowedContexts) == 0 && len(errs) > 0 {
+		return nil, logical.CodedError(403, fmt.Sprintf("role '%v' denied: allowed_contexts %s", name, joinErrors(errs)))
+	}
+
+	resolved.DeniedContexts, errs = b.resolveContextPatterns(req, r.DeniedContexts)
+	if len(errs) > 0 {
+		return nil, logical.CodedError(403, fmt.Sprintf("role '%v' denied: denied_contexts %s", name, joinErrors(errs)))
+	}
+	return &resolved, nil
+}
+
+// roleField returns the schema of the field captured by rolePrefix.
+func roleField() *framework.FieldSchema {
+	return &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "The name of the role configured at roles/<name>.",
+		Required:    true,
+	}
+}
+
+// withRole wraps an orgOperationFunc, validates the fields, and calls it in
+// the organization of the role named by the request, if the role allows the
+// given operation, context and environment variable. Operations are also
+// subject to the access rule of config/access. An empty operation only checks
+// the context and environment variable.
+func (b *backend) withRole(op string, f orgOperationFunc) framework.OperationFunc {
+	return withFieldValidator(func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		name := d.Get("role").(string)
+		r, err := b.Role(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if r == nil {
+			return nil, logical.CodedError(404, fmt.Sprintf("role '%v' does not exist", name))
+		}
+
+		r, err = b.resolveRole(req, name, r)
+		if err != nil {
+			return nil, err
+		}
+
+		if op != "" && !r.AllowsOperation(op) {
+			return nil, logical.CodedError(403, fmt.Sprintf("role '%v' does not allow the %s operation", name, op))
+		}
+		if contextName := d.Get("context").(string); !r.AllowsContext(contextName) {
+			return nil, logical.CodedError(403, fmt.Sprintf("role '%v' does not allow context '%v'", name, contextName))
+		}
+		if _, ok := d.Schema["env"]; ok {
+			if envName := d.Get("env").(string); !r.AllowsEnvName(envName) {
+				return nil, logical.CodedError(403, fmt.Sprintf("role '%v' does not allow environment variable '%v'", name, envName))
+			}
+		}
+		if op != "" {
+			if err := b.checkContextAccess(ctx, req, d.Get("context").(string)); err != nil {
+				return nil, err
+			}
+		}
+
+		return f(ctx, req, d, r.Org)
+	})
+}
@@ -0,0 +1,318 @@
+package circleci
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// The operations a role may allow.
+const (
+	roleOperationCreateContext  = "create_context"
+	roleOperationWriteVariable  = "write_variable"
+	roleOperationDeleteVariable = "delete_variable"
+)
+
+var roleOperations = []string{
+	roleOperationCreateContext,
+	roleOperationWriteVariable,
+	roleOperationDeleteVariable,
+}
+
+// role restricts the contexts and environment variables that can be managed
+// through the role/<name>/ paths.
+type role struct {
+	// Org is the organization the role manages contexts in.
+	Org string `json:"org"`
+
+	// AllowedContexts and DeniedContexts are globs of context names, which
+	// may contain identity templates. A context must match an allowed and no
+	// denied glob.
+	AllowedContexts []string `json:"allowed_contexts"`
+	DeniedContexts  []string `json:"denied_contexts"`
+
+	// AllowedEnvNames and DeniedEnvNames are regular expressions that must
+	// match the whole name of an environment variable. A name must match an
+	// allowed and no denied expression.
+	AllowedEnvNames []string `json:"allowed_env_names"`
+	DeniedEnvNames  []string `json:"denied_env_names"`
+
+	// Operations are the operations the role allows.
+	Operations []string `json:"operations"`
+}
+
+// pathRolesList defines the circleci/roles base path on the backend.
+func (b *backend) pathRolesList() *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/?$",
+
+		HelpSynopsis:    "List the roles",
+		HelpDescription: "List the names of the roles configured at roles/<name>.",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathRolesListRead)},
+		},
+	}
+}
+
+// pathRoles defines the circleci/roles/:name path on the backend.
+func (b *backend) pathRoles() *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/" + framework.GenericNameRegex("name"),
+
+		HelpSynopsis: "Configure a role that restricts which contexts and variables can be managed",
+		HelpDescription: "Configure a role with the contexts, environment variable names and operations it allows. " +
+			"The role is used through the role/<name>/context paths, which enforce it before calling CircleCI.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the role.",
+				Required:    true,
+			},
+			"org": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the organization configured at orgs/<name> the role manages contexts in. Defaults to the organization configured at config.",
+			},
+			"allowed_contexts": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Globs of the names of the contexts the role may manage, e.g. team-a-*. Identity templates like {{identity.entity.metadata.team}} are resolved for the entity of the request.",
+			},
+			"denied_contexts": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Globs of the names of the contexts the role may not manage, even if allowed by allowed_contexts.",
+			},
+			"allowed_env_names": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Regular expressions matching the whole names of the environment variables the role may manage, e.g. TEAM_A_.*.",
+			},
+			"denied_env_names": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Regular expressions matching the whole names of the environment variables the role may not manage, e.g. CIRCLE_.*.",
+			},
+			"operations": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "The operations the role allows: " + strings.Join(roleOperations, ", ") + ".",
+			},
+		},
+
+		ExistenceCheck: b.pathRolesExists,
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.CreateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathRolesWrite)},
+			logical.UpdateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathRolesWrite)},
+			logical.ReadOperation:   &framework.PathOperation{Callback: withFieldValidator(b.pathRolesRead)},
+			logical.DeleteOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathRolesDelete)},
+		},
+	}
+}
+
+// pathRolesExists checks if the role exists.
+func (b *backend) pathRolesExists(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	r, err := b.Role(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+	return r != nil, nil
+}
+
+// pathRolesListRead corresponds to LIST circleci/roles.
+func (b *backend) pathRolesListRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	roles, err := req.Storage.List(ctx, "roles/")
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to list roles: {{err}}", err)
+	}
+	return logical.ListResponse(roles), nil
+}
+
+// pathRolesRead corresponds to READ circleci/roles/:name.
+func (b *backend) pathRolesRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	r, err := b.Role(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"org":               r.Org,
+			"allowed_contexts":  r.AllowedContexts,
+			"denied_contexts":   r.DeniedContexts,
+			"allowed_env_names": r.AllowedEnvNames,
+			"denied_env_names":  r.DeniedEnvNames,
+			"operations":        r.Operations,
+		},
+	}, nil
+}
+
+// pathRolesWrite corresponds to both CREATE and UPDATE circleci/roles/:name.
+func (b *backend) pathRolesWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	r, err := b.Role(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		r = &role{Org: defaultOrg}
+	}
+
+	if err := r.Update(d); err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	entry, err := logical.StorageEntryJSON("roles/"+name, r)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to generate JSON role: {{err}}", err)
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, errwrap.Wrapf("failed to persist role to storage: {{err}}", err)
+	}
+	return nil, nil
+}
+
+// pathRolesDelete corresponds to DELETE circleci/roles/:name.
+func (b *backend) pathRolesDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, "roles/"+d.Get("name").(string)); err != nil {
+		return nil, errwrap.Wrapf("failed to delete role from storage: {{err}}", err)
+	}
+	return nil, nil
+}
+
+// Role returns the named role, or nil if it does not exist.
+func (b *backend) Role(ctx context.Context, s logical.Storage, name string) (*role, error) {
+	entry, err := s.Get(ctx, "roles/"+name)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to get role from storage: {{err}}", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var r role
+	if err := entry.DecodeJSON(&r); err != nil {
+		return nil, errwrap.Wrapf("failed to decode role: {{err}}", err)
+	}
+	return &r, nil
+}
+
+// Update updates the role from the given field data.
+func (r *role) Update(d *framework.FieldData) error {
+	if v, ok := d.GetOk("org"); ok {
+		r.Org = v.(string)
+		if r.Org == "" {
+			r.Org = defaultOrg
+		}
+	}
+	if v, ok := d.GetOk("allowed_contexts"); ok {
+		r.AllowedContexts = v.([]string)
+	}
+	if v, ok := d.GetOk("denied_contexts"); ok {
+		r.DeniedContexts = v.([]string)
+	}
+	if v, ok := d.GetOk("allowed_env_names"); ok {
+		r.AllowedEnvNames = v.([]string)
+	}
+	if v, ok := d.GetOk("denied_env_names"); ok {
+		r.DeniedEnvNames = v.([]string)
+	}
+	if v, ok := d.GetOk("operations"); ok {
+		r.Operations = v.([]string)
+	}
+
+	for _, field := range []struct {
+		name     string
+		patterns []string
+	}{
+		{"allowed_contexts", r.AllowedContexts},
+		{"denied_contexts", r.DeniedContexts},
+	} {
+		if err := validateContextPatterns(field.patterns); err != nil {
+			return fmt.Errorf("invalid %s: %v", field.name, err)
+		}
+	}
+	for _, field := range []struct {
+		name     string
+		patterns []string
+	}{
+		{"allowed_env_names", r.AllowedEnvNames},
+		{"denied_env_names", r.DeniedEnvNames},
+	} {
+		if _, err := compileEnvNames(field.patterns); err != nil {
+			return fmt.Errorf("invalid %s: %v", field.name, err)
+		}
+	}
+	for _, op := range r.Operations {
+		if !strutil.StrListContains(roleOperations, op) {
+			return fmt.Errorf("invalid operation %q, must be one of: %s", op, strings.Join(roleOperations, ", "))
+		}
+	}
+	return nil
+}
+
+// AllowsOperation reports whether the role allows the given operation.
+func (r *role) AllowsOperation(op string) bool {
+	return strutil.StrListContains(r.Operations, op)
+}
+
+// AllowsContext reports whether the role may manage the named context.
+func (r *role) AllowsContext(name string) bool {
+	return matchesGlob(r.AllowedContexts, name) && !matchesGlob(r.DeniedContexts, name)
+}
+
+// AllowsEnvName reports whether the role may manage the named environment
+// variable.
+func (r *role) AllowsEnvName(name string) bool {
+	allowed, err := matchesEnvName(r.AllowedEnvNames, name)
+	if err != nil || !allowed {
+		return false
+	}
+	denied, err := matchesEnvName(r.DeniedEnvNames, name)
+	return err == nil && !denied
+}
+
+// matchesGlob reports whether name matches any of the given globs.
+func matchesGlob(globs []string, name string) bool {
+	for _, glob := range globs {
+		if strutil.GlobbedStringsMatch(glob, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesEnvName reports whether name matches any of the given regular
+// expressions as a whole.
+func matchesEnvName(patterns []string, name string) (bool, error) {
+	res, err := compileEnvNames(patterns)
+	if err != nil {
+		return false, err
+	}
+	for _, re := range res {
+		if re.MatchString(name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// compileEnvNames compiles the given regular expressions, anchored to match
+// whole names.
+func compileEnvNames(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, err
+		}
+		res[i] = re
+	}
+	return res, nil
+}
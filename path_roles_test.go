@@ -0,0 +1,208 @@
+package circleci
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRole_Allows(t *testing.T) {
+	t.Parallel()
+
+	r := &role{
+		AllowedContexts: []string{"team-a-*"},
+		DeniedContexts:  []string{"team-a-prod*"},
+		AllowedEnvNames: []string{"[A-Z_]+"},
+		DeniedEnvNames:  []string{"CIRCLE_.*"},
+		Operations:      []string{roleOperationWriteVariable},
+	}
+
+	for name, exp := range map[string]bool{
+		"team-a-dev":        true,
+		"team-a-production": false,
+		"team-b-dev":        false,
+		"":                  false,
+	} {
+		if v := r.AllowsContext(name); v != exp {
+			t.Errorf("context %q: expected %t to be %t", name, v, exp)
+		}
+	}
+
+	for name, exp := range map[string]bool{
+		"FOO":          true,
+		"CIRCLE_TOKEN": false,
+		"foo":          false,
+		"FOO-BAR":      false,
+	} {
+		if v := r.AllowsEnvName(name); v != exp {
+			t.Errorf("env %q: expected %t to be %t", name, v, exp)
+		}
+	}
+
+	if !r.AllowsOperation(roleOperationWriteVariable) || r.AllowsOperation(roleOperationDeleteVariable) {
+		t.Errorf("expected only %s to be allowed", roleOperationWriteVariable)
+	}
+}
+
+func TestRole_Update(t *testing.T) {
+	t.Parallel()
+
+	var b backend
+	for _, raw := range []map[string]interface{}{
+		{"allowed_env_names": "FOO("},
+		{"denied_env_names": "[a-"},
+		{"operations": "write_variable,read_everything"},
+	} {
+		r := &role{}
+		if err := r.Update(&framework.FieldData{Raw: raw, Schema: b.pathRoles().Fields}); err == nil {
+			t.Errorf("expected error for %v", raw)
+		}
+	}
+}
+
+func TestBackend_PathRoles(t *testing.T) {
+	t.Parallel()
+
+	t.Run("field_validation", func(t *testing.T) {
+		t.Parallel()
+		testFieldValidation(t, logical.UpdateOperation, "roles/my-role")
+	})
+
+	t.Run("crud", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage := testBackend(t)
+		ctx := context.Background()
+
+		if _, err := b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.CreateOperation,
+			Path:      "roles/team-a",
+			Data: map[string]interface{}{
+				"allowed_contexts":  "team-a-*",
+				"allowed_env_names": "TEAM_A_.*",
+				"operations":        "write_variable,delete_variable",
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.ListOperation,
+			Path:      "roles/",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, exp := resp.Data["keys"], []string{"team-a"}; !reflect.DeepEqual(v, exp) {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "roles/team-a",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, exp := resp.Data["org"], defaultOrg; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+		if v, exp := resp.Data["operations"], []string{"write_variable", "delete_variable"}; !reflect.DeepEqual(v, exp) {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+
+		if _, err := b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.DeleteOperation,
+			Path:      "roles/team-a",
+		}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "roles/team-a",
+		})
+		if err != nil || resp != nil {
+			t.Errorf("expected role to be deleted, got %v, %v", resp, err)
+		}
+	})
+}
+
+func TestBackend_RoleScopedContexts(t *testing.T) {
+	t.Parallel()
+
+	b, storage, server := testBackendWithCircleCI(t)
+	server.AddContext("team-a-dev", "TEAM_A_TOKEN")
+	server.AddContext("team-a-prod")
+	ctx := context.Background()
+
+	if _, err := b.HandleRequest(ctx, &logical.Request{
+		Storage:   storage,
+		Operation: logical.CreateOperation,
+		Path:      "roles/team-a",
+		Data: map[string]interface{}{
+			"allowed_contexts":  "team-a-*",
+			"denied_contexts":   "team-a-prod",
+			"allowed_env_names": "TEAM_A_.*",
+			"denied_env_names":  "CIRCLE_.*",
+			"operations":        "create_context,write_variable",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(op logical.Operation, pth string, data map[string]interface{}) error {
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      pth,
+			Data:      data,
+		})
+		return err
+	}
+	expectCode := func(err error, exp int) {
+		t.Helper()
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != exp {
+			t.Errorf("expected %d, got %v", exp, err)
+		}
+	}
+
+	if err := request(logical.UpdateOperation, "role/team-a/context/team-a-dev/TEAM_A_KEY", map[string]interface{}{"value": "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	if v, exp := server.Value("team-a-dev", "TEAM_A_KEY"), "bar"; v != exp {
+		t.Errorf("expected %q to be %q", v, exp)
+	}
+	if err := request(logical.ReadOperation, "role/team-a/context/team-a-dev/TEAM_A_KEY", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := request(logical.UpdateOperation, "role/team-a/context/", map[string]interface{}{"context": "team-a-staging"}); err != nil {
+		t.Fatal(err)
+	}
+	if server.Context("team-a-staging") == nil {
+		t.Errorf("expected context to be created")
+	}
+
+	// Denied context, denied and not allowed names, denied operation
+	expectCode(request(logical.UpdateOperation, "role/team-a/context/team-a-prod/TEAM_A_KEY", map[string]interface{}{"value": "bar"}), 403)
+	expectCode(request(logical.UpdateOperation, "role/team-a/context/team-b-dev/TEAM_A_KEY", map[string]interface{}{"value": "bar"}), 403)
+	expectCode(request(logical.UpdateOperation, "role/team-a/context/team-a-dev/CIRCLE_TOKEN", map[string]interface{}{"value": "bar"}), 403)
+	expectCode(request(logical.UpdateOperation, "role/team-a/context/team-a-dev/OTHER", map[string]interface{}{"value": "bar"}), 403)
+	expectCode(request(logical.DeleteOperation, "role/team-a/context/team-a-dev/TEAM_A_TOKEN", nil), 403)
+	expectCode(request(logical.UpdateOperation, "role/team-a/context/", map[string]interface{}{"context": "team-a-prod"}), 403)
+	expectCode(request(logical.UpdateOperation, "role/missing/context/team-a-dev/TEAM_A_KEY", map[string]interface{}{"value": "bar"}), 404)
+
+	if server.Variable("team-a-dev", "TEAM_A_TOKEN") == nil {
+		t.Errorf("expected variable not to be deleted")
+	}
+	if v, exp := server.Requests("PUT context/"+server.Context("team-a-prod").ID+"/environment-variable/TEAM_A_KEY"), 0; v != exp {
+		t.Errorf("expected %d requests, got %d", exp, v)
+	}
+}
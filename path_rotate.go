@@ -0,0 +1,465 @@
+package circleci
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// rotatePrefix is the storage prefix of the rotation definitions.
+const rotatePrefix = "rotate/"
+
+// rotation is the definition and state of a variable whose value is
+// generated by Vault and rotated periodically.
+type rotation struct {
+	// RotationPeriod is the time between two rotations.
+	RotationPeriod time.Duration `json:"rotation_period"`
+
+	// Generator generates the values.
+	Generator *valueGenerator `json:"generator"`
+
+	// LastRotated is the time of the last successful rotation, NextRotation
+	// the time the next rotation is due.
+	LastRotated  time.Time `json:"last_rotated"`
+	NextRotation time.Time `json:"next_rotation"`
+
+	// LastError is the error of the last rotation, if it failed.
+	LastError string `json:"last_error,omitempty"`
+}
+
+// rotationLock returns the lock of the rotation of the given environment
+// variable.
+func (b *backend) rotationLock(org, contextName, envVariable string) *locksutil.LockEntry {
+	return locksutil.LockForKey(b.rotationLocks, rotateKey(org, contextName, envVariable))
+}
+
+// rotateKey returns the storage key of the rotation of the given environment
+// variable.
+func rotateKey(org, contextName, envVariable string) string {
+	return rotatePrefix + org + "/" + contextName + "/" + envVariable
+}
+
+// pathRotateList defines the circleci/rotate and circleci/rotate/:context
+// base paths on the backend.
+func (b *backend) pathRotateList() *framework.Path {
+	return &framework.Path{
+		Pattern: orgPrefix + "rotate/(" + framework.GenericNameRegex("context") + "/)?$",
+
+		HelpSynopsis:    "List the contexts and variables that are rotated",
+		HelpDescription: "List the names of the contexts with rotated variables, or the names of the rotated variables of a context.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"org": orgField(),
+			"context": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the CircleCI context.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathRotateListRead)},
+		},
+	}
+}
+
+// pathRotate defines the circleci/rotate/:context/:env path on the backend.
+func (b *backend) pathRotate() *framework.Path {
+	fields := map[string]*framework.FieldSchema{
+		"org": orgField(),
+		"context": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "The name of the CircleCI context.",
+			Required:    true,
+		},
+		"env": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "The name of the environment variable in the given CircleCI context.",
+			Required:    true,
+		},
+		"rotation_period": &framework.FieldSchema{
+			Type:        framework.TypeDurationSecond,
+			Description: "The time between two rotations. Required when creating a rotation. Rotations are checked about once a minute.",
+		},
+	}
+	for name, schema := range generatorFields() {
+		fields[name] = schema
+	}
+
+	return &framework.Path{
+		Pattern: orgPrefix + "rotate/" + framework.GenericNameRegex("context") + "/" + framework.GenericNameRegex("env"),
+
+		HelpSynopsis: "Rotate an environment variable in a CircleCI context with generated values",
+		HelpDescription: "Define an environment variable whose value is generated by Vault and rotated every " +
+			"rotation_period. The variable is rotated when the rotation is created, and then on the active node " +
+			"whenever it is due.",
+
+		Fields: fields,
+
+		ExistenceCheck: b.pathRotateExists,
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.CreateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathRotateWrite)},
+			logical.UpdateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathRotateWrite)},
+			logical.ReadOperation:   &framework.PathOperation{Callback: withFieldValidator(b.pathRotateRead)},
+			logical.DeleteOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathRotateDelete)},
+		},
+	}
+}
+
+// pathRotateNow defines the circleci/rotate/:context/:env/rotate path on the
+// backend.
+func (b *backend) pathRotateNow() *framework.Path {
+	return &framework.Path{
+		Pattern: orgPrefix + "rotate/" + framework.GenericNameRegex("context") + "/" + framework.GenericNameRegex("env") + "/rotate",
+
+		HelpSynopsis:    "Rotate an environment variable in a CircleCI context now",
+		HelpDescription: "Rotate an environment variable defined at rotate/<context>/<env> immediately.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"org": orgField(),
+			"context": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the CircleCI context.",
+				Required:    true,
+			},
+			"env": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the environment variable in the given CircleCI context.",
+				Required:    true,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathRotateNowWrite)},
+		},
+	}
+}
+
+// pathRotateExists checks if the rotation exists.
+func (b *backend) pathRotateExists(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	r, err := b.Rotation(ctx, req.Storage, orgName(d), d.Get("context").(string), d.Get("env").(string))
+	if err != nil {
+		return false, err
+	}
+	return r != nil, nil
+}
+
+// pathRotateListRead corresponds to LIST circleci/rotate and
+// circleci/rotate/:context.
+func (b *backend) pathRotateListRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	prefix := rotatePrefix + orgName(d) + "/"
+	if contextName := d.Get("context").(string); contextName != "" {
+		prefix += contextName + "/"
+	}
+	keys, err := req.Storage.List(ctx, prefix)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to list rotations: {{err}}", err)
+	}
+	return logical.ListResponse(keys), nil
+}
+
+// pathRotateRead corresponds to READ circleci/rotate/:context/:env.
+func (b *backend) pathRotateRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	r, err := b.Rotation(ctx, req.Storage, orgName(d), d.Get("context").(string), d.Get("env").(string))
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"rotation_period": int64(r.RotationPeriod.Seconds()),
+			"password_policy": r.Generator.PasswordPolicy,
+			"length":          r.Generator.Length,
+			"charset":         r.Generator.Charset,
+			"last_rotated":    r.LastRotated,
+			"next_rotation":   r.NextRotation,
+			"last_error":      r.LastError,
+		},
+	}, nil
+}
+
+// pathRotateWrite corresponds to both CREATE and UPDATE
+// circleci/rotate/:context/:env. A new rotation is rotated immediately.
+func (b *backend) pathRotateWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	org := orgName(d)
+	contextName := d.Get("context").(string)
+	envVariable := d.Get("env").(string)
+	if err := b.checkContextAccess(ctx, req, contextName); err != nil {
+		return nil, err
+	}
+
+	lock := b.rotationLock(org, contextName, envVariable)
+	lock.Lock()
+	defer lock.Unlock()
+
+	r, err := b.Rotation(ctx, req.Storage, org, contextName, envVariable)
+	if err != nil {
+		return nil, err
+	}
+	created := r == nil
+	if created {
+		r = &rotation{Generator: defaultGenerator()}
+	}
+
+	if v, ok := d.GetOk("rotation_period"); ok {
+		r.RotationPeriod = time.Duration(v.(int)) * time.Second
+	}
+	if r.RotationPeriod <= 0 {
+		return nil, logical.CodedError(400, "rotation_period must be positive")
+	}
+	if err := r.Generator.Update(d); err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	if created {
+		if err := b.rotate(ctx, req, org, contextName, envVariable, r); err != nil {
+			return nil, err
+		}
+	} else if !r.LastRotated.IsZero() {
+		r.NextRotation = r.LastRotated.Add(r.RotationPeriod)
+	}
+
+	if err := b.putRotation(ctx, req.Storage, org, contextName, envVariable, r); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// pathRotateDelete corresponds to DELETE circleci/rotate/:context/:env. The
+// variable is kept in CircleCI.
+func (b *backend) pathRotateDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	contextName := d.Get("context").(string)
+	if err := b.checkContextAccess(ctx, req, contextName); err != nil {
+		return nil, err
+	}
+
+	org := orgName(d)
+	envVariable := d.Get("env").(string)
+	lock := b.rotationLock(org, contextName, envVariable)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := req.Storage.Delete(ctx, rotateKey(org, contextName, envVariable)); err != nil {
+		return nil, errwrap.Wrapf("failed to delete rotation from storage: {{err}}", err)
+	}
+	return nil, nil
+}
+
+// pathRotateNowWrite corresponds to PUT/POST
+// circleci/rotate/:context/:env/rotate.
+func (b *backend) pathRotateNowWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	org := orgName(d)
+	contextName := d.Get("context").(string)
+	envVariable := d.Get("env").(string)
+	if err := b.checkContextAccess(ctx, req, contextName); err != nil {
+		return nil, err
+	}
+
+	lock := b.rotationLock(org, contextName, envVariable)
+	lock.Lock()
+	defer lock.Unlock()
+
+	r, err := b.Rotation(ctx, req.Storage, org, contextName, envVariable)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, logical.CodedError(404, fmt.Sprintf("variable '%v' in context '%v' is not rotated", envVariable, contextName))
+	}
+
+	rotateErr := b.rotate(ctx, req, org, contextName, envVariable, r)
+	if err := b.putRotation(ctx, req.Storage, org, contextName, envVariable, r); err != nil {
+		return nil, err
+	}
+	if rotateErr != nil {
+		return nil, rotateErr
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"last_rotated":  r.LastRotated,
+			"next_rotation": r.NextRotation,
+		},
+	}, nil
+}
+
+// Rotation returns the rotation of the given environment variable, or nil if
+// it is not rotated.
+func (b *backend) Rotation(ctx context.Context, s logical.Storage, org, contextName, envVariable string) (*rotation, error) {
+	entry, err := s.Get(ctx, rotateKey(org, contextName, envVariable))
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to get rotation from storage: {{err}}", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var r rotation
+	if err := entry.DecodeJSON(&r); err != nil {
+		return nil, errwrap.Wrapf("failed to decode rotation: {{err}}", err)
+	}
+	return &r, nil
+}
+
+// putRotation stores the rotation of the given environment variable.
+func (b *backend) putRotation(ctx context.Context, s logical.Storage, org, contextName, envVariable string, r *rotation) error {
+	entry, err := logical.StorageEntryJSON(rotateKey(org, contextName, envVariable), r)
+	if err != nil {
+		return errwrap.Wrapf("failed to generate JSON rotation: {{err}}", err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return errwrap.Wrapf("failed to persist rotation to storage: {{err}}", err)
+	}
+	return nil
+}
+
+// deleteRotations deletes the rotations of all environment variables of the
+// given context.
+func (b *backend) deleteRotations(ctx context.Context, s logical.Storage, org, contextName string) error {
+	prefix := rotatePrefix + org + "/" + contextName + "/"
+	keys, err := s.List(ctx, prefix)
+	if err != nil {
+		return errwrap.Wrapf("failed to list rotations: {{err}}", err)
+	}
+	for _, key := range keys {
+		lock := locksutil.LockForKey(b.rotationLocks, prefix+key)
+		lock.Lock()
+		err := s.Delete(ctx, prefix+key)
+		lock.Unlock()
+		if err != nil {
+			return errwrap.Wrapf("failed to delete rotation from storage: {{err}}", err)
+		}
+	}
+	return nil
+}
+
+// rotate writes a new generated value to the given environment variable and
+// updates the state of the rotation, but does not store it. The caller must
+// hold the lock of the rotation.
+func (b *backend) rotate(ctx context.Context, req *logical.Request, org, contextName, envVariable string, r *rotation) error {
+	err := b.writeGenerated(ctx, req, org, contextName, envVariable, r.Generator, "rotation")
+	if err != nil {
+		b.Logger().Error("Failed to rotate variable", "org", org, "context", contextName, "envVariable", envVariable, "error", err)
+		r.LastError = err.Error()
+		return err
+	}
+	b.Logger().Info("Rotated variable", "org", org, "context", contextName, "envVariable", envVariable)
+
+	r.LastRotated = time.Now().UTC()
+	r.NextRotation = r.LastRotated.Add(r.RotationPeriod)
+	r.LastError = ""
+	return nil
+}
+
+// writeGenerated writes a value generated by the given generator to the given
+// environment variable, and records it.
+func (b *backend) writeGenerated(ctx context.Context, req *logical.Request, org, contextName, envVariable string, generator *valueGenerator, comment string) error {
+	config, err := b.OrgConfig(ctx, req.Storage, org)
+	if err != nil {
+		return err
+	}
+	foundContext, err := b.findContext(ctx, req, org, config, contextName)
+	if err != nil {
+		return err
+	}
+	circleCIClient, err := b.CircleCIClient(req.Storage, org)
+	if err != nil {
+		return err
+	}
+
+	value, err := generator.Generate(ctx, b.System())
+	if err != nil {
+		return err
+	}
+	written, err := circleCIClient.AddOrUpdateContextVariable(ctx, foundContext.ID, envVariable, value)
+	if err != nil {
+		return err
+	}
+	if _, err := b.recordVariable(ctx, req, org, config, foundContext.Name, written, value, comment); err != nil {
+		return errwrap.Wrapf("the variable was written to CircleCI, but its value could not be stored: {{err}}", err)
+	}
+	return nil
+}
+
+// rotateDue rotates all variables whose rotation is due. Each variable is
+// locked only while it is rotated, so that deleting other variables and
+// contexts does not wait for the whole pass.
+func (b *backend) rotateDue(ctx context.Context, s logical.Storage) error {
+	keys, err := listRecursive(ctx, s, rotatePrefix)
+	if err != nil {
+		return errwrap.Wrapf("failed to list rotations: {{err}}", err)
+	}
+
+	req := &logical.Request{Storage: s}
+	now := time.Now()
+	var errs []error
+	for _, key := range keys {
+		parts := strings.SplitN(strings.TrimPrefix(key, rotatePrefix), "/", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		org, contextName, envVariable := parts[0], parts[1], parts[2]
+
+		if err := b.rotateIfDue(ctx, req, org, contextName, envVariable, now); err != nil {
+			errs = append(errs, fmt.Errorf("variable '%v' in context '%v' of organization '%v': %v", envVariable, contextName, org, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to rotate variables: %s", joinErrors(errs))
+	}
+	return nil
+}
+
+// rotateIfDue rotates the given variable under its lock if its rotation is
+// still due, and stores the state of the rotation.
+func (b *backend) rotateIfDue(ctx context.Context, req *logical.Request, org, contextName, envVariable string, now time.Time) error {
+	lock := b.rotationLock(org, contextName, envVariable)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// The rotation may have been deleted or rotated since it was listed
+	r, err := b.Rotation(ctx, req.Storage, org, contextName, envVariable)
+	if err != nil {
+		return err
+	}
+	if r == nil || now.Before(r.NextRotation) {
+		return nil
+	}
+
+	rotateErr := b.rotate(ctx, req, org, contextName, envVariable, r)
+	if err := b.putRotation(ctx, req.Storage, org, contextName, envVariable, r); err != nil {
+		return err
+	}
+	return rotateErr
+}
+
+// listRecursive lists all keys below the given prefix.
+func listRecursive(ctx context.Context, s logical.Storage, prefix string) ([]string, error) {
+	keys, err := s.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var all []string
+	for _, key := range keys {
+		if !strings.HasSuffix(key, "/") {
+			all = append(all, prefix+key)
+			continue
+		}
+		sub, err := listRecursive(ctx, s, prefix+key)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, sub...)
+	}
+	return all, nil
+}
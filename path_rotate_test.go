@@ -0,0 +1,187 @@
+package circleci
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestBackend_PathRotate(t *testing.T) {
+	t.Parallel()
+
+	t.Run("field_validation", func(t *testing.T) {
+		t.Parallel()
+		testFieldValidation(t, logical.UpdateOperation, "rotate/my-context/FOO")
+		testFieldValidation(t, logical.UpdateOperation, "rotate/my-context/FOO/rotate")
+	})
+
+	request := func(tb testing.TB, b *backend, storage logical.Storage, op logical.Operation, pth string, data map[string]interface{}) (*logical.Response, error) {
+		tb.Helper()
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      pth,
+			Data:      data,
+		})
+	}
+
+	t.Run("rotate", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		ctx := context.Background()
+
+		if _, err := request(t, b, storage, logical.CreateOperation, "rotate/my-context/FOO", map[string]interface{}{
+			"rotation_period": "1h",
+			"length":          20,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		first := server.Value("my-context", "FOO")
+		if len(first) != 20 {
+			t.Errorf("expected a rotated value of 20 characters, got %q", first)
+		}
+
+		resp, err := request(t, b, storage, logical.ListOperation, "rotate/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, exp := resp.Data["keys"], []string{"my-context/"}; !reflect.DeepEqual(v, exp) {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+
+		// Not due yet
+		if _, err := request(t, b, storage, logical.RollbackOperation, "", nil); err != nil {
+			t.Fatal(err)
+		}
+		if v := server.Value("my-context", "FOO"); v != first {
+			t.Errorf("expected value not to be rotated")
+		}
+
+		r, err := b.Rotation(ctx, storage, defaultOrg, "my-context", "FOO")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.NextRotation = time.Now().Add(-time.Minute)
+		if err := b.putRotation(ctx, storage, defaultOrg, "my-context", "FOO", r); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := request(t, b, storage, logical.RollbackOperation, "", nil); err != nil {
+			t.Fatal(err)
+		}
+		second := server.Value("my-context", "FOO")
+		if second == first {
+			t.Errorf("expected value to be rotated")
+		}
+
+		resp, err = request(t, b, storage, logical.UpdateOperation, "rotate/my-context/FOO/rotate", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if server.Value("my-context", "FOO") == second {
+			t.Errorf("expected value to be rotated manually")
+		}
+		if next := resp.Data["next_rotation"].(time.Time); time.Until(next) < 59*time.Minute {
+			t.Errorf("expected next rotation in an hour, got %v", next)
+		}
+	})
+
+	t.Run("failure_persisted", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		ctx := context.Background()
+
+		if _, err := request(t, b, storage, logical.CreateOperation, "rotate/my-context/FOO", map[string]interface{}{"rotation_period": "1h"}); err != nil {
+			t.Fatal(err)
+		}
+		server.RemoveContext("my-context")
+		if _, err := request(t, b, storage, logical.UpdateOperation, "rotate/my-context/FOO/rotate", map[string]interface{}{}); err == nil {
+			t.Fatal("expected error")
+		}
+
+		resp, err := request(t, b, storage, logical.ReadOperation, "rotate/my-context/FOO", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Data["last_error"] == "" {
+			t.Errorf("expected the error to be persisted")
+		}
+		if r, err := b.Rotation(ctx, storage, defaultOrg, "my-context", "FOO"); err != nil || r.LastRotated.IsZero() {
+			t.Errorf("expected the last rotation to be kept, got %v, %v", r, err)
+		}
+	})
+
+	t.Run("create_fails", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, _ := testBackendWithCircleCI(t)
+		_, err := request(t, b, storage, logical.CreateOperation, "rotate/my-context/FOO", map[string]interface{}{"rotation_period": "1h"})
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 404 {
+			t.Errorf("expected 404, got %v", err)
+		}
+		if r, err := b.Rotation(context.Background(), storage, defaultOrg, "my-context", "FOO"); err != nil || r != nil {
+			t.Errorf("expected no rotation to be stored, got %v, %v", r, err)
+		}
+
+		_, err = request(t, b, storage, logical.CreateOperation, "rotate/my-context/FOO", nil)
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 400 {
+			t.Errorf("expected 400 without rotation_period, got %v", err)
+		}
+	})
+
+	t.Run("variable_deleted", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		if _, err := request(t, b, storage, logical.CreateOperation, "rotate/my-context/FOO", map[string]interface{}{"rotation_period": "1h"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := request(t, b, storage, logical.DeleteOperation, "context/my-context/FOO", nil); err != nil {
+			t.Fatal(err)
+		}
+		if r, err := b.Rotation(context.Background(), storage, defaultOrg, "my-context", "FOO"); err != nil || r != nil {
+			t.Errorf("expected the rotation to be deleted, got %v, %v", r, err)
+		}
+	})
+	t.Run("locked_per_variable", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		for _, name := range []string{"FOO", "BAR"} {
+			if _, err := request(t, b, storage, logical.CreateOperation, "rotate/my-context/"+name, map[string]interface{}{"rotation_period": "1h"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if locksutil.LockIndexForKey(rotateKey(defaultOrg, "my-context", "FOO")) == locksutil.LockIndexForKey(rotateKey(defaultOrg, "my-context", "BAR")) {
+			t.Fatal("expected FOO and BAR to have distinct locks")
+		}
+
+		// A rotation of FOO in progress does not hold up deleting BAR
+		lock := b.rotationLock(defaultOrg, "my-context", "FOO")
+		lock.Lock()
+		defer lock.Unlock()
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := request(t, b, storage, logical.DeleteOperation, "context/my-context/BAR", nil)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected deleting BAR not to wait for the lock of FOO")
+		}
+	})
+}
@@ -0,0 +1,274 @@
+package circleci
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/crypto/ssh"
+)
+
+// The SSH key types that can be generated.
+const (
+	sshKeyTypeEd25519 = "ed25519"
+	sshKeyTypeRSA     = "rsa"
+)
+
+// defaultRSAKeyBits is the default size of generated RSA keys.
+const defaultRSAKeyBits = 4096
+
+// pathSSHKeypair defines the circleci/context/:context/:env/ssh-keypair path
+// on the backend.
+func (b *backend) pathSSHKeypair() *framework.Path {
+	return &framework.Path{
+		Pattern: orgPrefix + "context/" + framework.GenericNameRegex("context") + "/" + framework.GenericNameRegex("env") + "/ssh-keypair",
+
+		HelpSynopsis: "Generate an SSH keypair into an environment variable of a CircleCI context",
+		HelpDescription: "Generate an SSH keypair, write the PEM-encoded private key to the environment variable and " +
+			"return the public key and its fingerprint, e.g. to install it on the target hosts. Only the public key " +
+			"is stored, and can be read again from this path. Variables with a rotation are rejected.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"org":     orgField(),
+			"refresh": refreshField(),
+			"context": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the CircleCI context.",
+				Required:    true,
+			},
+			"env": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the environment variable the private key is written to.",
+				Required:    true,
+			},
+			"key_type": &framework.FieldSchema{
+				Type:          framework.TypeString,
+				Description:   "The type of the key: ed25519 or rsa.",
+				Default:       sshKeyTypeEd25519,
+				AllowedValues: []interface{}{sshKeyTypeEd25519, sshKeyTypeRSA},
+			},
+			"key_bits": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: fmt.Sprintf("The size of RSA keys: 2048, 3072 or 4096. Defaults to %d.", defaultRSAKeyBits),
+			},
+			"base64": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "Encode the PEM private key with base64, so that it fits on a single line.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathSSHKeypairWrite)},
+			logical.ReadOperation:   &framework.PathOperation{Callback: withFieldValidator(b.pathSSHKeypairRead)},
+		},
+	}
+}
+
+// pathSSHKeypairRead corresponds to READ
+// circleci/context/:context/:env/ssh-keypair and returns the stored public
+// key.
+func (b *backend) pathSSHKeypairRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	circleCIContext := d.Get("context").(string)
+	envVariable := d.Get("env").(string)
+
+	v, err := b.StoredVariable(ctx, req.Storage, orgName(d), circleCIContext, envVariable)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil || v.SSHKey == nil {
+		return nil, logical.CodedError(404, fmt.Sprintf("no SSH keypair was generated into variable '%v' in context '%v'", envVariable, circleCIContext))
+	}
+	return sshKeypairResponse(circleCIContext, envVariable, v), nil
+}
+
+// pathSSHKeypairWrite corresponds to PUT/POST
+// circleci/context/:context/:env/ssh-keypair.
+func (b *backend) pathSSHKeypairWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	org := orgName(d)
+	circleCIContext := d.Get("context").(string)
+	envVariable := d.Get("env").(string)
+	if err := b.checkContextAccess(ctx, req, circleCIContext); err != nil {
+		return nil, err
+	}
+	if d.Get("refresh").(bool) {
+		b.invalidateContexts(ctx, req.Storage, org)
+	}
+
+	keyType := d.Get("key_type").(string)
+	keyBits := d.Get("key_bits").(int)
+	switch {
+	case keyType != sshKeyTypeEd25519 && keyType != sshKeyTypeRSA:
+		return nil, logical.CodedError(400, fmt.Sprintf("invalid key_type %q, must be %s or %s", keyType, sshKeyTypeEd25519, sshKeyTypeRSA))
+	case keyType == sshKeyTypeRSA && keyBits == 0:
+		keyBits = defaultRSAKeyBits
+	case keyType == sshKeyTypeRSA && keyBits != 2048 && keyBits != 3072 && keyBits != 4096:
+		return nil, logical.CodedError(400, "key_bits must be 2048, 3072 or 4096")
+	case keyType == sshKeyTypeEd25519 && keyBits != 0:
+		return nil, logical.CodedError(400, "key_bits cannot be set for ed25519 keys")
+	}
+
+	// A rotation would overwrite the private key with a generated value
+	lock := b.rotationLock(org, circleCIContext, envVariable)
+	lock.Lock()
+	defer lock.Unlock()
+	r, err := b.Rotation(ctx, req.Storage, org, circleCIContext, envVariable)
+	if err != nil {
+		return nil, err
+	}
+	if r != nil {
+		return nil, logical.CodedError(400, fmt.Sprintf("variable '%v' in context '%v' is rotated, delete its rotation before generating an SSH keypair into it", envVariable, circleCIContext))
+	}
+
+	config, err := b.OrgConfig(ctx, req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+	foundContext, err := b.findContext(ctx, req, org, config, circleCIContext)
+	if err != nil {
+		return nil, err
+	}
+	circleCIClient, err := b.CircleCIClient(req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, info, err := generateSSHKeypair(keyType, keyBits)
+	if err != nil {
+		return nil, err
+	}
+	if d.Get("base64").(bool) {
+		privateKey = base64.StdEncoding.EncodeToString([]byte(privateKey))
+	}
+
+	written, err := circleCIClient.AddOrUpdateContextVariable(ctx, foundContext.ID, envVariable, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	b.Logger().Debug("SSH keypair generated into variable", "context", foundContext.Name, "contextID", foundContext.ID, "envVariable", envVariable, "fingerprint", info.Fingerprint)
+
+	// The private key replaces any stored value and history
+	variableLock := b.variableLock(org, foundContext.Name, envVariable)
+	variableLock.Lock()
+	defer variableLock.Unlock()
+	v := &storedVariable{
+		ContextID: written.ContextID,
+		WrittenAt: time.Now().UTC(),
+		UpdatedAt: written.UpdatedAt,
+		SSHKey:    info,
+	}
+	if err := b.putStoredVariable(ctx, req.Storage, org, foundContext.Name, envVariable, v); err != nil {
+		return nil, errwrap.Wrapf("the private key was written to CircleCI, but the public key could not be stored: {{err}}", err)
+	}
+	return sshKeypairResponse(foundContext.Name, envVariable, v), nil
+}
+
+// sshKeypairResponse returns the response with the public key of the given
+// record.
+func sshKeypairResponse(contextName, envVariable string, v *storedVariable) *logical.Response {
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"variable":    envVariable,
+			"context":     contextName,
+			"context_id":  v.ContextID,
+			"key_type":    v.SSHKey.KeyType,
+			"public_key":  v.SSHKey.PublicKey,
+			"fingerprint": v.SSHKey.Fingerprint,
+			"written_at":  v.WrittenAt,
+		},
+	}
+}
+
+// generateSSHKeypair generates an SSH keypair of the given type, and returns
+// the PEM-encoded private key and the public key in authorized_keys format.
+// Ed25519 keys are encoded in the OpenSSH format, RSA keys in PKCS #1.
+func generateSSHKeypair(keyType string, keyBits int) (string, *sshKeyInfo, error) {
+	var signer interface{}
+	var block *pem.Block
+	switch keyType {
+	case sshKeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to generate ed25519 key: %v", err)
+		}
+		signer = key
+		block, err = marshalOpenSSHEd25519(key)
+		if err != nil {
+			return "", nil, err
+		}
+	case sshKeyTypeRSA:
+		key, err := rsa.GenerateKey(rand.Reader, keyBits)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to generate RSA key: %v", err)
+		}
+		signer = key
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	default:
+		return "", nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
+
+	sshSigner, err := ssh.NewSignerFromKey(signer)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encode public key: %v", err)
+	}
+	publicKey := sshSigner.PublicKey()
+	return string(pem.EncodeToMemory(block)), &sshKeyInfo{
+		KeyType:     keyType,
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))),
+		Fingerprint: ssh.FingerprintSHA256(publicKey),
+	}, nil
+}
+
+// marshalOpenSSHEd25519 encodes the given ed25519 key in the unencrypted
+// OpenSSH private key format, which is the only format all OpenSSH versions
+// read ed25519 keys from.
+func marshalOpenSSHEd25519(key ed25519.PrivateKey) (*pem.Block, error) {
+	public := key.Public().(ed25519.PublicKey)
+	publicKey := ssh.Marshal(struct {
+		KeyType string
+		Public  []byte
+	}{ssh.KeyAlgoED25519, public})
+
+	var check [4]byte
+	if _, err := rand.Read(check[:]); err != nil {
+		return nil, fmt.Errorf("failed to encode ed25519 key: %v", err)
+	}
+	checkInt := binary.BigEndian.Uint32(check[:])
+
+	private := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		KeyType string
+		Public  []byte
+		Private []byte
+		Comment string
+	}{checkInt, checkInt, ssh.KeyAlgoED25519, public, key, ""})
+	// Pad to the block size of the "none" cipher
+	for i := 1; len(private)%8 != 0; i++ {
+		private = append(private, byte(i))
+	}
+
+	body := ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PublicKey    []byte
+		PrivateBlock []byte
+	}{"none", "none", "", 1, publicKey, private})
+
+	return &pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: append([]byte("openssh-key-v1\x00"), body...),
+	}, nil
+}
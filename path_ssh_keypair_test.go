@@ -0,0 +1,132 @@
+package circleci
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGenerateSSHKeypair(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		keyType string
+		keyBits int
+		prefix  string
+	}{
+		{sshKeyTypeEd25519, 0, "ssh-ed25519 "},
+		{sshKeyTypeRSA, 2048, "ssh-rsa "},
+	} {
+		tc := tc
+		t.Run(tc.keyType, func(t *testing.T) {
+			t.Parallel()
+
+			privateKey, info, err := generateSSHKeypair(tc.keyType, tc.keyBits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signer, err := ssh.ParsePrivateKey([]byte(privateKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v, exp := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))), info.PublicKey; v != exp {
+				t.Errorf("expected %q to be %q", v, exp)
+			}
+			if !strings.HasPrefix(info.PublicKey, tc.prefix) || !strings.HasPrefix(info.Fingerprint, "SHA256:") {
+				t.Errorf("unexpected public key %q with fingerprint %q", info.PublicKey, info.Fingerprint)
+			}
+		})
+	}
+}
+
+func TestBackend_PathSSHKeypair(t *testing.T) {
+	t.Parallel()
+
+	t.Run("field_validation", func(t *testing.T) {
+		t.Parallel()
+		testFieldValidation(t, logical.UpdateOperation, "context/my-context/DEPLOY_KEY/ssh-keypair")
+	})
+
+	b, storage, server := testBackendWithCircleCI(t)
+	server.AddContext("my-context")
+	ctx := context.Background()
+
+	request := func(op logical.Operation, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      "context/my-context/DEPLOY_KEY/ssh-keypair",
+			Data:      data,
+		})
+	}
+
+	if _, err := b.HandleRequest(ctx, &logical.Request{
+		Storage:   storage,
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data:      map[string]interface{}{"store-values": true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := request(logical.UpdateOperation, map[string]interface{}{"base64": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(server.Value("my-context", "DEPLOY_KEY"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, exp := ssh.FingerprintSHA256(signer.PublicKey()), resp.Data["fingerprint"]; v != exp {
+		t.Errorf("expected %q to be %q", v, exp)
+	}
+
+	// Only the public key is stored
+	v, err := b.StoredVariable(ctx, storage, defaultOrg, "my-context", "DEPLOY_KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Value != "" || len(v.Versions) != 0 {
+		t.Errorf("expected the private key not to be stored")
+	}
+	read, err := request(logical.ReadOperation, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Data["public_key"] != resp.Data["public_key"] {
+		t.Errorf("expected %q to be %q", read.Data["public_key"], resp.Data["public_key"])
+	}
+
+	for _, data := range []map[string]interface{}{
+		{"key_type": "dsa"},
+		{"key_type": "rsa", "key_bits": 1024},
+		{"key_bits": 2048},
+	} {
+		_, err := request(logical.UpdateOperation, data)
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 400 {
+			t.Errorf("%v: expected 400, got %v", data, err)
+		}
+	}
+
+	// Rotated variables would lose the key on the next rotation
+	if _, err := b.HandleRequest(ctx, &logical.Request{
+		Storage:   storage,
+		Operation: logical.CreateOperation,
+		Path:      "rotate/my-context/DEPLOY_KEY",
+		Data:      map[string]interface{}{"rotation_period": "1h"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = request(logical.UpdateOperation, nil)
+	if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 400 || !strings.Contains(err.Error(), "rotated") {
+		t.Errorf("expected 400 for a rotated variable, got %v", err)
+	}
+}
@@ -0,0 +1,460 @@
+package circleci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// vaultTokenRolesPrefix is the storage prefix of the roles of the Vault
+// tokens minted through vault-token/.
+const vaultTokenRolesPrefix = "vault-token-roles/"
+
+// vaultTokenRole defines the Vault tokens minted through vault-token/<name>.
+type vaultTokenRole struct {
+	// Policies are the policies of the tokens.
+	Policies []string `json:"policies"`
+
+	// TTL is the TTL of the tokens and their leases, Period makes the tokens
+	// periodic instead. MaxTTL is the explicit maximum TTL of the tokens and
+	// the maximum TTL of their leases.
+	TTL    time.Duration `json:"ttl"`
+	Period time.Duration `json:"period"`
+	MaxTTL time.Duration `json:"max_ttl"`
+
+	// Orphan creates tokens without a parent, so that they outlive the token
+	// configured at config/vault.
+	Orphan bool `json:"orphan"`
+}
+
+// pathVaultTokenRolesList defines the circleci/vault-token-roles base path on
+// the backend.
+func (b *backend) pathVaultTokenRolesList() *framework.Path {
+	return &framework.Path{
+		Pattern: "vault-token-roles/?$",
+
+		HelpSynopsis:    "List the Vault token roles",
+		HelpDescription: "List the names of the Vault token roles configured at vault-token-roles/<name>.",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathVaultTokenRolesListRead)},
+		},
+	}
+}
+
+// pathVaultTokenRoles defines the circleci/vault-token-roles/:name path on the
+// backend.
+func (b *backend) pathVaultTokenRoles() *framework.Path {
+	return &framework.Path{
+		Pattern: "vault-token-roles/" + framework.GenericNameRegex("name"),
+
+		HelpSynopsis:    "Configure the Vault tokens minted into CircleCI contexts",
+		HelpDescription: "Configure the policies and TTLs of the Vault tokens that vault-token/<name> mints into CircleCI contexts.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the role.",
+				Required:    true,
+			},
+			"policies": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "The policies of the tokens. Required.",
+			},
+			"ttl": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "The TTL of the tokens and their leases. Defaults to the TTL Vault assigns.",
+			},
+			"period": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "Create periodic tokens with the given period, renewed with their leases. Takes precedence over ttl.",
+			},
+			"max_ttl": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "The explicit maximum TTL of the tokens and the maximum TTL of their leases.",
+			},
+			"orphan": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "Create orphan tokens, which outlive the token configured at config/vault. Defaults to true.",
+				Default:     true,
+			},
+		},
+
+		ExistenceCheck: b.pathVaultTokenRolesExists,
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.CreateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathVaultTokenRolesWrite)},
+			logical.UpdateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathVaultTokenRolesWrite)},
+			logical.ReadOperation:   &framework.PathOperation{Callback: withFieldValidator(b.pathVaultTokenRolesRead)},
+			logical.DeleteOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathVaultTokenRolesDelete)},
+		},
+	}
+}
+
+// pathVaultToken defines the circleci/vault-token/:role path on the backend.
+func (b *backend) pathVaultToken() *framework.Path {
+	return &framework.Path{
+		Pattern: orgPrefix + "vault-token/" + framework.GenericNameRegex("role"),
+
+		HelpSynopsis: "Mint a Vault token into an environment variable in a CircleCI context",
+		HelpDescription: "Create a Vault token as configured by the role at vault-token-roles/<role> and write it into " +
+			"the given environment variable. The token is revoked and the variable removed when the lease expires or " +
+			"is revoked. Renewing the lease renews the token.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"org": orgField(),
+			"role": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the Vault token role.",
+				Required:    true,
+			},
+			"context": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the CircleCI context to write the token into.",
+			},
+			"env": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the environment variable to write the token into.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{Callback: withFieldValidator(b.pathVaultTokenWrite)},
+		},
+	}
+}
+
+// pathVaultTokenRolesExists checks if the Vault token role exists.
+func (b *backend) pathVaultTokenRolesExists(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	r, err := b.VaultTokenRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+	return r != nil, nil
+}
+
+// pathVaultTokenRolesListRead corresponds to LIST circleci/vault-token-roles.
+func (b *backend) pathVaultTokenRolesListRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	roles, err := req.Storage.List(ctx, vaultTokenRolesPrefix)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to list Vault token roles: {{err}}", err)
+	}
+	return logical.ListResponse(roles), nil
+}
+
+// pathVaultTokenRolesRead corresponds to READ circleci/vault-token-roles/:name.
+func (b *backend) pathVaultTokenRolesRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	r, err := b.VaultTokenRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"policies": r.Policies,
+			"ttl":      int64(r.TTL.Seconds()),
+			"period":   int64(r.Period.Seconds()),
+			"max_ttl":  int64(r.MaxTTL.Seconds()),
+			"orphan":   r.Orphan,
+		},
+	}, nil
+}
+
+// pathVaultTokenRolesWrite corresponds to both CREATE and UPDATE
+// circleci/vault-token-roles/:name.
+func (b *backend) pathVaultTokenRolesWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	r, err := b.VaultTokenRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		r = &vaultTokenRole{Orphan: true}
+	}
+
+	if v, ok := d.GetOk("policies"); ok {
+		r.Policies = v.([]string)
+	}
+	if v, ok := d.GetOk("ttl"); ok {
+		r.TTL = time.Duration(v.(int)) * time.Second
+	}
+	if v, ok := d.GetOk("period"); ok {
+		r.Period = time.Duration(v.(int)) * time.Second
+	}
+	if v, ok := d.GetOk("max_ttl"); ok {
+		r.MaxTTL = time.Duration(v.(int)) * time.Second
+	}
+	if v, ok := d.GetOk("orphan"); ok {
+		r.Orphan = v.(bool)
+	}
+
+	// Without policies, the tokens would inherit the policies of the token
+	// configured at config/vault
+	if len(r.Policies) == 0 {
+		return nil, logical.CodedError(400, "policies are required")
+	}
+	if r.TTL < 0 || r.Period < 0 || r.MaxTTL < 0 {
+		return nil, logical.CodedError(400, "ttl, period and max_ttl must not be negative")
+	}
+
+	entry, err := logical.StorageEntryJSON(vaultTokenRolesPrefix+name, r)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to generate JSON Vault token role: {{err}}", err)
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, errwrap.Wrapf("failed to persist Vault token role to storage: {{err}}", err)
+	}
+	return nil, nil
+}
+
+// pathVaultTokenRolesDelete corresponds to DELETE
+// circleci/vault-token-roles/:name. Tokens minted with the role are kept until
+// their leases end.
+func (b *backend) pathVaultTokenRolesDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, vaultTokenRolesPrefix+d.Get("name").(string)); err != nil {
+		return nil, errwrap.Wrapf("failed to delete Vault token role from storage: {{err}}", err)
+	}
+	return nil, nil
+}
+
+// VaultTokenRole returns the named Vault token role, or nil if it does not
+// exist.
+func (b *backend) VaultTokenRole(ctx context.Context, s logical.Storage, name string) (*vaultTokenRole, error) {
+	entry, err := s.Get(ctx, vaultTokenRolesPrefix+name)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to get Vault token role from storage: {{err}}", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var r vaultTokenRole
+	if err := entry.DecodeJSON(&r); err != nil {
+		return nil, errwrap.Wrapf("failed to decode Vault token role: {{err}}", err)
+	}
+	return &r, nil
+}
+
+// pathVaultTokenWrite corresponds to PUT/POST circleci/vault-token/:role and
+// mints a Vault token into an environment variable.
+func (b *backend) pathVaultTokenWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("role").(string)
+	contextName := d.Get("context").(string)
+	envVariable := d.Get("env").(string)
+	org := orgName(d)
+	if contextName == "" || envVariable == "" {
+		return nil, logical.CodedError(400, "context and env are required")
+	}
+	if err := b.checkContextAccess(ctx, req, contextName); err != nil {
+		return nil, err
+	}
+
+	r, err := b.VaultTokenRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, logical.CodedError(404, fmt.Sprintf("Vault token role '%v' does not exist", name))
+	}
+
+	config, err := b.OrgConfig(ctx, req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+	foundContext, err := b.findContext(ctx, req, org, config, contextName)
+	if err != nil {
+		return nil, err
+	}
+	circleCIClient, err := b.CircleCIClient(req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+	vaultClient, err := b.VaultClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// The token is revoked again if the request fails before its lease is
+	// returned. The WAL entry is written before the token is created, and
+	// replaced by one with its accessor once it is known
+	requestID, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	mintWALID, err := framework.PutWAL(ctx, req.Storage, walTypeVaultToken, &walVaultToken{RequestID: requestID})
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to write WAL entry: {{err}}", err)
+	}
+
+	token, err := createVaultToken(ctx, vaultClient, name, r, foundContext.Name, envVariable, requestID)
+	if err != nil {
+		// Only a request Vault rejected did not create the token, otherwise
+		// the WAL looks it up by its metadata
+		var respErr *api.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode >= 400 && respErr.StatusCode < 500 {
+			if err := framework.DeleteWAL(ctx, req.Storage, mintWALID); err != nil {
+				b.Logger().Warn("Failed to delete WAL entry", "walID", mintWALID, "error", err)
+			}
+		}
+		return nil, err
+	}
+	accessor := token.Auth.Accessor
+
+	walID, err := framework.PutWAL(ctx, req.Storage, walTypeVaultToken, &walVaultToken{RequestID: requestID, Accessor: accessor})
+	if err != nil {
+		return nil, b.abortVaultToken(ctx, vaultClient, accessor, errwrap.Wrapf("failed to write WAL entry: {{err}}", err))
+	}
+	if err := framework.DeleteWAL(ctx, req.Storage, mintWALID); err != nil {
+		return nil, b.abortVaultToken(ctx, vaultClient, accessor, errwrap.Wrapf("failed to delete WAL entry: {{err}}", err))
+	}
+
+	written, err := circleCIClient.AddOrUpdateContextVariable(ctx, foundContext.ID, envVariable, token.Auth.ClientToken)
+	if err != nil {
+		return nil, b.abortVaultToken(ctx, vaultClient, accessor, err)
+	}
+	b.Logger().Debug("Vault token written to context", "context", foundContext.Name, "contextID", foundContext.ID, "envVariable", envVariable, "accessor", accessor)
+
+	// The token is never stored, only the metadata of the write
+	metadataOnly := *config
+	metadataOnly.StoreValues = false
+	if _, err := b.recordVariable(ctx, req, org, &metadataOnly, foundContext.Name, written, "", ""); err != nil {
+		return nil, errwrap.Wrapf("the token was written to CircleCI, but the variable could not be recorded: {{err}}", err)
+	}
+
+	ttl := r.TTL
+	if r.Period > 0 {
+		ttl = r.Period
+	}
+	resp := b.variableLease(secretTypeVaultToken, map[string]interface{}{
+		"contextEnvironmentVariable": written.Variable,
+		"accessor":                   accessor,
+		"policies":                   token.Auth.Policies,
+	}, org, foundContext.Name, written, 0, ttl, r.MaxTTL)
+	resp.Secret.InternalData["accessor"] = accessor
+
+	if err := framework.DeleteWAL(ctx, req.Storage, walID); err != nil {
+		return nil, errwrap.Wrapf("failed to delete WAL entry: {{err}}", err)
+	}
+	return resp, nil
+}
+
+// abortVaultToken revokes a token that could not be handed out, and returns
+// the error that caused it.
+func (b *backend) abortVaultToken(ctx context.Context, client *api.Client, accessor string, cause error) error {
+	if err := revokeVaultToken(ctx, client, accessor); err != nil {
+		b.Logger().Error("Failed to revoke Vault token, it is revoked by the WAL", "accessor", accessor, "error", err)
+	}
+	return cause
+}
+
+// createVaultToken creates a token as configured by the given role, with
+// metadata naming the variable it is written into and the request that
+// created it.
+func createVaultToken(ctx context.Context, client *api.Client, name string, r *vaultTokenRole, contextName, envVariable, requestID string) (*api.Secret, error) {
+	// Retrying a creation whose response was lost would create another token
+	shared := client
+	client, err := shared.Clone()
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to create Vault client: {{err}}", err)
+	}
+	client.SetToken(shared.Token())
+	client.SetHeaders(shared.Headers())
+	client.SetMaxRetries(0)
+
+	tokenRequest := &api.TokenCreateRequest{
+		Policies:       r.Policies,
+		TTL:            tokenDuration(r.TTL),
+		Period:         tokenDuration(r.Period),
+		ExplicitMaxTTL: tokenDuration(r.MaxTTL),
+		DisplayName:    "circleci-" + name,
+		Metadata: map[string]string{
+			"circleci_role":    name,
+			"circleci_context": contextName,
+			"circleci_env":     envVariable,
+			"circleci_request": requestID,
+		},
+	}
+
+	var token *api.Secret
+	if r.Orphan {
+		token, err = client.Auth().Token().CreateOrphanWithContext(ctx, tokenRequest)
+	} else {
+		token, err = client.Auth().Token().CreateWithContext(ctx, tokenRequest)
+	}
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to create Vault token: {{err}}", err)
+	}
+	if token == nil || token.Auth == nil {
+		return nil, errors.New("failed to create Vault token: empty response")
+	}
+	return token, nil
+}
+
+// revokeVaultToken revokes the token with the given accessor. Tokens that
+// expired or were revoked already are ignored.
+func revokeVaultToken(ctx context.Context, client *api.Client, accessor string) error {
+	err := client.Auth().Token().RevokeAccessorWithContext(ctx, accessor)
+	var respErr *api.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == 400 {
+		// Vault rejects unknown accessors as invalid
+		return nil
+	}
+	if err != nil {
+		return errwrap.Wrapf("failed to revoke Vault token: {{err}}", err)
+	}
+	return nil
+}
+
+// findVaultTokens returns the accessors of the tokens created by the request
+// with the given ID, as named by their circleci_request metadata.
+func findVaultTokens(ctx context.Context, client *api.Client, requestID string) ([]string, error) {
+	list, err := client.Logical().ListWithContext(ctx, "auth/token/accessors")
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to list Vault token accessors: {{err}}", err)
+	}
+	if list == nil {
+		return nil, nil
+	}
+	keys, _ := list.Data["keys"].([]interface{})
+
+	var accessors []string
+	for _, key := range keys {
+		accessor, _ := key.(string)
+		token, err := client.Auth().Token().LookupAccessorWithContext(ctx, accessor)
+		var respErr *api.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == 400 {
+			// The token expired or was revoked since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, errwrap.Wrapf("failed to look up Vault token: {{err}}", err)
+		}
+		if token == nil {
+			continue
+		}
+		if meta, _ := token.Data["meta"].(map[string]interface{}); meta["circleci_request"] == requestID {
+			accessors = append(accessors, accessor)
+		}
+	}
+	return accessors, nil
+}
+
+// tokenDuration formats a duration for a token creation request, where an
+// empty value is the default.
+func tokenDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64(d.Seconds()), 10) + "s"
+}
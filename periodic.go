@@ -0,0 +1,40 @@
+package circleci
+
+import (
+	"context"
+	"errors"
+
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// periodicFunc is called by Vault about once a minute. It only runs on the
+// node that may write to the storage of the mount, i.e. the active node of
+// the primary cluster, or of any cluster for local mounts.
+func (b *backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	if !b.writableNode() {
+		return nil
+	}
+
+	var errs []error
+	if err := b.rotateDue(ctx, req.Storage); err != nil {
+		errs = append(errs, err)
+	}
+	if err := b.enforceContexts(ctx, req.Storage); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return errors.New(joinErrors(errs))
+	}
+	return nil
+}
+
+// writableNode reports whether this node may write to the storage of the
+// mount.
+func (b *backend) writableNode() bool {
+	state := b.System().ReplicationState()
+	if state.HasState(consts.ReplicationPerformanceStandby | consts.ReplicationDRSecondary) {
+		return false
+	}
+	return b.System().LocalMount() || !state.HasState(consts.ReplicationPerformanceSecondary)
+}
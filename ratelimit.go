@@ -0,0 +1,127 @@
+package circleci
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket that limits the rate of requests to CircleCI.
+// Requests that find the bucket empty queue for a token, as long as the token
+// becomes available before the deadline of their context.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	tokens  float64
+	last    time.Time
+	waiting int
+}
+
+// newRateLimiter returns the rate limiter of the given configuration, or nil
+// if requests are not limited.
+func newRateLimiter(config *Config) *rateLimiter {
+	if config.RateLimit <= 0 {
+		return nil
+	}
+	burst := rateLimitBurst(config)
+	return &rateLimiter{
+		rate:   config.RateLimit,
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// rateLimitBurst returns the configured burst, defaulting to one second worth
+// of requests.
+func rateLimitBurst(config *Config) int {
+	if config.RateLimitBurst > 0 {
+		return config.RateLimitBurst
+	}
+	return int(math.Max(1, math.Ceil(config.RateLimit)))
+}
+
+// rateLimitError is returned for requests that cannot get a token before the
+// deadline of their context.
+type rateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("client-side rate limit for CircleCI exceeded, next request possible in %s", e.RetryAfter.Round(time.Millisecond))
+}
+
+// advance refills the bucket up to now. l.mu must be held.
+func (l *rateLimiter) advance(now time.Time) {
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = math.Min(float64(l.burst), l.tokens+elapsed.Seconds()*l.rate)
+		l.last = now
+	}
+}
+
+// Wait takes a token from the bucket, waiting for it if necessary. A nil
+// limiter never waits.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.advance(now)
+	l.tokens--
+	if l.tokens >= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+
+	// The token is reserved, but only becomes available after delay
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	if deadline, ok := ctx.Deadline(); ok && deadline.Sub(now) < delay {
+		l.tokens++
+		l.mu.Unlock()
+		return &rateLimitError{RetryAfter: delay}
+	}
+	l.waiting++
+	l.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		l.mu.Lock()
+		l.waiting--
+		l.mu.Unlock()
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.waiting--
+		l.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Status returns the current state of the bucket.
+func (l *rateLimiter) Status() map[string]interface{} {
+	if l == nil {
+		return map[string]interface{}{
+			"enabled": false,
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advance(time.Now())
+	return map[string]interface{}{
+		"enabled":          true,
+		"rate":             l.rate,
+		"burst":            l.burst,
+		"available_tokens": math.Max(0, math.Floor(l.tokens*100)/100),
+		"waiting":          l.waiting,
+	}
+}
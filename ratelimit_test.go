@@ -0,0 +1,167 @@
+package circleci
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+
+		l := newRateLimiter(&Config{})
+		if l != nil {
+			t.Fatalf("expected no limiter, got %v", l)
+		}
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if v := l.Status()["enabled"]; v != false {
+			t.Errorf("expected limiter to be disabled")
+		}
+	})
+
+	t.Run("default_burst", func(t *testing.T) {
+		t.Parallel()
+
+		if v, exp := newRateLimiter(&Config{RateLimit: 2.5}).burst, 3; v != exp {
+			t.Errorf("expected %d to be %d", v, exp)
+		}
+		if v, exp := newRateLimiter(&Config{RateLimit: 0.1}).burst, 1; v != exp {
+			t.Errorf("expected %d to be %d", v, exp)
+		}
+	})
+
+	t.Run("queues_until_deadline", func(t *testing.T) {
+		t.Parallel()
+
+		l := newRateLimiter(&Config{RateLimit: 10, RateLimitBurst: 2})
+		for i := 0; i < 2; i++ {
+			if err := l.Wait(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The next token is available after 100ms
+		start := time.Now()
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d < 50*time.Millisecond {
+			t.Errorf("expected to wait for a token, waited %s", d)
+		}
+
+		// A deadline before the next token fails immediately
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		var rateLimitErr *rateLimitError
+		if err := l.Wait(ctx); !errors.As(err, &rateLimitErr) {
+			t.Fatalf("expected rate limit error, got %v", err)
+		}
+		if rateLimitErr.RetryAfter <= 0 {
+			t.Errorf("expected a retry delay")
+		}
+
+		status := l.Status()
+		if v, exp := status["burst"], 2; v != exp {
+			t.Errorf("expected %v to be %v", v, exp)
+		}
+		if v, exp := status["waiting"], 0; v != exp {
+			t.Errorf("expected %v to be %v", v, exp)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		t.Parallel()
+
+		l := newRateLimiter(&Config{RateLimit: 1})
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- l.Wait(ctx) }()
+		for l.Status()["waiting"] != 1 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context canceled, got %v", err)
+		}
+		if v, exp := l.Status()["waiting"], 0; v != exp {
+			t.Errorf("expected %v to be %v", v, exp)
+		}
+	})
+}
+
+func TestBackend_RateLimit(t *testing.T) {
+	t.Parallel()
+
+	b, storage, server := testBackendWithCircleCI(t)
+	server.AddContext("my-context")
+	ctx := context.Background()
+
+	if _, err := b.HandleRequest(ctx, &logical.Request{
+		Storage:   storage,
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"rate-limit":       0.5,
+			"rate-limit-burst": 1,
+			"verify":           false,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(ctx context.Context) (*logical.Response, error) {
+		return b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.ListOperation,
+			Path:      "context/",
+			Data:      map[string]interface{}{"refresh": true},
+		})
+	}
+	if _, err := list(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bucket is empty, and the next token is not available within the
+	// deadline of the request
+	deadlineCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err := list(deadlineCtx)
+	if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 429 || !strings.Contains(err.Error(), "retry after 2s") {
+		t.Errorf("expected 429 naming the retry delay, got %v", err)
+	}
+	if v, exp := server.Requests("GET context"), 1; v != exp {
+		t.Errorf("expected %d requests, got %d", exp, v)
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Storage:   storage,
+		Operation: logical.ReadOperation,
+		Path:      "config",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := resp.Data["status"].(map[string]interface{})
+	if v, exp := status["enabled"], true; v != exp {
+		t.Errorf("expected %v to be %v", v, exp)
+	}
+	if v, exp := status["rate"], 0.5; v != exp {
+		t.Errorf("expected %v to be %v", v, exp)
+	}
+	if v := status["available_tokens"].(float64); v >= 1 {
+		t.Errorf("expected the bucket to be empty, got %v tokens", v)
+	}
+}
@@ -0,0 +1,116 @@
+package circleci
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// Logger returns the backend's logger wrapped in a redaction layer, so that
+// credentials never end up in the plugin logs. It shadows the logger of the
+// embedded framework.Backend.
+func (b *backend) Logger() hclog.Logger {
+	return &redactingLogger{Logger: b.Backend.Logger()}
+}
+
+// tokenFingerprint returns a non-reversible fingerprint of the given token,
+// consisting of its last four characters and a truncated SHA-256 hash. Short
+// tokens only get the hash.
+func tokenFingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:])[:16]
+	if len(token) < 16 {
+		return fmt.Sprintf("sha256:%s", hash)
+	}
+	return fmt.Sprintf("...%s (sha256:%s)", token[len(token)-4:], hash)
+}
+
+// redactingLogger is a hclog.Logger that redacts sensitive values from the
+// key/value pairs before handing them to the wrapped logger.
+type redactingLogger struct {
+	hclog.Logger
+}
+
+func (l *redactingLogger) Log(level hclog.Level, msg string, args ...interface{}) {
+	l.Logger.Log(level, msg, redactArgs(args)...)
+}
+
+func (l *redactingLogger) Trace(msg string, args ...interface{}) {
+	l.Logger.Trace(msg, redactArgs(args)...)
+}
+
+func (l *redactingLogger) Debug(msg string, args ...interface{}) {
+	l.Logger.Debug(msg, redactArgs(args)...)
+}
+
+func (l *redactingLogger) Info(msg string, args ...interface{}) {
+	l.Logger.Info(msg, redactArgs(args)...)
+}
+
+func (l *redactingLogger) Warn(msg string, args ...interface{}) {
+	l.Logger.Warn(msg, redactArgs(args)...)
+}
+
+func (l *redactingLogger) Error(msg string, args ...interface{}) {
+	l.Logger.Error(msg, redactArgs(args)...)
+}
+
+func (l *redactingLogger) With(args ...interface{}) hclog.Logger {
+	return &redactingLogger{Logger: l.Logger.With(redactArgs(args)...)}
+}
+
+func (l *redactingLogger) Named(name string) hclog.Logger {
+	return &redactingLogger{Logger: l.Logger.Named(name)}
+}
+
+func (l *redactingLogger) ResetNamed(name string) hclog.Logger {
+	return &redactingLogger{Logger: l.Logger.ResetNamed(name)}
+}
+
+// redactArgs returns a copy of the given key/value pairs in which
+// configurations are replaced by their redacted form and the values of keys
+// that look like credentials are replaced by their fingerprint.
+func redactArgs(args []interface{}) []interface{} {
+	redacted := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case *Config:
+			redacted[i] = v.Redacted()
+			continue
+		case Config:
+			redacted[i] = *v.Redacted()
+			continue
+		}
+
+		if i%2 == 1 {
+			if key, ok := args[i-1].(string); ok && isSensitiveKey(key) {
+				if s, ok := arg.(string); ok {
+					redacted[i] = tokenFingerprint(s)
+				} else {
+					redacted[i] = "<redacted>"
+				}
+				continue
+			}
+		}
+		redacted[i] = arg
+	}
+	return redacted
+}
+
+// isSensitiveKey reports whether the log key names a credential.
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range []string{"token", "secret", "password", "value"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package circleci
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTokenFingerprint(t *testing.T) {
+	t.Parallel()
+
+	if v := tokenFingerprint(""); v != "" {
+		t.Errorf("expected %q to be empty", v)
+	}
+
+	token := "0123456789abcdef0123456789abcdef"
+	v := tokenFingerprint(token)
+	if !strings.HasPrefix(v, "...cdef") {
+		t.Errorf("expected %q to start with the last four characters", v)
+	}
+	if strings.Contains(v, token[:8]) {
+		t.Errorf("expected %q to not contain the token", v)
+	}
+	if v != tokenFingerprint(token) {
+		t.Errorf("expected fingerprint to be stable")
+	}
+
+	if v := tokenFingerprint("short"); strings.Contains(v, "hort") {
+		t.Errorf("expected %q to not reveal short tokens", v)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	t.Parallel()
+
+	token := "0123456789abcdef0123456789abcdef"
+	args := redactArgs([]interface{}{
+		"config", &Config{APIToken: token, OrgId: "my-org-id"},
+		"api-token", token,
+		"context", "my-context",
+	})
+
+	if c := args[1].(*Config); c.APIToken == token || c.OrgId != "my-org-id" {
+		t.Errorf("expected config to be redacted, got %#v", c)
+	}
+	if v := args[3].(string); v == token {
+		t.Errorf("expected token to be redacted")
+	}
+	if v := args[5].(string); v != "my-context" {
+		t.Errorf("expected %q to be %q", v, "my-context")
+	}
+}
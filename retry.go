@@ -0,0 +1,135 @@
+package circleci
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// retryPolicy decides whether and when a failed request to CircleCI is
+// retried.
+type retryPolicy struct {
+	MaxAttempts int
+	BackoffBase time.Duration
+	BackoffCap  time.Duration
+	Jitter      bool
+}
+
+// newRetryPolicy returns the retry policy of the given configuration.
+func newRetryPolicy(config *Config) retryPolicy {
+	return retryPolicy{
+		MaxAttempts: config.RetryMaxAttempts,
+		BackoffBase: config.RetryBackoffBase,
+		BackoffCap:  config.RetryBackoffCap,
+		Jitter:      config.RetryJitter,
+	}
+}
+
+// idempotentMethods are the HTTP methods that are retried automatically.
+// Creating a context is a POST and is never retried, as a lost response does
+// not tell whether the context was created.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// attempts returns the number of attempts for the given request.
+func (p retryPolicy) attempts(req *http.Request) int {
+	if p.MaxAttempts <= 1 || !idempotentMethods[req.Method] {
+		return 1
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// delay returns the delay before the given retry, starting at 1, after a
+// request failed with err. It returns false if the request should not be
+// retried.
+func (p retryPolicy) delay(retry int, err error) (time.Duration, bool) {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		default:
+			return 0, false
+		}
+
+		// A Retry-After beyond the cap is not waited for, so that the caller
+		// gets to see it
+		if apiErr.RetryAfter > 0 {
+			return apiErr.RetryAfter, apiErr.RetryAfter <= p.BackoffCap
+		}
+	} else if permanentError(err) {
+		return 0, false
+	}
+
+	backoff := p.BackoffBase
+	for i := 1; i < retry && backoff < p.BackoffCap; i++ {
+		backoff *= 2
+	}
+	if backoff > p.BackoffCap {
+		backoff = p.BackoffCap
+	}
+	if p.Jitter && backoff > 0 {
+		backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	}
+	return backoff, true
+}
+
+// permanentError reports whether the given transport error does not go away
+// by retrying, like a canceled request or an untrusted certificate.
+func permanentError(err error) bool {
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var certificateInvalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	return errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &certificateInvalidErr) ||
+		errors.As(err, &hostnameErr)
+}
+
+// retryCounter counts the retries of the requests to CircleCI made on behalf
+// of one Vault request.
+type retryCounter struct {
+	n int64
+}
+
+type retryCounterKey struct{}
+
+// withRetryCounter returns a copy of ctx that carries the given counter.
+func withRetryCounter(ctx context.Context, counter *retryCounter) context.Context {
+	if counter == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, retryCounterKey{}, counter)
+}
+
+// retryCounterFrom returns the counter carried by ctx, if any.
+func retryCounterFrom(ctx context.Context) *retryCounter {
+	counter, _ := ctx.Value(retryCounterKey{}).(*retryCounter)
+	return counter
+}
+
+func (c *retryCounter) add() {
+	if c != nil {
+		atomic.AddInt64(&c.n, 1)
+	}
+}
+
+func (c *retryCounter) count() int64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.n)
+}
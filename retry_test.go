@@ -0,0 +1,193 @@
+package circleci
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	t.Parallel()
+
+	p := retryPolicy{
+		MaxAttempts: 5,
+		BackoffBase: time.Second,
+		BackoffCap:  5 * time.Second,
+	}
+	transportErr := errors.New("connection reset by peer")
+
+	cases := []struct {
+		name  string
+		retry int
+		err   error
+		exp   time.Duration
+		ok    bool
+	}{
+		{"first", 1, transportErr, time.Second, true},
+		{"doubles", 3, transportErr, 4 * time.Second, true},
+		{"capped", 10, transportErr, 5 * time.Second, true},
+		{"rate_limited", 1, &apiError{StatusCode: 429}, time.Second, true},
+		{"retry_after", 1, &apiError{StatusCode: 429, RetryAfter: 3 * time.Second}, 3 * time.Second, true},
+		{"retry_after_beyond_cap", 1, &apiError{StatusCode: 429, RetryAfter: time.Minute}, time.Minute, false},
+		{"server_error", 1, &apiError{StatusCode: 503}, time.Second, true},
+		{"not_found", 1, &apiError{StatusCode: 404}, 0, false},
+		{"canceled", 1, context.Canceled, 0, false},
+	}
+	for _, tc := range cases {
+		delay, ok := p.delay(tc.retry, tc.err)
+		if delay != tc.exp || ok != tc.ok {
+			t.Errorf("%s: expected (%v, %t), got (%v, %t)", tc.name, tc.exp, tc.ok, delay, ok)
+		}
+	}
+
+	p.Jitter = true
+	for i := 0; i < 100; i++ {
+		if delay, _ := p.delay(2, transportErr); delay < time.Second || delay > 2*time.Second {
+			t.Fatalf("expected jittered delay between 1s and 2s, got %v", delay)
+		}
+	}
+}
+
+func TestRetryPolicy_Attempts(t *testing.T) {
+	t.Parallel()
+
+	p := retryPolicy{MaxAttempts: 3}
+	for method, exp := range map[string]int{
+		http.MethodGet:    3,
+		http.MethodPut:    3,
+		http.MethodDelete: 3,
+		http.MethodPost:   1,
+	} {
+		req, err := http.NewRequest(method, "https://circleci.com/api/v2/context", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := p.attempts(req); v != exp {
+			t.Errorf("%s: expected %d to be %d", method, v, exp)
+		}
+	}
+}
+
+func TestBackend_Retry(t *testing.T) {
+	t.Parallel()
+
+	// failFirst fails the first n requests for the given method and path
+	failFirst := func(n int, status int, method, path string) func(w http.ResponseWriter, r *http.Request) bool {
+		var mu sync.Mutex
+		return func(w http.ResponseWriter, r *http.Request) bool {
+			if r.Method != method || !strings.HasSuffix(r.URL.Path, path) {
+				return false
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if n == 0 {
+				return false
+			}
+			n--
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(status)
+			w.Write([]byte(`{"message": "injected"}`))
+			return true
+		}
+	}
+
+	t.Run("rate_limited_pages", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.pageSize = 1
+		server.AddContext("context-1")
+		server.AddContext("context-2")
+		server.SetIntercept(failFirst(2, http.StatusTooManyRequests, http.MethodGet, "/context"))
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ListOperation,
+			Path:      "context/",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, exp := len(resp.Data["keys"].([]string)), 2; v != exp {
+			t.Errorf("expected %d to be %d", v, exp)
+		}
+		if v, exp := server.Requests("GET context"), 4; v != exp {
+			t.Errorf("expected %d requests, got %d", exp, v)
+		}
+		if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "retried 2 time(s)") {
+			t.Errorf("expected a warning about 2 retries, got %v", resp.Warnings)
+		}
+	})
+
+	t.Run("gives_up", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.SetIntercept(failFirst(10, http.StatusTooManyRequests, http.MethodGet, "/context"))
+
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ListOperation,
+			Path:      "context/",
+		})
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 429 {
+			t.Errorf("expected 429, got %v", err)
+		}
+		if v, exp := server.Requests("GET context"), defaultRetryMaxAttempts; v != exp {
+			t.Errorf("expected %d requests, got %d", exp, v)
+		}
+	})
+
+	t.Run("idempotent_write", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		id := server.AddContext("my-context")
+		server.SetIntercept(failFirst(1, http.StatusServiceUnavailable, http.MethodPut, "/environment-variable/FOO"))
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "context/my-context/FOO",
+			Data:      map[string]interface{}{"value": "bar"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, exp := server.Value("my-context", "FOO"), "bar"; v != exp {
+			t.Errorf("expected %q to be %q", v, exp)
+		}
+		if v, exp := server.Requests("PUT context/"+id+"/environment-variable/FOO"), 2; v != exp {
+			t.Errorf("expected %d requests, got %d", exp, v)
+		}
+		if len(resp.Warnings) != 1 {
+			t.Errorf("expected a warning about the retry, got %v", resp.Warnings)
+		}
+	})
+
+	t.Run("create_not_retried", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.SetIntercept(failFirst(1, http.StatusServiceUnavailable, http.MethodPost, "/context"))
+
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "context/",
+			Data:      map[string]interface{}{"context": "my-context"},
+		})
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 502 {
+			t.Errorf("expected 502, got %v", err)
+		}
+		if v, exp := server.Requests("POST context"), 1; v != exp {
+			t.Errorf("expected %d requests, got %d", exp, v)
+		}
+	})
+}
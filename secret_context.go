@@ -0,0 +1,234 @@
+package circleci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	circleci "github.com/bobthebuilderberlin/go-circleci"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// secretTypeContext is the type of the leases of ephemeral contexts.
+const secretTypeContext = "context"
+
+// walTypeContext is the kind of the WAL entries of ephemeral contexts that
+// are being created.
+const walTypeContext = "context"
+
+// walRollbackMinAge is the age of WAL entries after which their creation is
+// rolled back. It exceeds the time a request to CircleCI may take.
+const walRollbackMinAge = 5 * time.Minute
+
+// walContext is the WAL entry of an ephemeral context that is being created.
+// If the request fails before the lease is returned, the context is deleted
+// again.
+type walContext struct {
+	Org  string `json:"org"`
+	Name string `json:"name"`
+
+	// CreatedAt is the time before the context was created, and Deadline the
+	// time the request to CircleCI times out. Contexts with the same name
+	// created outside of this window were not created by the request, and are
+	// kept.
+	CreatedAt time.Time `json:"created_at"`
+	Deadline  time.Time `json:"deadline,omitempty"`
+}
+
+// secretContext defines the leases of ephemeral contexts, which delete the
+// context when they are revoked or expire.
+func (b *backend) secretContext() *framework.Secret {
+	return &framework.Secret{
+		Type: secretTypeContext,
+		Fields: map[string]*framework.FieldSchema{
+			"context": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the ephemeral CircleCI context.",
+			},
+			"context_id": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The ID of the ephemeral CircleCI context.",
+			},
+		},
+		Renew:  b.secretRenew,
+		Revoke: b.secretContextRevoke,
+	}
+}
+
+// contextTTLField returns the schema of the field that creates a context as
+// an ephemeral context with the given TTL.
+func contextTTLField() *framework.FieldSchema {
+	return &framework.FieldSchema{
+		Type:        framework.TypeDurationSecond,
+		Description: "Create an ephemeral context, deleted when its lease expires or is revoked. The TTL of the lease.",
+	}
+}
+
+// contextMaxTTLField returns the schema of the maximum TTL of the lease of an
+// ephemeral context.
+func contextMaxTTLField() *framework.FieldSchema {
+	return &framework.FieldSchema{
+		Type:        framework.TypeDurationSecond,
+		Description: "The maximum TTL the lease of an ephemeral context can be renewed to. Defaults to the mount's maximum.",
+	}
+}
+
+// leaseTTLs returns the ttl and max_ttl of a request that creates a leased
+// secret. A zero ttl creates no lease.
+func leaseTTLs(d *framework.FieldData) (time.Duration, time.Duration, error) {
+	ttl := time.Duration(d.Get("ttl").(int)) * time.Second
+	maxTTL := time.Duration(d.Get("max_ttl").(int)) * time.Second
+	if ttl < 0 || maxTTL < 0 || (maxTTL > 0 && ttl == 0) {
+		return 0, 0, logical.CodedError(400, "ttl and max_ttl must not be negative, and max_ttl requires ttl")
+	}
+	return ttl, maxTTL, nil
+}
+
+// secretRenew extends a lease by the TTL it was created with, up to its
+// maximum TTL.
+func (b *backend) secretRenew(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	ttl, _ := req.Secret.InternalData["ttl"].(float64)
+	maxTTL, _ := req.Secret.InternalData["max_ttl"].(float64)
+
+	resp := &logical.Response{Secret: req.Secret}
+	resp.Secret.TTL = time.Duration(ttl) * time.Second
+	resp.Secret.MaxTTL = time.Duration(maxTTL) * time.Second
+	return resp, nil
+}
+
+// secretContextRevoke deletes an ephemeral context. Contexts that were
+// already deleted are ignored.
+func (b *backend) secretContextRevoke(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	org, _ := req.Secret.InternalData["org"].(string)
+	contextName, _ := req.Secret.InternalData["context"].(string)
+	contextID, _ := req.Secret.InternalData["context_id"].(string)
+	if org == "" || contextID == "" {
+		return nil, errors.New("lease is missing the organization or ID of the context")
+	}
+
+	if err := b.deleteEphemeralContext(ctx, req.Storage, org, contextName, contextID); err != nil {
+		return nil, err
+	}
+	b.Logger().Debug("Ephemeral context deleted", "org", org, "context", contextName, "contextID", contextID)
+	return nil, nil
+}
+
+// deleteEphemeralContext deletes the given context and everything Vault
+// keeps about it. Contexts that were already deleted are ignored.
+func (b *backend) deleteEphemeralContext(ctx context.Context, s logical.Storage, org, contextName, contextID string) error {
+	circleCIClient, err := b.CircleCIClient(s, org)
+	if err != nil {
+		return err
+	}
+	if err := circleCIClient.Contexts.Delete(ctx, contextID); err != nil && !errors.Is(err, circleci.ErrNotFound) {
+		return err
+	}
+	b.invalidateContexts(ctx, s, org)
+	return b.deleteContextState(ctx, s, org, contextName)
+}
+
+// contextLease returns the response of a created ephemeral context, which
+// carries its lease.
+func (b *backend) contextLease(org string, createdContext *circleci.Context, ttl, maxTTL time.Duration) *logical.Response {
+	resp := b.Secret(secretTypeContext).Response(map[string]interface{}{
+		"context":    createdContext,
+		"context_id": createdContext.ID,
+	}, map[string]interface{}{
+		"org":        org,
+		"context":    createdContext.Name,
+		"context_id": createdContext.ID,
+		"ttl":        ttl.Seconds(),
+		"max_ttl":    maxTTL.Seconds(),
+	})
+	resp.Secret.TTL = ttl
+	resp.Secret.MaxTTL = maxTTL
+	return resp
+}
+
+// walRollback rolls back the creations that failed before their lease was
+// returned.
+func (b *backend) walRollback(ctx context.Context, req *logical.Request, kind string, data interface{}) error {
+	switch kind {
+	case walTypeContext:
+		return b.contextWALRollback(ctx, req, data)
+	case walTypeVaultToken:
+		return b.vaultTokenWALRollback(ctx, req, data)
+	default:
+		return fmt.Errorf("unknown WAL entry kind %q", kind)
+	}
+}
+
+// createRejected reports whether CircleCI rejected the creation of a context,
+// so that the request certainly did not create it.
+func createRejected(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.StatusCode >= 400 && apiErr.StatusCode < 500
+}
+
+// deleteContextWALs deletes the WAL entries of the contexts of the given name.
+// Once a context of the name was created, the contexts of earlier entries are
+// gone, and rolling them back would delete the new context instead.
+func (b *backend) deleteContextWALs(ctx context.Context, s logical.Storage, org, name string) error {
+	ids, err := framework.ListWAL(ctx, s)
+	if err != nil {
+		return errwrap.Wrapf("failed to list WAL entries: {{err}}", err)
+	}
+	for _, id := range ids {
+		wal, err := framework.GetWAL(ctx, s, id)
+		if err != nil {
+			return errwrap.Wrapf("failed to read WAL entry: {{err}}", err)
+		}
+		if wal == nil || wal.Kind != walTypeContext {
+			continue
+		}
+		data, _ := wal.Data.(map[string]interface{})
+		if data["org"] != org || data["name"] != name {
+			continue
+		}
+		if err := framework.DeleteWAL(ctx, s, id); err != nil {
+			return errwrap.Wrapf("failed to delete WAL entry: {{err}}", err)
+		}
+	}
+	return nil
+}
+
+// contextWALRollback deletes the context of the given WAL entry, if it was
+// created by the request that wrote the entry.
+func (b *backend) contextWALRollback(ctx context.Context, req *logical.Request, data interface{}) error {
+	// The entry is decoded from JSON into a map
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	var entry walContext
+	if err := json.Unmarshal(encoded, &entry); err != nil {
+		return errwrap.Wrapf("failed to decode WAL entry: {{err}}", err)
+	}
+
+	config, err := b.OrgConfig(ctx, req.Storage, entry.Org)
+	if err != nil {
+		return err
+	}
+	b.invalidateContexts(ctx, req.Storage, entry.Org)
+	foundContext, err := b.findContext(ctx, req, entry.Org, config, entry.Name)
+	if coded, ok := err.(logical.HTTPCodedError); ok && coded.Code() == 404 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Allow for clock skew between Vault and CircleCI
+	if foundContext.CreatedAt.Before(entry.CreatedAt.Add(-time.Minute)) {
+		return nil
+	}
+	if !entry.Deadline.IsZero() && foundContext.CreatedAt.After(entry.Deadline.Add(time.Minute)) {
+		return nil
+	}
+
+	b.Logger().Warn("Deleting ephemeral context whose lease was never returned", "org", entry.Org, "context", entry.Name, "contextID", foundContext.ID)
+	return b.deleteEphemeralContext(ctx, req.Storage, entry.Org, foundContext.Name, foundContext.ID)
+}
@@ -0,0 +1,173 @@
+package circleci
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestBackend_EphemeralContext(t *testing.T) {
+	t.Parallel()
+
+	b, storage, server := testBackendWithCircleCI(t)
+	ctx := context.Background()
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Storage:   storage,
+		Operation: logical.UpdateOperation,
+		Path:      "context/",
+		Data:      map[string]interface{}{"context": "pr-1234", "ttl": "1h", "max_ttl": "24h"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Secret == nil || resp.Secret.TTL != time.Hour || resp.Secret.MaxTTL != 24*time.Hour {
+		t.Fatalf("expected a lease of 1h up to 24h, got %#v", resp.Secret)
+	}
+	if v, exp := resp.Data["context_id"], server.Context("pr-1234").ID; v != exp {
+		t.Errorf("expected %q to be %q", v, exp)
+	}
+	if keys, err := framework.ListWAL(ctx, storage); err != nil || len(keys) != 0 {
+		t.Errorf("expected the WAL entry to be deleted, got %q, %v", keys, err)
+	}
+
+	secret := resp.Secret
+	secret.IssueTime = time.Now()
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Storage:   storage,
+		Operation: logical.RenewOperation,
+		Secret:    secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Secret.TTL != time.Hour {
+		t.Errorf("expected the lease to be extended by 1h, got %v", resp.Secret.TTL)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.RevokeOperation,
+			Secret:    secret,
+		}); err != nil {
+			t.Fatalf("revoke %d: %v", i, err)
+		}
+	}
+	if server.Context("pr-1234") != nil {
+		t.Errorf("expected the context to be deleted")
+	}
+}
+
+func TestBackend_EphemeralContextRetry(t *testing.T) {
+	t.Parallel()
+
+	for _, status := range []int{409, 500} {
+		status := status
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			t.Parallel()
+
+			b, storage, server := testBackendWithCircleCI(t)
+			ctx := context.Background()
+			create := func() error {
+				_, err := b.HandleRequest(ctx, &logical.Request{
+					Storage:   storage,
+					Operation: logical.UpdateOperation,
+					Path:      "context/",
+					Data:      map[string]interface{}{"context": "pr-1234", "ttl": "1h"},
+				})
+				return err
+			}
+
+			server.SetIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Method != http.MethodPost || r.URL.Path != "/api/v2/context" {
+					return false
+				}
+				w.WriteHeader(status)
+				fmt.Fprint(w, `{"message": "failed"}`)
+				return true
+			})
+			if err := create(); err == nil {
+				t.Fatal("expected the creation to fail")
+			}
+			keys, err := framework.ListWAL(ctx, storage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The context may have been created by a failed request CircleCI
+			// did not reject
+			if exp := map[int]int{409: 0, 500: 1}[status]; len(keys) != exp {
+				t.Errorf("expected %d WAL entries, got %q", exp, keys)
+			}
+
+			server.SetIntercept(nil)
+			if err := create(); err != nil {
+				t.Fatal(err)
+			}
+			if keys, err := framework.ListWAL(ctx, storage); err != nil || len(keys) != 0 {
+				t.Errorf("expected the WAL entries to be deleted, got %q, %v", keys, err)
+			}
+
+			// A rollback of the failed request leaves the leased context alone
+			if _, err := b.HandleRequest(ctx, &logical.Request{
+				Storage:   storage,
+				Operation: logical.RollbackOperation,
+				Data:      map[string]interface{}{"immediate": true},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if server.Context("pr-1234") == nil {
+				t.Errorf("expected the leased context to be kept")
+			}
+		})
+	}
+}
+
+func TestBackend_ContextWALRollback(t *testing.T) {
+	t.Parallel()
+
+	b, storage, server := testBackendWithCircleCI(t)
+	ctx := context.Background()
+
+	server.AddContext("existing")
+	server.AddContext("orphaned")
+	now := time.Now().UTC()
+
+	server.AddContext("recreated")
+
+	for name, walCreatedAt := range map[string]time.Time{
+		// Created two minutes before the WAL entry, i.e. by someone else
+		"existing":      now.Add(2 * time.Minute),
+		"orphaned":      now.Add(-time.Second),
+		"never-created": now,
+		// Created ten minutes after the WAL entry, long after its request
+		"recreated": now.Add(-10 * time.Minute),
+	} {
+		// WAL entries are decoded from JSON
+		data := map[string]interface{}{
+			"org":        defaultOrg,
+			"name":       name,
+			"created_at": walCreatedAt.Format(time.RFC3339Nano),
+			"deadline":   walCreatedAt.Add(time.Minute).Format(time.RFC3339Nano),
+		}
+		if err := b.walRollback(ctx, &logical.Request{Storage: storage}, walTypeContext, data); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	if server.Context("orphaned") != nil {
+		t.Errorf("expected the orphaned context to be deleted")
+	}
+	if server.Context("existing") == nil {
+		t.Errorf("expected the context created before the WAL entry to be kept")
+	}
+	if server.Context("recreated") == nil {
+		t.Errorf("expected the context created after the request of the WAL entry to be kept")
+	}
+}
@@ -0,0 +1,140 @@
+package circleci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	circleci "github.com/bobthebuilderberlin/go-circleci"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// secretTypeVariable is the type of the leases of time-limited environment
+// variables.
+const secretTypeVariable = "variable"
+
+// secretVariable defines the leases of time-limited environment variables,
+// which remove the variable or restore its previous value when they are
+// revoked or expire.
+func (b *backend) secretVariable() *framework.Secret {
+	return &framework.Secret{
+		Type: secretTypeVariable,
+		Fields: map[string]*framework.FieldSchema{
+			"contextEnvironmentVariable": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the time-limited environment variable.",
+			},
+		},
+		Renew:  b.secretRenew,
+		Revoke: b.secretVariableRevoke,
+	}
+}
+
+// variableTTLField returns the schema of the field that writes an
+// environment variable for the given TTL.
+func variableTTLField() *framework.FieldSchema {
+	return &framework.FieldSchema{
+		Type:        framework.TypeDurationSecond,
+		Description: "Write the variable for a limited time. When the lease expires or is revoked, the previous value is restored if it is stored, otherwise the variable is removed.",
+	}
+}
+
+// variableMaxTTLField returns the schema of the maximum TTL of the lease of a
+// time-limited environment variable.
+func variableMaxTTLField() *framework.FieldSchema {
+	return &framework.FieldSchema{
+		Type:        framework.TypeDurationSecond,
+		Description: "The maximum TTL the lease of a time-limited variable can be renewed to. Defaults to the mount's maximum.",
+	}
+}
+
+// variableLease returns the response of a time-limited environment variable,
+// which carries its lease of the given type. The lease records the update
+// CircleCI reported for the write, to leave the variable alone if it is
+// written again before the lease ends, and the version to restore, if any.
+func (b *backend) variableLease(secretType string, data map[string]interface{}, org, contextName string, written *apiContextVariable, previousVersion int, ttl, maxTTL time.Duration) *logical.Response {
+	resp := b.Secret(secretType).Response(data, map[string]interface{}{
+		"org":              org,
+		"context":          contextName,
+		"context_id":       written.ContextID,
+		"env":              written.Variable,
+		"updated_at":       written.UpdatedAt.Format(time.RFC3339Nano),
+		"previous_version": float64(previousVersion),
+		"ttl":              ttl.Seconds(),
+		"max_ttl":          maxTTL.Seconds(),
+	})
+	resp.Secret.TTL = ttl
+	resp.Secret.MaxTTL = maxTTL
+	return resp
+}
+
+// secretVariableRevoke restores the previous value of a time-limited
+// environment variable if it is stored, and removes the variable otherwise.
+// Variables written again since, through Vault, are kept. The lease releases
+// the version it pinned in every case.
+func (b *backend) secretVariableRevoke(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	org, _ := req.Secret.InternalData["org"].(string)
+	contextName, _ := req.Secret.InternalData["context"].(string)
+	contextID, _ := req.Secret.InternalData["context_id"].(string)
+	envVariable, _ := req.Secret.InternalData["env"].(string)
+	updatedAt, _ := req.Secret.InternalData["updated_at"].(string)
+	previousVersion, _ := req.Secret.InternalData["previous_version"].(float64)
+	if org == "" || contextID == "" || envVariable == "" {
+		return nil, errors.New("lease is missing the organization, context or name of the variable")
+	}
+
+	v, err := b.StoredVariable(ctx, req.Storage, org, contextName, envVariable)
+	if err != nil {
+		return nil, err
+	}
+	if v != nil && (v.ContextID != contextID || v.UpdatedAt.Format(time.RFC3339Nano) != updatedAt) {
+		b.Logger().Debug("Time-limited variable was written again, keeping it", "context", contextName, "contextID", contextID, "envVariable", envVariable)
+		return nil, b.unpinVersion(ctx, req.Storage, org, contextName, contextID, envVariable, int(previousVersion))
+	}
+
+	circleCIClient, err := b.CircleCIClient(req.Storage, org)
+	if err != nil {
+		return nil, err
+	}
+
+	if v != nil && previousVersion > 0 {
+		previous := v.Version(int(previousVersion))
+		if previous == nil {
+			// Leases written before versions were pinned may have lost theirs
+			b.Logger().Warn("Version to restore on lease expiry is no longer stored, keeping the variable", "context", contextName, "contextID", contextID, "envVariable", envVariable, "version", int(previousVersion))
+			return nil, nil
+		}
+		config, err := b.OrgConfig(ctx, req.Storage, org)
+		if err != nil {
+			return nil, err
+		}
+		written, err := circleCIClient.AddOrUpdateContextVariable(ctx, contextID, envVariable, previous.Value)
+		if errors.Is(err, circleci.ErrNotFound) {
+			// The context was deleted along with the variable
+			return nil, b.forgetVariable(ctx, req.Storage, org, contextName, envVariable)
+		}
+		if err != nil {
+			return nil, err
+		}
+		comment := fmt.Sprintf("restore version %d on lease expiry", previous.Version)
+		if _, err := b.recordVariable(ctx, req, org, config, contextName, written, previous.Value, comment); err != nil {
+			return nil, err
+		}
+		if err := b.unpinVersion(ctx, req.Storage, org, contextName, contextID, envVariable, previous.Version); err != nil {
+			return nil, err
+		}
+		b.Logger().Debug("Time-limited variable restored", "context", contextName, "contextID", contextID, "envVariable", envVariable, "version", previous.Version)
+		return nil, nil
+	}
+
+	if err := circleCIClient.Contexts.RemoveVariable(ctx, contextID, envVariable); err != nil && !errors.Is(err, circleci.ErrNotFound) {
+		return nil, err
+	}
+	if err := b.forgetVariable(ctx, req.Storage, org, contextName, envVariable); err != nil {
+		return nil, err
+	}
+	b.Logger().Debug("Time-limited variable removed", "context", contextName, "contextID", contextID, "envVariable", envVariable)
+	return nil, nil
+}
@@ -0,0 +1,177 @@
+package circleci
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestBackend_TimeLimitedVariable(t *testing.T) {
+	t.Parallel()
+
+	write := func(tb testing.TB, b *backend, storage logical.Storage, pth string, data map[string]interface{}) *logical.Response {
+		tb.Helper()
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      pth,
+			Data:      data,
+		})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return resp
+	}
+	revoke := func(tb testing.TB, b *backend, storage logical.Storage, secret *logical.Secret) {
+		tb.Helper()
+		if _, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.RevokeOperation,
+			Secret:    secret,
+		}); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	t.Run("removed", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+
+		resp := write(t, b, storage, "context/my-context/FOO", map[string]interface{}{"value": "bar", "ttl": "1h"})
+		if resp.Secret == nil || resp.Secret.TTL != time.Hour {
+			t.Fatalf("expected a lease of 1h, got %#v", resp.Secret)
+		}
+		if v := server.Value("my-context", "FOO"); v != "bar" {
+			t.Errorf("expected %q to be %q", v, "bar")
+		}
+
+		// Revoking twice is a no-op
+		revoke(t, b, storage, resp.Secret)
+		revoke(t, b, storage, resp.Secret)
+		if server.Variable("my-context", "FOO") != nil {
+			t.Errorf("expected the variable to be removed")
+		}
+		if v, err := b.StoredVariable(context.Background(), storage, defaultOrg, "my-context", "FOO"); err != nil || v != nil {
+			t.Errorf("expected the record to be deleted, got %#v, %v", v, err)
+		}
+	})
+
+	t.Run("restored", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		write(t, b, storage, "config", map[string]interface{}{"store-values": true})
+
+		write(t, b, storage, "context/my-context/FOO", map[string]interface{}{"value": "permanent"})
+		resp := write(t, b, storage, "context/my-context/FOO", map[string]interface{}{"value": "temporary", "ttl": "1h"})
+		if v := server.Value("my-context", "FOO"); v != "temporary" {
+			t.Errorf("expected %q to be %q", v, "temporary")
+		}
+
+		revoke(t, b, storage, resp.Secret)
+		if v := server.Value("my-context", "FOO"); v != "permanent" {
+			t.Errorf("expected %q to be %q", v, "permanent")
+		}
+		v, err := b.StoredVariable(context.Background(), storage, defaultOrg, "my-context", "FOO")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.CurrentVersion() != 3 || v.Value != "permanent" || v.Versions[2].Comment != "restore version 1 on lease expiry" {
+			t.Errorf("expected version 1 to be restored as version 3, got %#v", v.Versions[len(v.Versions)-1])
+		}
+	})
+
+	t.Run("restored_beyond_max_versions", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		write(t, b, storage, "config", map[string]interface{}{"store-values": true, "max-versions": 1})
+
+		write(t, b, storage, "context/my-context/FOO", map[string]interface{}{"value": "permanent"})
+		resp := write(t, b, storage, "context/my-context/FOO", map[string]interface{}{"value": "temporary", "ttl": "1h"})
+		v, err := b.StoredVariable(context.Background(), storage, defaultOrg, "my-context", "FOO")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if previous := v.Version(1); previous == nil || previous.Leases != 1 {
+			t.Fatalf("expected version 1 to be pinned by the lease, got %#v", previous)
+		}
+
+		revoke(t, b, storage, resp.Secret)
+		if v := server.Value("my-context", "FOO"); v != "permanent" {
+			t.Errorf("expected %q to be %q", v, "permanent")
+		}
+
+		// Once released, version 1 is dropped by the next write
+		write(t, b, storage, "context/my-context/FOO", map[string]interface{}{"value": "next"})
+		v, err = b.StoredVariable(context.Background(), storage, defaultOrg, "my-context", "FOO")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v.Versions) != 1 || v.CurrentVersion() != 4 {
+			t.Errorf("expected only version 4 to be kept, got %d versions up to %d", len(v.Versions), v.CurrentVersion())
+		}
+	})
+
+	t.Run("previous_version_missing", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		write(t, b, storage, "config", map[string]interface{}{"store-values": true})
+
+		write(t, b, storage, "context/my-context/FOO", map[string]interface{}{"value": "permanent"})
+		resp := write(t, b, storage, "context/my-context/FOO", map[string]interface{}{"value": "temporary", "ttl": "1h"})
+
+		// A lease naming a version that is no longer stored keeps the variable
+		resp.Secret.InternalData["previous_version"] = float64(7)
+		revoke(t, b, storage, resp.Secret)
+		if v := server.Value("my-context", "FOO"); v != "temporary" {
+			t.Errorf("expected %q to be %q", v, "temporary")
+		}
+		if v, err := b.StoredVariable(context.Background(), storage, defaultOrg, "my-context", "FOO"); err != nil || v == nil {
+			t.Errorf("expected the record to be kept, got %#v, %v", v, err)
+		}
+	})
+
+	t.Run("written_again", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+
+		resp := write(t, b, storage, "context/my-context/FOO", map[string]interface{}{"value": "temporary", "ttl": "1h"})
+		write(t, b, storage, "context/my-context/FOO", map[string]interface{}{"value": "permanent"})
+
+		revoke(t, b, storage, resp.Secret)
+		if v := server.Value("my-context", "FOO"); v != "permanent" {
+			t.Errorf("expected %q to be %q", v, "permanent")
+		}
+	})
+
+	t.Run("invalid_ttl", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "context/my-context/FOO",
+			Data:      map[string]interface{}{"value": "bar", "max_ttl": "1h"},
+		})
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 400 {
+			t.Errorf("expected 400, got %v", err)
+		}
+		if server.Variable("my-context", "FOO") != nil {
+			t.Errorf("expected the variable not to be written")
+		}
+	})
+}
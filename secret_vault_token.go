@@ -0,0 +1,126 @@
+package circleci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// secretTypeVaultToken is the type of the leases of Vault tokens minted into
+// environment variables.
+const secretTypeVaultToken = "vault_token"
+
+// walTypeVaultToken is the kind of the WAL entries of Vault tokens that are
+// being minted.
+const walTypeVaultToken = "vault_token"
+
+// walVaultToken is the WAL entry of a Vault token that is being minted. If
+// the request fails before the lease is returned, the token is revoked.
+type walVaultToken struct {
+	// RequestID identifies the request in the circleci_request metadata of
+	// the token. Tokens the request failed to record the accessor of are
+	// looked up by it.
+	RequestID string `json:"request_id,omitempty"`
+	Accessor  string `json:"accessor,omitempty"`
+}
+
+// secretVaultToken defines the leases of Vault tokens minted into environment
+// variables. They renew the token when they are renewed, and revoke the token
+// and remove the variable when they are revoked or expire.
+func (b *backend) secretVaultToken() *framework.Secret {
+	return &framework.Secret{
+		Type: secretTypeVaultToken,
+		Fields: map[string]*framework.FieldSchema{
+			"contextEnvironmentVariable": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The name of the environment variable holding the token.",
+			},
+			"accessor": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The accessor of the token.",
+			},
+		},
+		Renew:  b.secretVaultTokenRenew,
+		Revoke: b.secretVaultTokenRevoke,
+	}
+}
+
+// secretVaultTokenRenew renews the token by the TTL of the lease, and then
+// the lease.
+func (b *backend) secretVaultTokenRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	accessor, _ := req.Secret.InternalData["accessor"].(string)
+	ttl, _ := req.Secret.InternalData["ttl"].(float64)
+	if accessor == "" {
+		return nil, errors.New("lease is missing the accessor of the token")
+	}
+
+	client, err := b.VaultClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.Auth().Token().RenewAccessorWithContext(ctx, accessor, int(ttl)); err != nil {
+		return nil, errwrap.Wrapf("failed to renew Vault token: {{err}}", err)
+	}
+	return b.secretRenew(ctx, req, d)
+}
+
+// secretVaultTokenRevoke revokes the token and removes it from its variable,
+// unless the variable was written again since.
+func (b *backend) secretVaultTokenRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	accessor, _ := req.Secret.InternalData["accessor"].(string)
+	if accessor == "" {
+		return nil, errors.New("lease is missing the accessor of the token")
+	}
+
+	client, err := b.VaultClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if err := revokeVaultToken(ctx, client, accessor); err != nil {
+		return nil, err
+	}
+	b.Logger().Debug("Vault token revoked", "accessor", accessor)
+	return b.secretVariableRevoke(ctx, req, d)
+}
+
+// vaultTokenWALRollback revokes the token of the given WAL entry.
+func (b *backend) vaultTokenWALRollback(ctx context.Context, req *logical.Request, data interface{}) error {
+	// The entry is decoded from JSON into a map
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	var entry walVaultToken
+	if err := json.Unmarshal(encoded, &entry); err != nil {
+		return errwrap.Wrapf("failed to decode WAL entry: {{err}}", err)
+	}
+
+	client, err := b.VaultClient(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	accessors := []string{entry.Accessor}
+	if entry.Accessor == "" {
+		// The request failed before it recorded the accessor of the token,
+		// if it created one
+		if entry.RequestID == "" {
+			return nil
+		}
+		if accessors, err = findVaultTokens(ctx, client, entry.RequestID); err != nil {
+			return err
+		}
+	}
+
+	for _, accessor := range accessors {
+		b.Logger().Warn("Revoking Vault token whose lease was never returned", "accessor", accessor)
+		if err := revokeVaultToken(ctx, client, accessor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,501 @@
+package circleci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// fakeVault is an in-memory implementation of the parts of the Vault token
+// API used by the plugin.
+type fakeVault struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	tokens map[string]*fakeVaultToken
+	nextID int
+
+	// onCreate, if set, is called before each token is created.
+	onCreate func()
+
+	// dropCreated closes the connection instead of responding once a token
+	// is created.
+	dropCreated bool
+}
+
+type fakeVaultToken struct {
+	ID      string
+	Request api.TokenCreateRequest
+	Orphan  bool
+	Renewed int
+}
+
+// newFakeVault starts a new fake Vault server that is shut down when the test
+// finishes.
+func newFakeVault(tb testing.TB) *fakeVault {
+	tb.Helper()
+
+	f := &fakeVault{tokens: make(map[string]*fakeVaultToken)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	tb.Cleanup(f.Close)
+	return f
+}
+
+// Token returns the token with the given accessor, or nil if there is none.
+func (f *fakeVault) Token(accessor string) *fakeVaultToken {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t, ok := f.tokens[accessor]; ok {
+		copied := *t
+		return &copied
+	}
+	return nil
+}
+
+// Len returns the number of tokens that were not revoked.
+func (f *fakeVault) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.tokens)
+}
+
+func (f *fakeVault) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("X-Vault-Token") != "root" {
+		f.writeJSON(w, 403, map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v1/auth/token/create", "/v1/auth/token/create-orphan":
+		var body api.TokenCreateRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			f.writeJSON(w, 400, map[string]interface{}{"errors": []string{err.Error()}})
+			return
+		}
+		if f.onCreate != nil {
+			f.onCreate()
+		}
+		f.nextID++
+		token := &fakeVaultToken{
+			ID:      fmt.Sprintf("hvs.token-%d", f.nextID),
+			Request: body,
+			Orphan:  r.URL.Path == "/v1/auth/token/create-orphan",
+		}
+		accessor := fmt.Sprintf("accessor-%d", f.nextID)
+		f.tokens[accessor] = token
+		if f.dropCreated {
+			if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+				conn.Close()
+			}
+			return
+		}
+		f.writeJSON(w, 200, map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token": token.ID,
+				"accessor":     accessor,
+				"policies":     body.Policies,
+				"renewable":    true,
+			},
+		})
+
+	case "/v1/auth/token/accessors":
+		keys := make([]string, 0, len(f.tokens))
+		for accessor := range f.tokens {
+			keys = append(keys, accessor)
+		}
+		f.writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+
+	case "/v1/auth/token/lookup-accessor", "/v1/auth/token/renew-accessor", "/v1/auth/token/revoke-accessor":
+		var body struct {
+			Accessor string `json:"accessor"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			f.writeJSON(w, 400, map[string]interface{}{"errors": []string{err.Error()}})
+			return
+		}
+		token, ok := f.tokens[body.Accessor]
+		if !ok {
+			f.writeJSON(w, 400, map[string]interface{}{"errors": []string{"invalid accessor"}})
+			return
+		}
+		if r.URL.Path == "/v1/auth/token/lookup-accessor" {
+			f.writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{
+				"accessor": body.Accessor,
+				"meta":     token.Request.Metadata,
+			}})
+			return
+		}
+		if r.URL.Path == "/v1/auth/token/revoke-accessor" {
+			delete(f.tokens, body.Accessor)
+			w.WriteHeader(204)
+			return
+		}
+		token.Renewed++
+		f.writeJSON(w, 200, map[string]interface{}{"auth": map[string]interface{}{"accessor": body.Accessor}})
+
+	default:
+		f.writeJSON(w, 404, map[string]interface{}{"errors": []string{}})
+	}
+}
+
+func (f *fakeVault) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func TestBackend_PathVaultToken(t *testing.T) {
+	t.Parallel()
+
+	t.Run("field_validation", func(t *testing.T) {
+		t.Parallel()
+		testFieldValidation(t, logical.UpdateOperation, "config/vault")
+		testFieldValidation(t, logical.UpdateOperation, "vault-token-roles/deploy")
+		testFieldValidation(t, logical.UpdateOperation, "vault-token/deploy")
+	})
+
+	// setup configures the backend to mint tokens through a fake Vault with
+	// the role deploy.
+	setup := func(tb testing.TB) (*backend, logical.Storage, *fakeCircleCI, *fakeVault) {
+		tb.Helper()
+
+		b, storage, server := testBackendWithCircleCI(tb)
+		vault := newFakeVault(tb)
+		server.AddContext("my-context")
+		for pth, data := range map[string]map[string]interface{}{
+			"config/vault":             {"address": vault.URL, "token": "root"},
+			"vault-token-roles/deploy": {"policies": "deploy,read-secrets", "period": "1h"},
+		} {
+			if _, err := b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   storage,
+				Operation: logical.UpdateOperation,
+				Path:      pth,
+				Data:      data,
+			}); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		return b, storage, server, vault
+	}
+	mint := func(b *backend, storage logical.Storage) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "vault-token/deploy",
+			Data:      map[string]interface{}{"context": "my-context", "env": "VAULT_TOKEN"},
+		})
+	}
+
+	t.Run("lifecycle", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server, vault := setup(t)
+		ctx := context.Background()
+
+		resp, err := mint(b, storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Secret == nil || resp.Secret.TTL != time.Hour {
+			t.Fatalf("expected a lease of the period, got %#v", resp.Secret)
+		}
+		accessor := resp.Data["accessor"].(string)
+		token := vault.Token(accessor)
+		if token == nil {
+			t.Fatalf("expected token %q to be created", accessor)
+		}
+		if !token.Orphan || token.Request.Period != "3600s" || !reflect.DeepEqual(token.Request.Policies, []string{"deploy", "read-secrets"}) {
+			t.Errorf("unexpected token request %#v", token)
+		}
+		if v := server.Value("my-context", "VAULT_TOKEN"); v != token.ID {
+			t.Errorf("expected %q to be %q", v, token.ID)
+		}
+		if keys, err := framework.ListWAL(ctx, storage); err != nil || len(keys) != 0 {
+			t.Errorf("expected the WAL entry to be deleted, got %q, %v", keys, err)
+		}
+
+		secret := resp.Secret
+		secret.IssueTime = time.Now()
+		if _, err := b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.RenewOperation,
+			Secret:    secret,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if token := vault.Token(accessor); token.Renewed != 1 {
+			t.Errorf("expected the token to be renewed once, got %d", token.Renewed)
+		}
+
+		for i := 0; i < 2; i++ {
+			if _, err := b.HandleRequest(ctx, &logical.Request{
+				Storage:   storage,
+				Operation: logical.RevokeOperation,
+				Secret:    secret,
+			}); err != nil {
+				t.Fatalf("revoke %d: %v", i, err)
+			}
+		}
+		if vault.Token(accessor) != nil {
+			t.Errorf("expected the token to be revoked")
+		}
+		if server.Variable("my-context", "VAULT_TOKEN") != nil {
+			t.Errorf("expected the variable to be removed")
+		}
+	})
+
+	t.Run("write_failed", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server, vault := setup(t)
+		server.SetIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+			if r.Method == http.MethodPut {
+				w.WriteHeader(403)
+				return true
+			}
+			return false
+		})
+
+		if _, err := mint(b, storage); err == nil {
+			t.Fatal("expected error")
+		}
+		if n := vault.Len(); n != 0 {
+			t.Errorf("expected the token to be revoked, %d left", n)
+		}
+	})
+
+	t.Run("wal_before_mint", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, _, vault := setup(t)
+		var walEntries []string
+		vault.onCreate = func() {
+			walEntries, _ = framework.ListWAL(context.Background(), storage)
+		}
+		resp, err := mint(b, storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(walEntries) != 1 {
+			t.Fatalf("expected a WAL entry while the token is created, got %q", walEntries)
+		}
+		wal, err := framework.GetWAL(context.Background(), storage, walEntries[0])
+		if err != nil || wal != nil {
+			t.Errorf("expected the WAL entry to be deleted, got %v, %v", wal, err)
+		}
+		if keys, err := framework.ListWAL(context.Background(), storage); err != nil || len(keys) != 0 {
+			t.Errorf("expected no WAL entries, got %q, %v", keys, err)
+		}
+		if token := vault.Token(resp.Data["accessor"].(string)); token == nil || token.Request.Metadata["circleci_request"] == "" {
+			t.Errorf("expected the token to carry the request in its metadata, got %#v", token)
+		}
+	})
+
+	t.Run("wal_rollback", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, _, vault := setup(t)
+		resp, err := mint(b, storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// WAL entries are decoded from JSON
+		data := map[string]interface{}{"accessor": resp.Data["accessor"]}
+		for i := 0; i < 2; i++ {
+			if err := b.walRollback(context.Background(), &logical.Request{Storage: storage}, walTypeVaultToken, data); err != nil {
+				t.Fatalf("rollback %d: %v", i, err)
+			}
+		}
+		if n := vault.Len(); n != 0 {
+			t.Errorf("expected the token to be revoked, %d left", n)
+		}
+
+		// Entries written before the token was created have no accessor
+		data = map[string]interface{}{"request_id": "f81d4fae-7dec-11d0-a765-00a0c91e6bf6"}
+		if err := b.walRollback(context.Background(), &logical.Request{Storage: storage}, walTypeVaultToken, data); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("response_dropped", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, _, vault := setup(t)
+		vault.dropCreated = true
+		if _, err := mint(b, storage); err == nil {
+			t.Fatal("expected error")
+		}
+		if vault.Len() == 0 {
+			t.Fatal("expected the token to be created")
+		}
+
+		// The token is only known by the metadata the WAL entry names
+		keys, err := framework.ListWAL(context.Background(), storage)
+		if err != nil || len(keys) != 1 {
+			t.Fatalf("expected the WAL entry to be kept, got %q, %v", keys, err)
+		}
+		if _, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.RollbackOperation,
+			Data:      map[string]interface{}{"immediate": true},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n := vault.Len(); n != 0 {
+			t.Errorf("expected the token to be revoked, %d left", n)
+		}
+		if keys, err := framework.ListWAL(context.Background(), storage); err != nil || len(keys) != 0 {
+			t.Errorf("expected no WAL entries, got %q, %v", keys, err)
+		}
+	})
+
+	t.Run("create_rejected", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, _, vault := setup(t)
+		if _, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "config/vault",
+			Data:      map[string]interface{}{"address": vault.URL, "token": "wrong"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// A request Vault rejected created no token to roll back
+		if _, err := mint(b, storage); err == nil {
+			t.Fatal("expected error")
+		}
+		if keys, err := framework.ListWAL(context.Background(), storage); err != nil || len(keys) != 0 {
+			t.Errorf("expected no WAL entries, got %q, %v", keys, err)
+		}
+	})
+
+	t.Run("not_configured", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage, server := testBackendWithCircleCI(t)
+		server.AddContext("my-context")
+		if _, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "vault-token-roles/deploy",
+			Data:      map[string]interface{}{"policies": "deploy"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := mint(b, storage)
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 400 {
+			t.Errorf("expected 400, got %v", err)
+		}
+	})
+
+	t.Run("role_without_policies", func(t *testing.T) {
+		t.Parallel()
+
+		b, storage := testBackend(t)
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.CreateOperation,
+			Path:      "vault-token-roles/deploy",
+			Data:      map[string]interface{}{"period": "1h"},
+		})
+		if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != 400 {
+			t.Errorf("expected 400, got %v", err)
+		}
+	})
+}
+
+// TestAcc_VaultToken mints a token through a real Vault server, e.g. one
+// started with:
+//
+//	vault server -dev -dev-root-token-id=root
+//
+// It runs with VAULT_ACC=1 and connects to VAULT_ADDR with VAULT_TOKEN.
+func TestAcc_VaultToken(t *testing.T) {
+	if os.Getenv("VAULT_ACC") == "" {
+		t.Skip("set VAULT_ACC=1 to run acceptance tests against VAULT_ADDR")
+	}
+
+	client, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Token() == "" {
+		t.Fatal("missing VAULT_TOKEN")
+	}
+
+	b, storage, server := testBackendWithCircleCI(t)
+	server.AddContext("my-context")
+	ctx := context.Background()
+
+	write := func(pth string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      pth,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	write("config/vault", map[string]interface{}{"address": client.Address(), "token": client.Token()})
+	write("vault-token-roles/acc", map[string]interface{}{"policies": "default", "period": "1h"})
+	resp := write("vault-token/acc", map[string]interface{}{"context": "my-context", "env": "VAULT_TOKEN"})
+	accessor := resp.Data["accessor"].(string)
+
+	token, err := client.Auth().Token().LookupAccessor(accessor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orphan, _ := token.Data["orphan"].(bool); !orphan {
+		t.Errorf("expected an orphan token, got %v", token.Data)
+	}
+	if period, _ := token.Data["period"].(json.Number); period.String() != "3600" {
+		t.Errorf("expected a period of 3600, got %v", token.Data["period"])
+	}
+	minted, err := client.Auth().Token().Lookup(server.Value("my-context", "VAULT_TOKEN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if minted.Data["accessor"] != accessor {
+		t.Errorf("expected the token of %q to be written to the context", accessor)
+	}
+
+	secret := resp.Secret
+	secret.IssueTime = time.Now()
+	for _, op := range []logical.Operation{logical.RenewOperation, logical.RevokeOperation} {
+		if _, err := b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Secret:    secret,
+		}); err != nil {
+			t.Fatalf("%s: %v", op, err)
+		}
+	}
+	if _, err := client.Auth().Token().LookupAccessor(accessor); err == nil {
+		t.Errorf("expected the token to be revoked")
+	}
+	if server.Variable("my-context", "VAULT_TOKEN") != nil {
+		t.Errorf("expected the variable to be removed")
+	}
+}
@@ -0,0 +1,253 @@
+package circleci
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// variablesPrefix is the storage prefix of the records of the environment
+// variables written through Vault. It is seal-wrapped, as the records may
+// contain the values.
+const variablesPrefix = "variables/"
+
+// defaultMaxVersions is the default number of versions kept per variable.
+const defaultMaxVersions = 10
+
+// storedVariable is the record of an environment variable written through
+// Vault.
+type storedVariable struct {
+	ContextID string    `json:"context_id"`
+	WrittenAt time.Time `json:"written_at"`
+
+	// UpdatedAt is the time of the last update CircleCI reported for the
+	// write. A later update in CircleCI was made outside of Vault.
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+
+	// Value is the written value. It is only stored if the organization is
+	// configured with store-values.
+	Value string `json:"value,omitempty"`
+
+	// Versions are the values written, oldest first. At most max-versions
+	// are kept, besides the versions pinned by leases.
+	Versions []*variableVersion `json:"versions,omitempty"`
+
+	// SSHKey is the public key of the SSH keypair generated into the
+	// variable, if any.
+	SSHKey *sshKeyInfo `json:"ssh_key,omitempty"`
+}
+
+// sshKeyInfo is the public part of an SSH keypair generated into an
+// environment variable. The private key is never stored.
+type sshKeyInfo struct {
+	KeyType     string `json:"key_type"`
+	PublicKey   string `json:"public_key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// variableVersion is a value of an environment variable written through
+// Vault.
+type variableVersion struct {
+	Version   int       `json:"version"`
+	Value     string    `json:"value"`
+	WrittenAt time.Time `json:"written_at"`
+	WrittenBy string    `json:"written_by,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+
+	// Leases is the number of outstanding leases of time-limited writes that
+	// restore this version when they end. The version is kept until then.
+	Leases int `json:"leases,omitempty"`
+}
+
+// CurrentVersion returns the number of the latest version, or 0 if there are
+// no versions.
+func (v *storedVariable) CurrentVersion() int {
+	if len(v.Versions) == 0 {
+		return 0
+	}
+	return v.Versions[len(v.Versions)-1].Version
+}
+
+// Version returns the given version, or nil if it is not kept.
+func (v *storedVariable) Version(n int) *variableVersion {
+	for _, version := range v.Versions {
+		if version.Version == n {
+			return version
+		}
+	}
+	return nil
+}
+
+// addVersion numbers the given version, makes it the current value and drops
+// the oldest versions beyond maxVersions that are not pinned by a lease.
+func (v *storedVariable) addVersion(version *variableVersion, maxVersions int) {
+	version.Version = v.CurrentVersion() + 1
+	v.Value = version.Value
+	v.WrittenAt = version.WrittenAt
+	v.Versions = append(v.Versions, version)
+
+	drop := len(v.Versions) - maxVersions
+	kept := v.Versions[:0]
+	for _, old := range v.Versions {
+		if drop > 0 && old.Leases == 0 && old != version {
+			drop--
+			continue
+		}
+		kept = append(kept, old)
+	}
+	v.Versions = kept
+}
+
+// variableLock returns the lock of the record of the given environment
+// variable.
+func (b *backend) variableLock(org, contextName, envVariable string) *locksutil.LockEntry {
+	return locksutil.LockForKey(b.variableLocks, variableKey(org, contextName, envVariable))
+}
+
+// variableKey returns the storage key of the record of the given environment
+// variable.
+func variableKey(org, contextName, envVariable string) string {
+	return variablesPrefix + org + "/" + contextName + "/" + envVariable
+}
+
+// StoredVariable returns the record of the given environment variable, or nil
+// if there is none.
+func (b *backend) StoredVariable(ctx context.Context, s logical.Storage, org, contextName, envVariable string) (*storedVariable, error) {
+	entry, err := s.Get(ctx, variableKey(org, contextName, envVariable))
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to get variable from storage: {{err}}", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var v storedVariable
+	if err := entry.DecodeJSON(&v); err != nil {
+		return nil, errwrap.Wrapf("failed to decode variable: {{err}}", err)
+	}
+	return &v, nil
+}
+
+// putStoredVariable stores the record of the given environment variable.
+func (b *backend) putStoredVariable(ctx context.Context, s logical.Storage, org, contextName, envVariable string, v *storedVariable) error {
+	entry, err := logical.StorageEntryJSON(variableKey(org, contextName, envVariable), v)
+	if err != nil {
+		return errwrap.Wrapf("failed to generate JSON variable: {{err}}", err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return errwrap.Wrapf("failed to persist variable to storage: {{err}}", err)
+	}
+	return nil
+}
+
+// recordVariable records the environment variable written to CircleCI with
+// the time of the update CircleCI reported, to detect changes made outside of
+// Vault. If the organization is configured with store-values, the value is
+// recorded as a new version, which is returned. Otherwise, only the metadata
+// is recorded: the current value stored before is dropped, but the versions
+// written while store-values was enabled are kept.
+func (b *backend) recordVariable(ctx context.Context, req *logical.Request, org string, config *Config, contextName string, written *apiContextVariable, value, comment string) (*variableVersion, error) {
+	version, _, err := b.updateRecord(ctx, req, org, config, contextName, written, value, comment, false)
+	return version, err
+}
+
+// recordLeasedVariable records a time-limited environment variable like
+// recordVariable, and pins the version it replaced so that it is kept until
+// the lease restores it. The number of the pinned version is returned, or 0
+// if the value replaced is not stored.
+func (b *backend) recordLeasedVariable(ctx context.Context, req *logical.Request, org string, config *Config, contextName string, written *apiContextVariable, value, comment string) (*variableVersion, int, error) {
+	return b.updateRecord(ctx, req, org, config, contextName, written, value, comment, true)
+}
+
+// updateRecord implements recordVariable and recordLeasedVariable.
+func (b *backend) updateRecord(ctx context.Context, req *logical.Request, org string, config *Config, contextName string, written *apiContextVariable, value, comment string, pin bool) (*variableVersion, int, error) {
+	lock := b.variableLock(org, contextName, written.Variable)
+	lock.Lock()
+	defer lock.Unlock()
+
+	v, err := b.StoredVariable(ctx, req.Storage, org, contextName, written.Variable)
+	if err != nil {
+		return nil, 0, err
+	}
+	// A context recreated outside of Vault starts a new history
+	if v == nil || v.ContextID != written.ContextID {
+		v = &storedVariable{ContextID: written.ContextID}
+	}
+	v.UpdatedAt = written.UpdatedAt
+	v.SSHKey = nil
+
+	// The value replaced is only stored as the current version
+	var pinned int
+	if current := v.Version(v.CurrentVersion()); pin && v.Value != "" && current != nil {
+		current.Leases++
+		pinned = current.Version
+	}
+
+	now := time.Now().UTC()
+	if !config.StoreValues {
+		v.WrittenAt = now
+		v.Value = ""
+		return nil, pinned, b.putStoredVariable(ctx, req.Storage, org, contextName, written.Variable, v)
+	}
+
+	version := &variableVersion{
+		Value:     value,
+		WrittenAt: now,
+		WrittenBy: req.EntityID,
+		Comment:   comment,
+	}
+	v.addVersion(version, config.maxVersions())
+	if err := b.putStoredVariable(ctx, req.Storage, org, contextName, written.Variable, v); err != nil {
+		return nil, 0, err
+	}
+	return version, pinned, nil
+}
+
+// unpinVersion releases the pin a lease holds on the given version of an
+// environment variable of the given context ID, if it is still recorded.
+func (b *backend) unpinVersion(ctx context.Context, s logical.Storage, org, contextName, contextID, envVariable string, n int) error {
+	lock := b.variableLock(org, contextName, envVariable)
+	lock.Lock()
+	defer lock.Unlock()
+
+	v, err := b.StoredVariable(ctx, s, org, contextName, envVariable)
+	if err != nil {
+		return err
+	}
+	if v == nil || v.ContextID != contextID {
+		return nil
+	}
+	version := v.Version(n)
+	if version == nil || version.Leases == 0 {
+		return nil
+	}
+	version.Leases--
+	return b.putStoredVariable(ctx, s, org, contextName, envVariable, v)
+}
+
+// deleteStoredVariable deletes the record of the given environment variable.
+func (b *backend) deleteStoredVariable(ctx context.Context, s logical.Storage, org, contextName, envVariable string) error {
+	if err := s.Delete(ctx, variableKey(org, contextName, envVariable)); err != nil {
+		return errwrap.Wrapf("failed to delete variable from storage: {{err}}", err)
+	}
+	return nil
+}
+
+// deleteStoredContext deletes the records of all environment variables of the
+// given context.
+func (b *backend) deleteStoredContext(ctx context.Context, s logical.Storage, org, contextName string) error {
+	prefix := variablesPrefix + org + "/" + contextName + "/"
+	keys, err := s.List(ctx, prefix)
+	if err != nil {
+		return errwrap.Wrapf("failed to list variables: {{err}}", err)
+	}
+	for _, key := range keys {
+		if err := s.Delete(ctx, prefix+key); err != nil {
+			return errwrap.Wrapf("failed to delete variable from storage: {{err}}", err)
+		}
+	}
+	return nil
+}